@@ -28,14 +28,20 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -49,6 +55,9 @@ import (
 
 const VOID = "void?"
 
+// API_PREFIX is the path of the current version of the api
+const API_PREFIX = "/v0"
+
 var (
 	VERSION string
 	BUILD   string
@@ -61,7 +70,7 @@ var (
 	driver     func(string) gorm.Dialector
 	database   *gorm.DB
 	multiplex  = mux.NewRouter()
-	httpRouter = multiplex.PathPrefix("/v0").Subrouter()
+	httpRouter = multiplex.PathPrefix(API_PREFIX).Subrouter()
 )
 
 type config struct {
@@ -69,7 +78,18 @@ type config struct {
 	address    string
 	timeout    time.Duration
 	backupFile zipBackup
+	backupSave zipBackup
 	batchSize  int
+	schedule   time.Duration
+	catchUp    bool
+
+	journalRecords int
+	authenticate   bool
+
+	tlsCert       string
+	tlsKey        string
+	tlsClientCA   string
+	tlsSelfSigned bool
 }
 
 type zipBackup struct {
@@ -153,10 +173,19 @@ func init() {
 }
 
 func shell() {
-	flag.StringVar(&args.address, "bind", "127.0.0.1:9121", "address to bind")
+	flag.StringVar(&args.address, "bind", "127.0.0.1:9121", "address to bind, or unix:/path/to/socket (ignored on socket activation)")
 	flag.DurationVar(&args.timeout, "timeout", time.Second*60, "http i/o timeout")
 	flag.IntVar(&args.batchSize, "batch", 1000, "batch size for database i/o")
 	flag.Var(&args.backupFile, "restore", "optional backup to restore on boot")
+	flag.Var(&args.backupSave, "backup", "optional zip file to save a backup on boot")
+	flag.DurationVar(&args.schedule, "schedule", time.Hour, "interval to materialize recurring templates (0 to disable)")
+	flag.BoolVar(&args.catchUp, "catchup", true, "materialize templates missed while the process was down")
+	flag.IntVar(&args.journalRecords, "journal-records", 1000000, "records and features the journal keeps in memory (0 for unlimited)")
+	flag.BoolVar(&args.authenticate, "auth", LICENSE == "cloud", "require api keys on every request (see keys command)")
+	flag.StringVar(&args.tlsCert, "tls-cert", "", "certificate to serve https, reloaded on SIGHUP or change")
+	flag.StringVar(&args.tlsKey, "tls-key", "", "private key of the certificate to serve https")
+	flag.StringVar(&args.tlsClientCA, "tls-client-ca", "", "optional bundle of authorities to verify client certificates")
+	flag.BoolVar(&args.tlsSelfSigned, "tls-selfsigned", false, "serve https with a generated certificate if none exists")
 	flag.Parse()
 }
 
@@ -165,6 +194,50 @@ func main() {
 	awake() // various checks and constraints lookup, e.g. has registry been installed? has backup been restored?
 	setup() // setup the connection to the main database pool and allocate it globally for other modules to use
 
+	{ /* begin setup for keys module */
+		mod := keys{database, args.batchSize}
+		if err := mod.Install(); err != nil {
+			panic(err)
+		}
+
+		if flag.Arg(0) == "keys" { // manage keys from the shell and exit
+			if err := mod.Command(flag.Args()[1:], os.Stdout); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			return
+		}
+
+		if args.authenticate {
+			httpRouter.Use(mod.Authenticate)
+		} else {
+			fmt.Println("WARNING: api keys are not required, anyone who can connect has full access")
+		}
+
+		mod.Setup(httpRouter)
+	} /* done with keys module */
+
+	{ /* begin setup for households module */
+		mod := households{database, args.batchSize}
+		if err := mod.Install(); err != nil {
+			panic(err)
+		}
+
+		httpRouter.Use(mod.Dispatch) // after authentication, principals are known
+		mod.Setup(httpRouter)
+		mod.MountAll()
+	} /* done with households module */
+
+	{ /* begin setup for grants module */
+		mod := grants{database, args.batchSize}
+		if err := mod.Install(); err != nil {
+			panic(err)
+		}
+
+		httpRouter.Use(mod.Enforce) // after households, grants are bound to one
+		mod.Setup(httpRouter)
+	} /* done with grants module */
+
 	{ /* begin setup for registry module */
 		if gospodapi.IsRegistryInstalled {
 			fmt.Println("NOTICE: registry has been previously installed ...")
@@ -187,11 +260,73 @@ func main() {
 		mod.Setup(httpRouter)
 	} /* done with registry module */
 
+	{ /* begin setup for signatures module */
+		mod := signatures{database, args.batchSize}
+		if err := mod.Install(); err != nil {
+			panic(err)
+		}
+
+		mod.Setup(httpRouter)
+	} /* done with signatures module */
+
 	{ /* begin setup for journal module */
 		mod := journal{database, args.batchSize}
+		if err := mod.Install(); err != nil {
+			panic(err)
+		}
+
+		memory.SetLimit(args.journalRecords)
 		mod.Setup(httpRouter)
 	} /* done with journal module */
 
+	{ /* begin setup for transfers module */
+		mod := transfers{database, args.batchSize}
+		if err := mod.Install(); err != nil {
+			panic(err)
+		}
+
+		mod.Setup(httpRouter)
+	} /* done with transfers module */
+
+	{ /* begin setup for budgets module */
+		mod := budgets{database, args.batchSize}
+		if err := mod.Install(); err != nil {
+			panic(err)
+		}
+
+		mod.Setup(httpRouter)
+	} /* done with budgets module */
+
+	{ /* begin setup for insights module */
+		mod := insights{database, args.batchSize}
+		mod.Setup(httpRouter)
+	} /* done with insights module */
+
+	{ /* begin setup for jobs module */
+		mod := jobs{database, args.batchSize}
+		mod.Setup(httpRouter)
+	} /* done with jobs module */
+
+	{ /* begin setup for backups module */
+		mod := backups{database, args.batchSize}
+		mod.Setup(httpRouter)
+	} /* done with backups module */
+
+	{ /* begin setup for templates module */
+		mod := templates{database, args.batchSize, time.Now}
+		if err := mod.Install(); err != nil {
+			panic(err)
+		}
+
+		mod.Setup(httpRouter)
+	} /* done with templates module */
+
+	{ /* begin setup for metrics module */
+		mod := metrics{database, args.batchSize, args.authenticate}
+		multiplex.Use(mod.Instrument) // every route, including households
+		mod.Setup(multiplex)          // next to the healthcheck, outside the api
+	} /* done with metrics module */
+
 	{ /* begin backup restore from zip file */
 		if args.backupFile.set {
 			if gospodapi.LastBackupRestored == args.backupFile.value {
@@ -205,6 +340,23 @@ func main() {
 		}
 	} /* done with backup restore */
 
+	{ /* begin backup save into zip file */
+		if args.backupSave.set {
+			if err := backup(database, args.backupSave.value); err != nil {
+				panic(err)
+			}
+
+			fmt.Printf("Succesfully saved backup into zip %v\n", args.backupSave.value)
+		}
+	} /* done with backup save */
+
+	{ /* begin scheduler for recurring templates */
+		if args.schedule > 0 {
+			mod := templates{database, args.batchSize, time.Now}
+			mod.Schedule(args.schedule, args.catchUp)
+		}
+	} /* done with scheduler */
+
 	fmt.Printf(`Booting v%s_%s; %s; %s ...
 
                                    _              _
@@ -283,12 +435,69 @@ func start() {
 
 	multiplex.HandleFunc("/", status) // register process healthcheck
 
-	log.Printf("Ready to serve HTTP requests on %s (timeout %v)\n", addr, tout)
-	log.Fatal(server.ListenAndServe())
+	listeners, err := _listeners(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg, certs, err := _tlsConfig(args.tlsCert, args.tlsKey, args.tlsClientCA, args.tlsSelfSigned)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	scheme := "HTTP"
+	if cfg != nil {
+		go certs.Watch(TLS_RELOAD_INTERVAL)
+		server.TLSConfig = cfg
+		scheme = "HTTPS"
+
+		for i, listener := range listeners {
+			listeners[i] = tls.NewListener(listener, cfg)
+		}
+	}
+
+	stopped := make(chan struct{}) // closed once in-flight requests are done
+	go func() {
+		shutdown := make(chan os.Signal, 1)
+		signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+		<-shutdown
+
+		_notify("STOPPING=1")
+		log.Printf("Shutting down, waiting up to %v for requests in progress ...\n", tout)
+
+		ctx, cancel := context.WithTimeout(context.Background(), tout)
+		defer cancel()
+
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("warning: %s\n", err)
+		}
+		close(stopped)
+	}()
+
+	if interval, err := _watchdogInterval(); err != nil {
+		log.Fatal(err)
+	} else if interval > 0 {
+		go _watchdog(interval, stopped)
+	}
+
+	served := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		log.Printf("Ready to serve %s requests on %s (timeout %v)\n", scheme, listener.Addr(), tout)
+		go func(listener net.Listener) { served <- server.Serve(listener) }(listener)
+	}
+
+	_notify(fmt.Sprintf("READY=1\nSTATUS=serving %s requests on %d socket(s)", scheme, len(listeners)))
+
+	if err := <-served; err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	<-stopped
 }
 
 func clean() {
-	// close api
+	gospodapi.LastGracefulShutdown = time.Now().Unix()
+	gospodapi.Save()
 }
 
 type introspection struct {
@@ -352,6 +561,42 @@ func (r Response) Wrong(err error, req *http.Request) {
 	log.Printf(" %5s %-80s [400] %12v\n", req.Method, req.URL.Path, err)
 }
 
+func (r Response) Unauthorized(err error, req *http.Request) {
+	r.Writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	r.Writer.Header().Set("X-Server", fmt.Sprintf("gospodapi v%s_%s; %s; %s", VERSION, LICENSE, OSARCH, BUILD))
+	r.Writer.Header().Set("WWW-Authenticate", `Bearer realm="gospodapi"`)
+	r.Writer.WriteHeader(http.StatusUnauthorized)
+
+	fmt.Fprint(r.Writer, err.Error())
+	log.Printf(" %5s %-80s [401] %12v\n", req.Method, req.URL.Path, err)
+}
+
+// Forbidden answers with a json error, structured if it's an accessDenied
+func (r Response) Forbidden(err error, req *http.Request) {
+	var denied accessDenied
+	if !errors.As(err, &denied) {
+		denied = accessDenied{Reason: err.Error()}
+	}
+
+	output, _ := json.Marshal(denied)
+
+	r.Writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	r.Writer.Header().Set("X-Server", fmt.Sprintf("gospodapi v%s_%s; %s; %s", VERSION, LICENSE, OSARCH, BUILD))
+	r.Writer.WriteHeader(http.StatusForbidden)
+
+	fmt.Fprint(r.Writer, string(output))
+	log.Printf(" %5s %-80s [403] %12v\n", req.Method, req.URL.Path, err)
+}
+
+func (r Response) Missing(err error, req *http.Request) {
+	r.Writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	r.Writer.Header().Set("X-Server", fmt.Sprintf("gospodapi v%s_%s; %s; %s", VERSION, LICENSE, OSARCH, BUILD))
+	r.Writer.WriteHeader(http.StatusNotFound)
+
+	fmt.Fprint(r.Writer, err.Error())
+	log.Printf(" %5s %-80s [404] %12v\n", req.Method, req.URL.Path, err)
+}
+
 func (r Response) Fault(err error, req *http.Request) {
 	r.Writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	r.Writer.Header().Set("X-Server", fmt.Sprintf("gospodapi v%s_%s; %s; %s", VERSION, LICENSE, OSARCH, BUILD))
@@ -378,7 +623,9 @@ func (r Response) Okay(output []byte, isCached bool, lap time.Duration, req *htt
 }
 
 func (r Response) OkayStream(output []byte, isCached bool, lap time.Duration, req *http.Request) {
-	r.Writer.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	if r.Writer.Header().Get("Content-Type") == "" {
+		r.Writer.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	}
 	r.Writer.Header().Set("X-Benchmark", fmt.Sprintf("%v", lap))
 	r.Writer.Header().Set("X-Server", fmt.Sprintf("gospodapi v%s_%s; %s; %s", VERSION, LICENSE, OSARCH, BUILD))
 	r.Writer.WriteHeader(http.StatusOK)
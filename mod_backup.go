@@ -31,18 +31,24 @@ import (
 	"archive/zip"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/lexndru/expenses"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type uploader struct {
 	Transactions expenses.Transactions
 	Actors       expenses.Actors
 	Labels       expenses.Labels
+	Models       []journalModel
+	Signatures   []signatureMetadata
 }
 
 func (u *uploader) LockZip(zfp string) (exists bool, err error) {
@@ -92,6 +98,10 @@ func (u *uploader) FromZip(zfp string) (err error) {
 			err = expenses.FromJson(unpack(file), &u.Actors)
 		} else if file.Name == "reg_labels.json" {
 			err = expenses.FromJson(unpack(file), &u.Labels)
+		} else if file.Name == "jrn_models.json" {
+			err = expenses.FromJson(unpack(file), &u.Models)
+		} else if file.Name == "sig_metadata.json" {
+			err = expenses.FromJson(unpack(file), &u.Signatures)
 		} else {
 			fmt.Printf("Unsupported file to unpack: %s\n", file.Name)
 		}
@@ -114,10 +124,210 @@ func (u *uploader) Commit(ctx expenses.PushContext) {
 	mustPush(ctx, &u.Actors)
 	mustPush(ctx, &u.Labels)
 	mustPush(ctx, &u.Transactions)
+
+	if len(u.Models) > 0 {
+		q := ctx.Storage.Clauses(clause.OnConflict{UpdateAll: true})
+		if err := q.CreateInBatches(&u.Models, ctx.BatchSize).Error; err != nil {
+			panic(err)
+		}
+	}
+
+	if len(u.Signatures) > 0 {
+		q := ctx.Storage.Clauses(clause.OnConflict{UpdateAll: true})
+		if err := q.CreateInBatches(&u.Signatures, ctx.BatchSize).Error; err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (u *uploader) Collect(db *gorm.DB) error {
+	ctx := expenses.PullContext{Storage: db} // no limit, everything is saved
+
+	if err := u.Actors.Pull(ctx); err != nil {
+		return err
+	}
+
+	if err := u.Labels.Pull(ctx); err != nil {
+		return err
+	}
+
+	if err := u.Transactions.Pull(ctx); err != nil {
+		return err
+	}
+
+	if err := db.Order("signature").Find(&u.Models).Error; err != nil {
+		return err
+	}
+
+	if !db.Migrator().HasTable(&signatureMetadata{}) {
+		return nil // signatures module is not installed
+	}
+
+	return db.Order("signature").Find(&u.Signatures).Error
+}
+
+func (u *uploader) ToZip(zfp string) (err error) {
+	var fd *os.File
+	if fd, err = os.Create(zfp); err != nil {
+		return
+	}
+
+	defer fd.Close()
+
+	zw := zip.NewWriter(fd)
+	pack := func(name string, src interface{}) error {
+		if bytez, err := expenses.ToJson(src); err != nil {
+			return err
+		} else if w, err := zw.Create(name); err != nil {
+			return err
+		} else {
+			_, err = w.Write(bytez)
+			return err
+		}
+	}
+
+	files := []struct {
+		name string
+		src  interface{}
+	}{
+		{"reg_actors.json", u.Actors},
+		{"reg_labels.json", u.Labels},
+		{"reg_transactions.json", u.Transactions},
+		{"jrn_models.json", u.Models},
+		{"sig_metadata.json", u.Signatures},
+	}
+
+	for _, file := range files {
+		if err = pack(file.name, file.src); err != nil {
+			return
+		}
+	}
+
+	return zw.Close()
+}
+
+func backup(db *gorm.DB, zipfile string) (err error) {
+	defer func() { backupOperations.Inc("save", _result(err)) }()
+
+	u := uploader{}
+	if err = u.Collect(db); err != nil {
+		return err
+	}
+
+	return u.ToZip(zipfile)
 }
 
 func restore(db *gorm.DB, batch int, zipfile string) {
 	u := uploader{}
 	u.FromZip(zipfile)
 	u.Commit(expenses.PushContext{Storage: db, BatchSize: batch})
+
+	backupOperations.Inc("restore", _result(nil))
+	importedTransactions.Add(float64(len(u.Transactions)), "restore")
+}
+
+// _result labels the outcome of an operation in metrics
+func _result(err error) string {
+	if err != nil {
+		return "error"
+	}
+
+	return "ok"
+}
+
+// backups serves the backup of a household as a zip and restores it, the
+// same as -backup and -restore do on boot for the default household
+type backups struct {
+	dbInstance  *gorm.DB
+	dbBatchSize int
+}
+
+func (b backups) Setup(router *mux.Router) {
+	router.HandleFunc("/backup", b.download).Methods(http.MethodGet)
+	router.HandleFunc("/backup", b.upload).Methods(http.MethodPost)
+}
+
+func (b backups) download(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	dir, err := ioutil.TempDir("", "gospodapi")
+	if err != nil {
+		response.Fault(err, rq)
+		return
+	}
+
+	defer os.RemoveAll(dir)
+
+	zipfile := filepath.Join(dir, "backup.zip")
+	if err := backup(b.dbInstance, zipfile); err != nil {
+		response.Fault(err, rq)
+	} else if output, err := ioutil.ReadFile(zipfile); err != nil {
+		response.Fault(err, rq)
+	} else {
+		name := fmt.Sprintf("gospodapi-%s.zip", startTime.Format("2006-01-02"))
+		wr.Header().Set("Content-Type", "application/zip")
+		wr.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		response.OkayStream(output, false, time.Since(startTime), rq)
+	}
+}
+
+func (b backups) upload(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	dir, err := ioutil.TempDir("", "gospodapi")
+	if err != nil {
+		response.Fault(err, rq)
+		return
+	}
+
+	defer os.RemoveAll(dir)
+
+	zipfile := filepath.Join(dir, "restore.zip")
+	if payload, err := ioutil.ReadAll(rq.Body); err != nil { // TODO: avoid ioutil because of memory issues?
+		response.Fault(err, rq)
+		return
+	} else if err := ioutil.WriteFile(zipfile, payload, 0600); err != nil {
+		response.Fault(err, rq)
+		return
+	}
+
+	u := uploader{}
+	if err := _restoreUploader(&u, zipfile, expenses.PushContext{Storage: b.dbInstance, BatchSize: b.dbBatchSize}); err != nil {
+		response.Wrong(err, rq)
+		return
+	}
+
+	for _, model := range u.Models {
+		_forgetSignature(b.dbInstance, model.Signature)
+	}
+
+	_cacheReset()
+
+	output := fmt.Sprintf(`{"transactions":%d,"actors":%d,"labels":%d,"models":%d}`,
+		len(u.Transactions), len(u.Actors), len(u.Labels), len(u.Models))
+	response.Okay([]byte(output), false, time.Since(startTime), rq)
+}
+
+// _restoreUploader is restore which returns its panics as an error
+func _restoreUploader(u *uploader, zipfile string, ctx expenses.PushContext) (err error) {
+	defer func() {
+		backupOperations.Inc("restore", _result(err))
+		if err == nil {
+			importedTransactions.Add(float64(len(u.Transactions)), "restore")
+		}
+	}() // after panics are recovered below
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cannot restore backup: %v", r)
+		}
+	}()
+
+	if err = u.FromZip(zipfile); err == nil {
+		u.Commit(ctx)
+	}
+
+	return
 }
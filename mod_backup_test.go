@@ -31,6 +31,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/lexndru/expenses"
 
@@ -100,3 +101,50 @@ func TestRestoreWithWrongInputs(t *testing.T) {
 
 	t.Fatal("Expected restore to fail and not reach this line")
 }
+
+func TestBackupToZipFile(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:backup?mode=memory"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := expenses.Install(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.AutoMigrate(&journalModel{}); err != nil {
+		t.Fatal(err)
+	}
+
+	trx := expenses.Transactions{
+		{Date: time.Now(), Amount: -100, LabelName: "Label", SenderName: "Sender", ReceiverName: "Receiver", Signature: "zip"},
+	}
+
+	if err := trx.Push(expenses.PushContext{Storage: db, BatchSize: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	model := journalModel{Signature: "zip", Version: JOURNAL_MODEL_VERSION, Patterns: "{}", ComputedAt: time.Now()}
+	if err := db.Create(&model).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	zipfile := filepath.Join(t.TempDir(), "backup.zip")
+	if err := backup(db, zipfile); err != nil {
+		t.Fatal(err)
+	}
+
+	var archived = &uploader{}
+	if err := archived.FromZip(zipfile); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(archived.Transactions) != 1 || len(archived.Actors) != 2 || len(archived.Labels) != 1 {
+		t.Fatalf("Expected registry in backup but got %d transactions, %d actors, %d labels",
+			len(archived.Transactions), len(archived.Actors), len(archived.Labels))
+	}
+
+	if len(archived.Models) != 1 || archived.Models[0].Signature != "zip" {
+		t.Fatalf("Expected journal model in backup but got %v", archived.Models)
+	}
+}
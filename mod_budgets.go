@@ -0,0 +1,424 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lexndru/expenses"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type budgets struct {
+	dbInstance  *gorm.DB
+	dbBatchSize int
+}
+
+func (b budgets) Install() error {
+	if err := b.dbInstance.AutoMigrate(&budget{}); err != nil {
+		return err
+	}
+
+	// index names are unique across tables, so households have their own
+	name := _tenantOf(b.dbInstance) + "idx_budget_label_cadence"
+	if b.dbInstance.Migrator().HasIndex(&budget{}, name) {
+		return nil
+	}
+
+	stmt := &gorm.Statement{DB: b.dbInstance}
+	if err := stmt.Parse(&budget{}); err != nil {
+		return err
+	}
+
+	return b.dbInstance.Exec("CREATE UNIQUE INDEX ? ON ? (label_name, cadence)",
+		clause.Column{Name: name}, clause.Table{Name: stmt.Schema.Table}).Error
+}
+
+func (b budgets) Setup(router *mux.Router) {
+	router.HandleFunc("/budgets", b.readJsonBudgets).Methods(http.MethodGet)
+	router.HandleFunc("/budgets", b.writeJsonBudgets).Methods(http.MethodPost)
+	router.HandleFunc("/budgets/{id:[0-9]+}", b.readJsonBudget).Methods(http.MethodGet)
+	router.HandleFunc("/budgets/{id:[0-9]+}", b.updateJsonBudget).Methods(http.MethodPut)
+	router.HandleFunc("/budgets/{id:[0-9]+}", b.deleteJsonBudget).Methods(http.MethodDelete)
+	router.HandleFunc("/budgets/{period:[0-9]{4}(?:-[0-9]{2}|-Q[1-4])?}/report", b.report).Methods(http.MethodGet)
+}
+
+const (
+	MONTHLY   = "month"
+	QUARTERLY = "quarter"
+	YEARLY    = "year"
+)
+
+// budget is the amount planned to be spent on a label (and its children) for
+// every period of a cadence; unused amounts can rollover to the next period
+type budget struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	LabelName string    `json:"label" gorm:"type: varchar(100); not null"`
+	Cadence   string    `json:"cadence" gorm:"type: varchar(10); not null"`
+	Amount    int64     `json:"amount" gorm:"not null"`
+	Rollover  bool      `json:"rollover" gorm:"not null"`
+	Since     time.Time `json:"since" gorm:"type: date; not null"`
+	CreatedAt time.Time `json:"-" gorm:"autoCreateTime"`
+	UpdatedAt time.Time `json:"-" gorm:"autoUpdateTime"`
+
+	Label *expenses.Label `json:"-" gorm:"foreignKey: LabelName; constraint: OnUpdate:CASCADE"`
+}
+
+func (b *budget) BeforeSave(tx *gorm.DB) (err error) {
+	if b.LabelName == "" {
+		return errors.New("budget cannot have an empty label")
+	}
+
+	if _, ok := cadenceMonths[b.Cadence]; !ok {
+		return fmt.Errorf("budget cadence must be one of month, quarter or year, got %q", b.Cadence)
+	}
+
+	if b.Amount < 0 {
+		return errors.New("budget amount cannot be negative")
+	}
+
+	if b.Since.IsZero() {
+		b.Since = _periodOf(b.Cadence, time.Now()).From
+	} else {
+		b.Since = _periodOf(b.Cadence, b.Since).From
+	}
+
+	return
+}
+
+var cadenceMonths = map[string]int{MONTHLY: 1, QUARTERLY: 3, YEARLY: 12}
+
+// period is a calendar month, quarter or year with both ends included
+type period struct {
+	Name    string    `json:"period"`
+	Cadence string    `json:"cadence"`
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+}
+
+var periodPattern = regexp.MustCompile(`^([0-9]{4})(?:-([0-9]{2})|-Q([1-4]))?$`)
+
+func _parsePeriod(value string) (period, error) {
+	match := periodPattern.FindStringSubmatch(value)
+	if match == nil {
+		return period{}, fmt.Errorf("unsupported period %q, expected YYYY, YYYY-MM or YYYY-QN", value)
+	}
+
+	year, _ := strconv.Atoi(match[1])
+
+	if match[2] != "" {
+		month, _ := strconv.Atoi(match[2])
+		if month < 1 || month > 12 {
+			return period{}, fmt.Errorf("unsupported month in period %q", value)
+		}
+
+		return _periodOf(MONTHLY, time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.Local)), nil
+	}
+
+	if match[3] != "" {
+		quarter, _ := strconv.Atoi(match[3])
+		return _periodOf(QUARTERLY, time.Date(year, time.Month(quarter*3), 1, 0, 0, 0, 0, time.Local)), nil
+	}
+
+	return _periodOf(YEARLY, time.Date(year, 1, 1, 0, 0, 0, 0, time.Local)), nil
+}
+
+func _periodOf(cadence string, date time.Time) period {
+	months := cadenceMonths[cadence]
+	if months == 0 {
+		cadence, months = MONTHLY, 1
+	}
+
+	month := (int(date.Month())-1)/months*months + 1
+	from := time.Date(date.Year(), time.Month(month), 1, 0, 0, 0, 0, time.Local)
+
+	p := period{Cadence: cadence, From: from, To: from.AddDate(0, months, -1)}
+
+	switch cadence {
+	case MONTHLY:
+		p.Name = from.Format("2006-01")
+	case QUARTERLY:
+		p.Name = fmt.Sprintf("%d-Q%d", from.Year(), (month-1)/3+1)
+	default:
+		p.Name = from.Format("2006")
+	}
+
+	return p
+}
+
+func (p period) Next() period {
+	return _periodOf(p.Cadence, p.To.AddDate(0, 0, 1))
+}
+
+func (p period) Contains(date time.Time) bool {
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.Local)
+	return !day.Before(p.From) && !day.After(p.To)
+}
+
+type budgetReport struct {
+	period
+
+	Budgets []budgetStatus `json:"budgets"`
+	Planned int64          `json:"planned"`
+	Spent   int64          `json:"spent"`
+}
+
+type budgetStatus struct {
+	budget
+
+	Carried   int64   `json:"carried"`
+	Available int64   `json:"available"`
+	Actual    int64   `json:"actual"`
+	Remaining int64   `json:"remaining"`
+	Usage     float64 `json:"usage"`
+}
+
+func (b budgets) readJsonBudgets(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	var list []budget
+	if err := b.dbInstance.Order("label_name, cadence").Find(&list).Error; err != nil {
+		response.Fault(err, rq)
+	} else if out, err := expenses.ToJson(list); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(out, false, time.Since(startTime), rq)
+	}
+}
+
+func (b budgets) writeJsonBudgets(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	var list []budget
+	if payload, err := ioutil.ReadAll(rq.Body); err != nil { // TODO: avoid ioutil because of memory issues?
+		response.Wrong(err, rq)
+		return // wrong payload, don't continue
+	} else if err := expenses.FromJson(payload, &list); err != nil {
+		response.Wrong(err, rq)
+		return // wrong payload, can't continue
+	}
+
+	for i := range list {
+		if err := list[i].BeforeSave(nil); err != nil {
+			response.Wrong(err, rq)
+			return // invalid budget, can't continue
+		}
+	}
+
+	if len(list) > 0 {
+		q := b.dbInstance.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "label_name"}, {Name: "cadence"}},
+			DoUpdates: clause.AssignmentColumns([]string{
+				"amount", "rollover", "since", "updated_at",
+			}),
+		})
+
+		if err := q.CreateInBatches(&list, b.dbBatchSize).Error; err != nil {
+			response.Fault(err, rq)
+			return
+		}
+	}
+
+	if out, err := expenses.ToJson(list); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(out, false, time.Since(startTime), rq)
+	}
+}
+
+func (b budgets) readJsonBudget(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	var item budget
+	if err := b.dbInstance.First(&item, mux.Vars(rq)["id"]).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		response.Missing(err, rq)
+	} else if err != nil {
+		response.Fault(err, rq)
+	} else if out, err := expenses.ToJson(item); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(out, false, time.Since(startTime), rq)
+	}
+}
+
+func (b budgets) updateJsonBudget(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	var item budget
+	if err := b.dbInstance.First(&item, mux.Vars(rq)["id"]).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		response.Missing(err, rq)
+		return
+	} else if err != nil {
+		response.Fault(err, rq)
+		return
+	}
+
+	id := item.ID
+	if payload, err := ioutil.ReadAll(rq.Body); err != nil { // TODO: avoid ioutil because of memory issues?
+		response.Wrong(err, rq)
+		return // wrong payload, don't continue
+	} else if err := expenses.FromJson(payload, &item); err != nil {
+		response.Wrong(err, rq)
+		return // wrong payload, can't continue
+	}
+
+	item.ID = id // identity cannot change
+	if err := item.BeforeSave(nil); err != nil {
+		response.Wrong(err, rq)
+	} else if err := b.dbInstance.Save(&item).Error; err != nil {
+		response.Fault(err, rq)
+	} else if out, err := expenses.ToJson(item); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(out, false, time.Since(startTime), rq)
+	}
+}
+
+func (b budgets) deleteJsonBudget(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	if res := b.dbInstance.Delete(&budget{}, mux.Vars(rq)["id"]); res.Error != nil {
+		response.Fault(res.Error, rq)
+	} else if res.RowsAffected == 0 {
+		response.Missing(gorm.ErrRecordNotFound, rq)
+	} else {
+		response.Okay([]byte(fmt.Sprintf(`{"deleted":%d}`, res.RowsAffected)), false, time.Since(startTime), rq)
+	}
+}
+
+func (b budgets) report(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	p, err := _parsePeriod(mux.Vars(rq)["period"])
+	if err != nil {
+		response.Wrong(err, rq)
+		return
+	}
+
+	var list []budget
+	query := b.dbInstance.Where("cadence = ? and since < ?", p.Cadence, p.To.AddDate(0, 0, 1))
+	if err := query.Order("label_name").Find(&list).Error; err != nil {
+		response.Fault(err, rq)
+	} else if report, err := _budgetReport(b.dbInstance, list, p); err != nil {
+		response.Fault(err, rq)
+	} else if out, err := expenses.ToJson(report); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(out, false, time.Since(startTime), rq)
+	}
+}
+
+// _budgetReport compares budgets with the actual spending of a period; the
+// spending of child labels is rolled up to their parents, linked transfers
+// are left out and unused amounts of previous periods are carried over for
+// budgets with rollover
+func _budgetReport(db *gorm.DB, list []budget, p period) (budgetReport, error) {
+	report := budgetReport{period: p, Budgets: make([]budgetStatus, 0, len(list))}
+
+	earliest := p.From
+	for _, item := range list {
+		if item.Rollover && item.Since.Before(earliest) {
+			earliest = item.Since
+		}
+	}
+
+	// the period ends with the whole of its last day, not just its midnight
+	var reg expenses.Transactions
+	ctx := expenses.PullContext{
+		Storage: db.Scopes(_withoutTransfers).Where("date >= ? and date < ?", earliest, p.To.AddDate(0, 0, 1)),
+	}
+
+	if err := reg.Pull(ctx); err != nil {
+		return report, err
+	}
+
+	parents, err := _labelParents(db)
+	if err != nil {
+		return report, err
+	}
+
+	spent := make(map[string]map[string]int64) // period => label => amount
+	for _, r := range _toRecords(reg) {
+		if r.Amount >= 0 {
+			continue // only expenses count against a budget
+		}
+
+		key := _periodOf(p.Cadence, r.Date).Name
+		if _, ok := spent[key]; !ok {
+			spent[key] = make(map[string]int64)
+		}
+
+		for _, label := range _labelLineage(parents, r.Label) {
+			spent[key][label] -= r.Amount
+		}
+
+		if p.Contains(r.Date) {
+			report.Spent -= r.Amount
+		}
+	}
+
+	for _, item := range list {
+		status := budgetStatus{budget: item}
+
+		if item.Rollover {
+			for q := _periodOf(item.Cadence, item.Since); q.From.Before(p.From); q = q.Next() {
+				if status.Carried += item.Amount - spent[q.Name][item.LabelName]; status.Carried < 0 {
+					status.Carried = 0 // overspending is not carried over
+				}
+			}
+		}
+
+		status.Available = item.Amount + status.Carried
+		status.Actual = spent[p.Name][item.LabelName]
+		status.Remaining = status.Available - status.Actual
+
+		if status.Available > 0 {
+			status.Usage = float64(status.Actual) / float64(status.Available)
+		}
+
+		report.Planned += item.Amount
+		report.Budgets = append(report.Budgets, status)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,221 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lexndru/expenses"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+var (
+	budgetsDBInstance = sqlite.Open("file::memory:")
+	budgetsHttpRouter *mux.Router
+	budgetsDB         *gorm.DB
+)
+
+func init() {
+	if db, err := gorm.Open(budgetsDBInstance, &gorm.Config{}); err != nil {
+		panic(err)
+	} else {
+		budgetsHttpRouter = mux.NewRouter()
+		budgetsDB = db
+
+		expenses.Install(db)
+
+		trf := transfers{db, 10}
+		if err := trf.Install(); err != nil {
+			panic(err)
+		}
+
+		mod := budgets{db, 10}
+		if err := mod.Install(); err != nil {
+			panic(err)
+		}
+
+		mod.Setup(budgetsHttpRouter)
+
+		car := expenses.NewLabel("Mașină", nil)
+		fuel := expenses.NewLabel("Combustibil", &car)
+		labels := expenses.Labels{car, fuel}
+		if err := labels.Push(expenses.PushContext{Storage: db, BatchSize: 10}); err != nil {
+			panic(err)
+		}
+
+		day := func(m time.Month, d int) time.Time {
+			return time.Date(2021, m, d, 0, 0, 0, 0, time.Local)
+		}
+
+		seed := expenses.Transactions{
+			{Date: day(1, 10), Amount: -30000, LabelName: "Combustibil", SenderName: "Me", ReceiverName: "Petrom", Signature: "budget"},
+			{Date: day(2, 10), Amount: -45000, LabelName: "Combustibil", SenderName: "Me", ReceiverName: "Petrom", Signature: "budget"},
+			{Date: day(2, 20), Amount: -15000, LabelName: "Mașină", SenderName: "Me", ReceiverName: "Service", Signature: "budget"},
+			{Date: day(3, 10), Amount: -10000, LabelName: "Combustibil", SenderName: "Me", ReceiverName: "Petrom", Signature: "budget"},
+			{Date: day(3, 11), Amount: 10000, LabelName: "Combustibil", SenderName: "Petrom", ReceiverName: "Me", Signature: "budget"},
+		}
+
+		if err := seed.Push(expenses.PushContext{Storage: db, BatchSize: 10}); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestParsePeriods(t *testing.T) {
+	cases := map[string]string{
+		"2021":    "2021-01-01 2021-12-31",
+		"2021-02": "2021-02-01 2021-02-28",
+		"2021-Q3": "2021-07-01 2021-09-30",
+	}
+
+	for value, expected := range cases {
+		p, err := _parsePeriod(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if span := p.From.Format("2006-01-02") + " " + p.To.Format("2006-01-02"); span != expected {
+			t.Fatalf("Expected period %s to span %s but got %s", value, expected, span)
+		}
+
+		if p.Name != value {
+			t.Fatalf("Expected period name %s but got %s", value, p.Name)
+		}
+	}
+
+	if _, err := _parsePeriod("2021-13"); err == nil {
+		t.Fatal("Expected error for month 13")
+	}
+}
+
+func TestWriteWrongJsonBudgets(t *testing.T) {
+	payload := []byte(`[{"label":"Mașină","cadence":"week","amount":100}]`)
+
+	buf := httptest.NewRecorder()
+	budgetsHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/budgets", bytes.NewReader(payload)))
+
+	if reply := buf.Result(); reply.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 Bad Request for unsupported cadence but got %v", reply.StatusCode)
+	}
+
+	buf2 := httptest.NewRecorder()
+	budgetsHttpRouter.ServeHTTP(buf2, httptest.NewRequest("GET", "/budgets/999", nil))
+
+	if reply := buf2.Result(); reply.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 Not Found for missing budget but got %v", reply.StatusCode)
+	}
+}
+
+func TestBudgetVersusActualReport(t *testing.T) {
+	payload := []byte(`[{"label":"Mașină","cadence":"month","amount":50000,"rollover":true,"since":"2021-01-15T00:00:00Z"}]`)
+
+	buf := httptest.NewRecorder()
+	budgetsHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/budgets", bytes.NewReader(payload)))
+
+	if reply := buf.Result(); reply.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(reply.Body)
+		t.Fatalf("Expected 200 OK after POST but got %v: %s", reply.StatusCode, body)
+	}
+
+	buf2 := httptest.NewRecorder()
+	budgetsHttpRouter.ServeHTTP(buf2, httptest.NewRequest("GET", "/budgets/2021-03/report", nil))
+	reply := buf2.Result()
+
+	if reply.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 OK for report but got %v", reply.StatusCode)
+	}
+
+	var report budgetReport
+	body, _ := io.ReadAll(reply.Body)
+	if err := json.Unmarshal(body, &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Budgets) != 1 {
+		t.Fatalf("Expected one budget in report but got %d", len(report.Budgets))
+	}
+
+	status := report.Budgets[0]
+
+	// january leaves 20000 unused, february overspends by 10000 of those
+	if status.Carried != 10000 {
+		t.Fatalf("Expected 10000 carried over from previous months but got %d", status.Carried)
+	}
+
+	// child label spending is rolled up to the budget of its parent
+	if status.Actual != 10000 {
+		t.Fatalf("Expected 10000 spent on Combustibil to count for Mașină but got %d", status.Actual)
+	}
+
+	if status.Remaining != 50000 {
+		t.Fatalf("Expected 50000 remaining but got %d", status.Remaining)
+	}
+
+	buf3 := httptest.NewRecorder()
+	budgetsHttpRouter.ServeHTTP(buf3, httptest.NewRequest("GET", "/budgets/2021-Q1/report", nil))
+
+	body3, _ := io.ReadAll(buf3.Result().Body)
+	if err := json.Unmarshal(body3, &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Budgets) != 0 || report.Spent != 100000 {
+		t.Fatalf("Expected no quarterly budgets and 100000 spent but got %d and %d", len(report.Budgets), report.Spent)
+	}
+}
+
+func TestBudgetReportIncludesLastDay(t *testing.T) {
+	evening := expenses.Transactions{
+		{Date: time.Date(2021, 4, 30, 18, 0, 0, 0, time.Local), Amount: -2500, LabelName: "Combustibil", SenderName: "Me", ReceiverName: "Petrom", Signature: "budget"},
+	}
+
+	if err := evening.Push(expenses.PushContext{Storage: budgetsDB, BatchSize: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := httptest.NewRecorder()
+	budgetsHttpRouter.ServeHTTP(buf, httptest.NewRequest("GET", "/budgets/2021-04/report", nil))
+
+	var report budgetReport
+	if err := json.NewDecoder(buf.Result().Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Spent != 2500 || len(report.Budgets) != 1 || report.Budgets[0].Actual != 2500 {
+		t.Fatalf("Expected 2500 spent in the evening of the last day but got %+v", report)
+	}
+}
@@ -0,0 +1,573 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// grants restrict api keys to some signatures of their household; a key is
+// restricted by its scopes alone until its first grant, from then on it's
+// limited to its grants, even none, until an admin releases it
+type grants struct {
+	dbInstance  *gorm.DB
+	dbBatchSize int
+}
+
+func (g grants) Install() error {
+	if err := g.dbInstance.AutoMigrate(&grant{}, &restrictedKey{}, &auditEntry{}); err != nil {
+		return err
+	}
+
+	// index names are unique across tables, so households have their own
+	name := _tenantOf(g.dbInstance) + "idx_grant_key_signature"
+	if g.dbInstance.Migrator().HasIndex(&grant{}, name) {
+		return nil
+	}
+
+	stmt := &gorm.Statement{DB: g.dbInstance}
+	if err := stmt.Parse(&grant{}); err != nil {
+		return err
+	}
+
+	return g.dbInstance.Exec("CREATE UNIQUE INDEX ? ON ? (key_id, signature)",
+		clause.Column{Name: name}, clause.Table{Name: stmt.Schema.Table}).Error
+}
+
+func (g grants) Setup(router *mux.Router) {
+	router.HandleFunc("/grants", g.list).Methods(http.MethodGet)
+	router.HandleFunc("/grants", g.write).Methods(http.MethodPut)
+	router.HandleFunc("/grants/{id:[0-9]+}", g.revoke).Methods(http.MethodDelete)
+	router.HandleFunc("/grants/keys/{key:[0-9]+}", g.release).Methods(http.MethodDelete)
+	router.HandleFunc("/grants/audit", g.audit).Methods(http.MethodGet)
+}
+
+const (
+	ROLE_VIEWER = "viewer"
+	ROLE_EDITOR = "editor"
+	ROLE_OWNER  = "owner"
+)
+
+// roles rank what a role allows, each one allows what the lower ones do
+var roles = map[string]int{
+	ROLE_VIEWER: 1,
+	ROLE_EDITOR: 2,
+	ROLE_OWNER:  3,
+}
+
+type grant struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	KeyID     uint      `json:"key" gorm:"not null"`
+	Signature string    `json:"signature" gorm:"type: varchar(36); index; not null"`
+	Role      string    `json:"role" gorm:"type: varchar(10); not null"`
+	CreatedAt time.Time `json:"created" gorm:"autoCreateTime"`
+}
+
+func (gr *grant) BeforeCreate(tx *gorm.DB) error {
+	if _, ok := roles[gr.Role]; !ok {
+		return fmt.Errorf("role must be %s, %s or %s, got %q", ROLE_OWNER, ROLE_EDITOR, ROLE_VIEWER, gr.Role)
+	}
+
+	if !signaturePattern.MatchString(gr.Signature) {
+		return fmt.Errorf("signature must have at most 36 characters, got %q", gr.Signature)
+	}
+
+	return nil
+}
+
+// restrictedKey marks a key which was granted access to some signatures, so
+// revoking its last grant doesn't lift the restriction
+type restrictedKey struct {
+	KeyID     uint      `json:"key" gorm:"primaryKey; autoIncrement:false"`
+	CreatedAt time.Time `json:"created" gorm:"autoCreateTime"`
+}
+
+// auditEntry records who changed grants, or the signatures they're bound to
+type auditEntry struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	KeyID     uint      `json:"key" gorm:"index; not null"`
+	Principal string    `json:"principal" gorm:"type: varchar(100); not null"`
+	Action    string    `json:"action" gorm:"type: varchar(20); not null"`
+	Signature string    `json:"signature" gorm:"type: varchar(36); index; not null"`
+	Detail    string    `json:"detail" gorm:"type: text; not null"`
+	CreatedAt time.Time `json:"date" gorm:"autoCreateTime; index"`
+}
+
+// _audit records an action of the principal of a request, if any
+func _audit(tx *gorm.DB, rq *http.Request, action, signature, detail string) error {
+	entry := auditEntry{Action: action, Signature: signature, Detail: detail}
+	if p, ok := _principalOf(rq); ok {
+		entry.KeyID, entry.Principal = p.KeyID, p.Name
+	}
+
+	return tx.Create(&entry).Error
+}
+
+// accessDenied is the structured error of a 403 response
+type accessDenied struct {
+	Reason    string `json:"error"`
+	Principal string `json:"principal,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Required  string `json:"required,omitempty"`
+	Granted   string `json:"granted,omitempty"`
+}
+
+func (e accessDenied) Error() string {
+	return e.Reason
+}
+
+// _isRestricted is true if a key was ever granted access to a signature
+func _isRestricted(db *gorm.DB, key uint) (bool, error) {
+	var count int64
+	err := db.Model(&restrictedKey{}).Where("key_id = ?", key).Count(&count).Error
+
+	return count > 0, err
+}
+
+// _grantsOf returns the roles of a key by signature, if any
+func _grantsOf(db *gorm.DB, key uint) (map[string]string, error) {
+	var list []grant
+	if err := db.Where("key_id = ?", key).Find(&list).Error; err != nil {
+		return nil, err
+	}
+
+	granted := make(map[string]string, len(list))
+	for _, gr := range list {
+		granted[gr.Signature] = gr.Role
+	}
+
+	return granted, nil
+}
+
+type grantedKey struct{}
+
+// _isGranted is true if the principal of a request can read a signature
+func _isGranted(rq *http.Request, signature string) bool {
+	granted, ok := rq.Context().Value(grantedKey{}).(map[string]string)
+	if !ok {
+		return true
+	}
+
+	_, ok = granted[signature]
+	return ok
+}
+
+// _grantedSignatures returns the signatures the principal of a request can
+// read, unless it's not restricted by grants
+func _grantedSignatures(rq *http.Request) ([]string, bool) {
+	granted, ok := rq.Context().Value(grantedKey{}).(map[string]string)
+	if !ok {
+		return nil, false
+	}
+
+	names := make([]string, 0, len(granted))
+	for signature := range granted {
+		names = append(names, signature)
+	}
+	sort.Strings(names)
+
+	return names, true
+}
+
+// _restrictedTo narrows down a query to the signatures granted to the
+// principal of a request, if it's restricted by grants
+func _restrictedTo(rq *http.Request, db *gorm.DB) *gorm.DB {
+	if names, ok := _grantedSignatures(rq); ok {
+		return db.Where("signature in ?", names)
+	}
+
+	return db
+}
+
+// _restrictedKey makes cache keys of requests restricted by grants distinct
+func _restrictedKey(rq *http.Request, key scoped) scoped {
+	if names, ok := _grantedSignatures(rq); ok {
+		key.name += "#" + strings.Join(names, ",")
+	}
+
+	return key
+}
+
+// _isUnrestricted is true without authentication or for admin keys, which
+// are not bound by grants
+func _isUnrestricted(rq *http.Request) bool {
+	p, ok := _principalOf(rq)
+	return !ok || p.Can(SCOPE_ADMIN, true)
+}
+
+// Enforce is a middleware which limits keys with grants to the routes of
+// their signatures: viewers read, editors write and owners also rename,
+// merge or delete them; registry, insights and signatures lists are filtered
+// by the handlers to the granted signatures
+func (g grants) Enforce(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, rq *http.Request) {
+		response := Response{wr}
+
+		if _isUnrestricted(rq) {
+			next.ServeHTTP(wr, rq)
+			return
+		}
+
+		p, _ := _principalOf(rq)
+		granted, err := _grantsOf(g.dbInstance, p.KeyID)
+		if err != nil {
+			response.Fault(err, rq)
+			return
+		}
+
+		if len(granted) == 0 {
+			if restricted, err := _isRestricted(g.dbInstance, p.KeyID); err != nil {
+				response.Fault(err, rq)
+			} else if restricted {
+				reason := fmt.Sprintf("key %q has no grants left", p.Name)
+				response.Forbidden(accessDenied{Reason: reason, Principal: p.Name, Required: ROLE_VIEWER}, rq)
+			} else {
+				next.ServeHTTP(wr, rq)
+			}
+			return
+		}
+
+		denied := func(signature, required string) {
+			reason := fmt.Sprintf("key %q cannot access signature %s", p.Name, signature)
+			if signature == "" {
+				reason = fmt.Sprintf("key %q is limited to its signatures", p.Name)
+			}
+
+			response.Forbidden(accessDenied{reason, p.Name, signature, required, granted[signature]}, rq)
+		}
+
+		allows := func(signature, required string) bool {
+			return roles[granted[signature]] >= roles[required]
+		}
+
+		required := ROLE_VIEWER
+		if rq.Method != http.MethodGet && rq.Method != http.MethodHead {
+			required = ROLE_EDITOR
+		}
+
+		segment, route := _segmentOf(rq), strings.TrimPrefix(rq.URL.Path, API_PREFIX)
+		params := mux.Vars(rq)
+		signature, bound := params["signature"]
+
+		switch {
+		case bound && segment == "signatures" && rq.Method != http.MethodGet:
+			for _, name := range []string{signature, rq.URL.Query().Get("into")} {
+				if name != "" && !allows(name, ROLE_OWNER) {
+					denied(name, ROLE_OWNER)
+					return
+				}
+			}
+		case bound:
+			if !allows(signature, required) {
+				denied(signature, required)
+				return
+			}
+		case segment == "jobs" && params["id"] != "":
+			if jb, ok := runner.Get(_tenantOf(g.dbInstance), params["id"]); ok && !allows(jb.Signature, required) {
+				denied(jb.Signature, required)
+				return
+			}
+		case route == "/registry/transactions/dedupe":
+			signature := rq.URL.Query().Get("signature")
+			if !allows(signature, ROLE_EDITOR) {
+				denied(signature, ROLE_EDITOR)
+				return
+			}
+		case route == "/registry/transactions" && required == ROLE_EDITOR:
+			payload, err := ioutil.ReadAll(rq.Body) // TODO: avoid ioutil because of memory issues?
+			if err != nil {
+				response.Wrong(err, rq)
+				return
+			}
+
+			var written []struct {
+				UUID      string `json:"uuid"`
+				Signature string `json:"signature"`
+			}
+			json.Unmarshal(payload, &written) // wrong payloads are reported by the registry
+
+			var keys []string
+			for _, trx := range written {
+				if !allows(trx.Signature, ROLE_EDITOR) {
+					denied(trx.Signature, ROLE_EDITOR)
+					return
+				}
+
+				if trx.UUID != "" {
+					keys = append(keys, trx.UUID)
+				}
+			}
+
+			// existing transactions are updated by key, whatever their signature
+			owners, err := _signaturesByUUID(g.dbInstance, keys, g.dbBatchSize)
+			if err != nil {
+				response.Fault(err, rq)
+				return
+			}
+
+			for _, owner := range owners {
+				if !allows(owner, ROLE_EDITOR) {
+					denied(owner, ROLE_EDITOR)
+					return
+				}
+			}
+
+			rq.Body = ioutil.NopCloser(bytes.NewReader(payload))
+		case segment == "registry" && required == ROLE_EDITOR:
+			editor := false
+			for name := range granted {
+				editor = editor || allows(name, ROLE_EDITOR)
+			}
+
+			if !editor {
+				denied("", ROLE_EDITOR)
+				return
+			}
+		case segment == "registry", segment == "insights", segment == "signatures", segment == "jobs", segment == "grants":
+			// lists are filtered by their handlers
+		default:
+			denied("", "")
+			return
+		}
+
+		next.ServeHTTP(wr, rq.WithContext(context.WithValue(rq.Context(), grantedKey{}, granted)))
+	})
+}
+
+// _canManage is true if the principal of a request can change the grants
+// of a signature, i.e. it's unrestricted or the owner
+func (g grants) _canManage(rq *http.Request, signature string) (bool, error) {
+	if _isUnrestricted(rq) {
+		return true, nil
+	}
+
+	p, _ := _principalOf(rq)
+	granted, err := _grantsOf(g.dbInstance, p.KeyID)
+
+	return granted[signature] == ROLE_OWNER, err
+}
+
+func (g grants) list(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	query := g.dbInstance.Order("signature, key_id")
+	if signature := rq.URL.Query().Get("signature"); signature != "" {
+		query = query.Where("signature = ?", signature)
+	}
+
+	if !_isUnrestricted(rq) {
+		p, _ := _principalOf(rq)
+		owned := g.dbInstance.Model(&grant{}).Select("signature").Where("key_id = ? and role = ?", p.KeyID, ROLE_OWNER)
+		query = query.Where("signature in (?) or key_id = ?", owned, p.KeyID)
+	}
+
+	list := make([]grant, 0)
+	if err := query.Find(&list).Error; err != nil {
+		response.Fault(err, rq)
+	} else if output, err := json.Marshal(list); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
+
+// write grants a role on a signature to a key, or changes its role
+func (g grants) write(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	var gr grant
+	if payload, err := ioutil.ReadAll(rq.Body); err != nil { // TODO: avoid ioutil because of memory issues?
+		response.Fault(err, rq)
+		return
+	} else if err := json.Unmarshal(payload, &gr); err != nil {
+		response.Wrong(err, rq)
+		return
+	}
+
+	if ok, err := g._canManage(rq, gr.Signature); err != nil {
+		response.Fault(err, rq)
+		return
+	} else if !ok {
+		response.Forbidden(accessDenied{Reason: "only owners can grant access to a signature", Signature: gr.Signature, Required: ROLE_OWNER}, rq)
+		return
+	}
+
+	gr.ID = 0
+	err := g.dbInstance.Transaction(func(tx *gorm.DB) error {
+		upsert := clause.OnConflict{
+			Columns:   []clause.Column{{Name: "key_id"}, {Name: "signature"}},
+			DoUpdates: clause.AssignmentColumns([]string{"role"}),
+		}
+
+		if err := tx.Clauses(upsert).Create(&gr).Error; err != nil {
+			return err
+		}
+
+		restricted := restrictedKey{KeyID: gr.KeyID}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&restricted).Error; err != nil {
+			return err
+		}
+
+		return _audit(tx, rq, "grant", gr.Signature, fmt.Sprintf("key %d as %s", gr.KeyID, gr.Role))
+	})
+
+	var saved grant // the id of an upsert is not reliable across drivers
+	if err != nil {
+		response.Wrong(err, rq)
+	} else if err := g.dbInstance.Take(&saved, "key_id = ? and signature = ?", gr.KeyID, gr.Signature).Error; err != nil {
+		response.Fault(err, rq)
+	} else if output, err := json.Marshal(saved); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
+
+func (g grants) revoke(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	params := mux.Vars(rq)
+	id, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	var gr grant
+	if err := g.dbInstance.Take(&gr, id).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		response.Missing(fmt.Errorf("grant %d not found", id), rq)
+		return
+	} else if err != nil {
+		response.Fault(err, rq)
+		return
+	}
+
+	if ok, err := g._canManage(rq, gr.Signature); err != nil {
+		response.Fault(err, rq)
+		return
+	} else if !ok {
+		response.Forbidden(accessDenied{Reason: "only owners can revoke access to a signature", Signature: gr.Signature, Required: ROLE_OWNER}, rq)
+		return
+	}
+
+	err := g.dbInstance.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&gr).Error; err != nil {
+			return err
+		}
+
+		return _audit(tx, rq, "revoke", gr.Signature, fmt.Sprintf("key %d as %s", gr.KeyID, gr.Role))
+	})
+
+	if err != nil {
+		response.Fault(err, rq)
+	} else if output, err := json.Marshal(gr); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
+
+// release revokes all grants of a key and lifts its restriction, so it's
+// restricted by its scopes alone again; only admins can release keys
+func (g grants) release(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	params := mux.Vars(rq)
+	key, _ := strconv.ParseUint(params["key"], 10, 32)
+
+	if !_isUnrestricted(rq) {
+		response.Forbidden(accessDenied{Reason: "only admins can release keys", Required: SCOPE_ADMIN}, rq)
+		return
+	}
+
+	var revoked int64
+	err := g.dbInstance.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("key_id = ?", key).Delete(&grant{})
+		if res.Error != nil {
+			return res.Error
+		}
+
+		revoked = res.RowsAffected
+		if err := tx.Where("key_id = ?", key).Delete(&restrictedKey{}).Error; err != nil {
+			return err
+		}
+
+		return _audit(tx, rq, "release", "", fmt.Sprintf("key %d with %d grants", key, revoked))
+	})
+
+	if err != nil {
+		response.Fault(err, rq)
+	} else {
+		output := fmt.Sprintf(`{"key":%d,"revoked":%d}`, key, revoked)
+		response.Okay([]byte(output), false, time.Since(startTime), rq)
+	}
+}
+
+// audit lists the changes of grants, newest first, of ?signature if given
+func (g grants) audit(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	signature := rq.URL.Query().Get("signature")
+	if ok, err := g._canManage(rq, signature); err != nil {
+		response.Fault(err, rq)
+		return
+	} else if !ok {
+		response.Forbidden(accessDenied{Reason: "only owners can read the audit of a signature", Signature: signature, Required: ROLE_OWNER}, rq)
+		return
+	}
+
+	query := g.dbInstance.Order("id DESC")
+	if signature != "" {
+		query = query.Where("signature = ?", signature)
+	}
+
+	list := make([]auditEntry, 0)
+	if err := query.Find(&list).Error; err != nil {
+		response.Fault(err, rq)
+	} else if output, err := json.Marshal(list); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
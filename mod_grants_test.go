@@ -0,0 +1,212 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/lexndru/expenses"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+var (
+	grantsDBInstance = sqlite.Open("file:grants?mode=memory&cache=shared")
+	grantsHttpRouter *mux.Router
+	grantsModule     grants
+)
+
+func init() {
+	if db, err := gorm.Open(grantsDBInstance, &gorm.Config{}); err != nil {
+		panic(err)
+	} else {
+		grantsHttpRouter = mux.NewRouter()
+		grantsModule = grants{db, 10}
+
+		if err := expenses.Install(db); err != nil {
+			panic(err)
+		}
+
+		modules := []interface{ Install() error }{keys{db, 10}, journal{db, 10}, signatures{db, 10}, grantsModule}
+		for _, mod := range modules {
+			if err := mod.Install(); err != nil {
+				panic(err)
+			}
+		}
+
+		whoami := func(wr http.ResponseWriter, rq *http.Request) {
+			p, _ := _principalOf(rq)
+			output, _ := json.Marshal(p)
+			Response{wr}.Okay(output, false, 0, rq)
+		}
+
+		grantsHttpRouter.Use(keys{db, 10}.Authenticate)
+		grantsHttpRouter.Use(grantsModule.Enforce)
+		grantsHttpRouter.HandleFunc("/journal/{signature}", whoami).Methods(http.MethodGet, http.MethodPost)
+		grantsHttpRouter.HandleFunc("/transfers", whoami).Methods(http.MethodGet)
+		registry{db, 10}.Setup(grantsHttpRouter)
+		signatures{db, 10}.Setup(grantsHttpRouter)
+		grantsModule.Setup(grantsHttpRouter)
+	}
+}
+
+func TestGrantsEnforcement(t *testing.T) {
+	_, admin, err := _createKey(grantsModule.dbInstance, "admin", "admin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clerkKey, clerk, err := _createKey(grantsModule.dbInstance, "clerk", "registry:write journal:write", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(method, target, key, payload string, status int) *httptest.ResponseRecorder {
+		rq := httptest.NewRequest(method, target, strings.NewReader(payload))
+		rq.Header.Set("Authorization", "Bearer "+key)
+
+		buf := httptest.NewRecorder()
+		grantsHttpRouter.ServeHTTP(buf, rq)
+
+		if reply := buf.Result(); reply.StatusCode != status {
+			t.Fatalf("Expected %d for %s %s but got %v: %s", status, method, target, reply.StatusCode, buf.Body)
+		}
+
+		return buf
+	}
+
+	trx := func(signature string, amount int) string {
+		return fmt.Sprintf(`[{"date":"2021-03-01T00:00:00Z","amount":%d,"label":"","sender":"a","receiver":"b","signature":%q}]`, amount, signature)
+	}
+
+	serve("POST", "/registry/transactions", admin, trx("grants-home", 100), http.StatusOK)
+	serve("POST", "/registry/transactions", admin, trx("grants-work", 200), http.StatusOK)
+
+	grantAs := func(signature, role string) {
+		payload := fmt.Sprintf(`{"key":%d,"signature":%q,"role":%q}`, clerkKey.ID, signature, role)
+		serve("PUT", "/grants", admin, payload, http.StatusOK)
+	}
+
+	// without grants, scopes alone apply
+	serve("GET", "/journal/grants-work", clerk, "", http.StatusOK)
+
+	grantAs("grants-home", ROLE_VIEWER)
+	serve("GET", "/journal/grants-home", clerk, "", http.StatusOK)
+	serve("POST", "/journal/grants-home", clerk, "", http.StatusForbidden)
+	serve("POST", "/registry/transactions", clerk, trx("grants-home", 300), http.StatusForbidden)
+	serve("GET", "/transfers", clerk, "", http.StatusForbidden)
+
+	var denied accessDenied
+	if err := json.NewDecoder(serve("GET", "/journal/grants-work", clerk, "", http.StatusForbidden).Body).Decode(&denied); err != nil {
+		t.Fatal(err)
+	}
+
+	if denied.Principal != "clerk" || denied.Signature != "grants-work" || denied.Required != ROLE_VIEWER || denied.Granted != "" {
+		t.Fatalf("Expected a structured error of the denied signature but got %+v", denied)
+	}
+
+	var reg expenses.Transactions
+	if err := json.NewDecoder(serve("GET", "/registry/transactions", clerk, "", http.StatusOK).Body).Decode(&reg); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reg) != 1 || reg[0].Signature != "grants-home" {
+		t.Fatalf("Expected only transactions of the granted signature but got %v", reg)
+	}
+
+	var list []signatureSummary
+	if err := json.NewDecoder(serve("GET", "/signatures", clerk, "", http.StatusOK).Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 1 || list[0].Signature != "grants-home" {
+		t.Fatalf("Expected only the granted signature but got %+v", list)
+	}
+
+	grantAs("grants-home", ROLE_EDITOR)
+	serve("POST", "/journal/grants-home", clerk, "", http.StatusOK)
+	serve("POST", "/registry/transactions", clerk, trx("grants-home", 300), http.StatusOK)
+	serve("POST", "/registry/transactions", clerk, trx("grants-work", 300), http.StatusForbidden)
+
+	// transactions are updated by key, so the stored signature must be granted too
+	stored := `[{"uuid":"00000000-0000-4000-8000-000000000047","date":"2021-03-02T00:00:00Z","amount":50,"label":"","sender":"a","receiver":"b","signature":%q}]`
+	serve("POST", "/registry/transactions", admin, fmt.Sprintf(stored, "grants-work"), http.StatusOK)
+	serve("POST", "/registry/transactions", clerk, fmt.Sprintf(stored, "grants-home"), http.StatusForbidden)
+
+	serve("POST", "/signatures/grants-home/rename?to=grants-flat", clerk, "", http.StatusForbidden)
+	serve("PUT", "/grants", clerk, fmt.Sprintf(`{"key":%d,"signature":"grants-work","role":"owner"}`, clerkKey.ID), http.StatusForbidden)
+
+	grantAs("grants-home", ROLE_OWNER)
+	serve("POST", "/signatures/grants-home/rename?to=grants-flat", clerk, "", http.StatusOK)
+	serve("GET", "/journal/grants-flat", clerk, "", http.StatusOK)
+	serve("POST", "/signatures/grants-flat/merge?into=grants-work", clerk, "", http.StatusForbidden)
+
+	var audit []auditEntry
+	if err := json.NewDecoder(serve("GET", "/grants/audit", admin, "", http.StatusOK).Body).Decode(&audit); err != nil {
+		t.Fatal(err)
+	}
+
+	actions := make([]string, len(audit))
+	for i, entry := range audit {
+		actions[i] = entry.Action + " " + entry.Signature
+	}
+
+	if expected := "rename grants-home,grant grants-home,grant grants-home,grant grants-home"; strings.Join(actions, ",") != expected {
+		t.Fatalf("Expected audit %s but got %s", expected, strings.Join(actions, ","))
+	}
+
+	if audit[0].Principal != "clerk" || audit[0].Detail != "grants-flat" {
+		t.Fatalf("Expected the rename by clerk in the audit but got %+v", audit[0])
+	}
+
+	var granted []grant
+	if err := json.NewDecoder(serve("GET", "/grants", clerk, "", http.StatusOK).Body).Decode(&granted); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(granted) != 1 || granted[0].Signature != "grants-flat" || granted[0].Role != ROLE_OWNER {
+		t.Fatalf("Expected the renamed grant of the owner but got %+v", granted)
+	}
+
+	// revoking the last grant doesn't lift the restriction
+	serve("DELETE", fmt.Sprintf("/grants/%d", granted[0].ID), clerk, "", http.StatusOK)
+	serve("GET", "/journal/grants-work", clerk, "", http.StatusForbidden)
+	serve("GET", "/registry/transactions", clerk, "", http.StatusForbidden)
+	serve("POST", "/registry/transactions", clerk, trx("grants-work", 300), http.StatusForbidden)
+
+	serve("DELETE", fmt.Sprintf("/grants/keys/%d", clerkKey.ID), clerk, "", http.StatusForbidden)
+	serve("DELETE", fmt.Sprintf("/grants/keys/%d", clerkKey.ID), admin, "", http.StatusOK)
+	serve("GET", "/journal/grants-work", clerk, "", http.StatusOK) // back to scopes alone
+}
@@ -0,0 +1,341 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lexndru/expenses"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// households share one database, each with its own tables prefixed by its
+// id; the default household is the one with unprefixed tables
+type households struct {
+	dbInstance  *gorm.DB
+	dbBatchSize int
+}
+
+func (h households) Install() error {
+	return h.dbInstance.AutoMigrate(&household{})
+}
+
+func (h households) Setup(router *mux.Router) {
+	router.HandleFunc("/households", h.list).Methods(http.MethodGet)
+	router.HandleFunc("/households", h.create).Methods(http.MethodPost)
+}
+
+type household struct {
+	ID        string    `json:"id" gorm:"type: varchar(20); primaryKey"`
+	Name      string    `json:"name" gorm:"type: varchar(100); not null"`
+	Resources string    `json:"resources" gorm:"type: varchar(10); not null"`
+	CreatedAt time.Time `json:"created" gorm:"autoCreateTime"`
+}
+
+var householdPattern = regexp.MustCompile(`^[a-z0-9]{1,20}$`)
+
+// defaultResources are the labels and actors a household can start with
+//
+//go:embed resources
+var defaultResources embed.FS
+
+func (hh *household) BeforeCreate(tx *gorm.DB) error {
+	if !householdPattern.MatchString(hh.ID) {
+		return fmt.Errorf("household id must be up to 20 lowercase letters and digits, got %q", hh.ID)
+	}
+
+	if hh.Resources != "" {
+		if _, err := defaultResources.ReadDir(path.Join("resources", hh.Resources)); err != nil {
+			return fmt.Errorf("unknown resources %q", hh.Resources)
+		}
+	}
+
+	return nil
+}
+
+// scoped is the key of anything kept in memory for a household, so equal
+// signatures or routes of different households don't collide
+type scoped struct {
+	tenant string
+	name   string
+}
+
+func _scoped(db *gorm.DB, name string) scoped {
+	return scoped{_tenantOf(db), name}
+}
+
+// _tenantOf identifies the household of a database session by the prefix of
+// its tables, which is empty for the default household
+func _tenantOf(db *gorm.DB) string {
+	if naming, ok := db.NamingStrategy.(schema.NamingStrategy); ok {
+		return naming.TablePrefix
+	}
+
+	return ""
+}
+
+// _householdDB opens a session on the same connection pool as root which
+// reads and writes the tables of a household
+func _householdDB(root *gorm.DB, id string) (*gorm.DB, error) {
+	pool, err := root.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	var dialector gorm.Dialector
+	switch d := root.Dialector.(type) {
+	case *sqlite.Dialector:
+		dialector = &sqlite.Dialector{DriverName: d.DriverName, DSN: d.DSN, Conn: pool}
+	case *postgres.Dialector:
+		config := *d.Config
+		config.Conn = pool
+		dialector = postgres.New(config)
+	case *mysql.Dialector:
+		config := *d.Config
+		config.Conn = pool
+		dialector = mysql.New(config)
+	default:
+		return nil, fmt.Errorf("households are not supported on %s", root.Dialector.Name())
+	}
+
+	return gorm.Open(dialector, &gorm.Config{
+		NamingStrategy: schema.NamingStrategy{TablePrefix: "h_" + id + "_"},
+		Logger:         root.Logger,
+	})
+}
+
+// _mountHousehold installs the modules of a household and sets up their
+// routes, the same as the default household has
+func _mountHousehold(db *gorm.DB, batch int, router *mux.Router) error {
+	if err := expenses.Install(db); err != nil {
+		return err
+	}
+
+	modules := []interface{ Install() error }{
+		journal{db, batch},
+		transfers{db, batch},
+		budgets{db, batch},
+		templates{db, batch, time.Now},
+		signatures{db, batch},
+		grants{db, batch},
+	}
+
+	for _, mod := range modules {
+		if err := mod.Install(); err != nil {
+			return err
+		}
+	}
+
+	registry{db, batch}.Setup(router)
+	journal{db, batch}.Setup(router)
+	transfers{db, batch}.Setup(router)
+	budgets{db, batch}.Setup(router)
+	insights{db, batch}.Setup(router)
+	templates{db, batch, time.Now}.Setup(router)
+	signatures{db, batch}.Setup(router)
+	jobs{db, batch}.Setup(router)
+	backups{db, batch}.Setup(router)
+	grants{db, batch}.Setup(router)
+
+	router.Use(grants{db, batch}.Enforce)
+
+	if args.schedule > 0 {
+		templates{db, batch, time.Now}.Schedule(args.schedule, args.catchUp)
+	}
+
+	return nil
+}
+
+// _installResources adds the default labels and actors to a household
+func _installResources(db *gorm.DB, batch int, name string) error {
+	var (
+		actors expenses.Actors
+		labels expenses.Labels
+	)
+
+	files := map[string]interface{}{"reg_actors.json": &actors, "reg_labels.json": &labels}
+	for file, target := range files {
+		if data, err := defaultResources.ReadFile(path.Join("resources", name, file)); err != nil {
+			return err
+		} else if err := expenses.FromJson(data, target); err != nil {
+			return err
+		}
+	}
+
+	ctx := expenses.PushContext{Storage: db, BatchSize: batch, JustAppend: true}
+	if err := actors.Push(ctx); err != nil {
+		return err
+	}
+
+	return labels.Push(ctx)
+}
+
+var (
+	householdRouters = make(map[string]*mux.Router)
+	householdLock    sync.Mutex
+)
+
+var errHouseholdNotFound = errors.New("household not found")
+
+// Router returns the router of a household, mounted on first use
+func (h households) Router(id string) (*mux.Router, error) {
+	householdLock.Lock()
+	defer householdLock.Unlock()
+
+	if router, ok := householdRouters[id]; ok {
+		return router, nil
+	}
+
+	var hh household
+	if err := h.dbInstance.Take(&hh, "id = ?", id).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errHouseholdNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	db, err := _householdDB(h.dbInstance, id)
+	if err != nil {
+		return nil, err
+	}
+
+	router := mux.NewRouter()
+	if err := _mountHousehold(db, h.dbBatchSize, router.PathPrefix(API_PREFIX).Subrouter()); err != nil {
+		return nil, err
+	}
+
+	householdRouters[id] = router
+	return router, nil
+}
+
+// MountAll mounts every household on boot, so their templates get scheduled
+func (h households) MountAll() {
+	var list []household
+	if err := h.dbInstance.Order("id").Find(&list).Error; err != nil {
+		log.Printf("warning: cannot load households: %s\n", err)
+		return
+	}
+
+	for _, hh := range list {
+		if _, err := h.Router(hh.ID); err != nil {
+			log.Printf("warning: cannot mount household %s: %s\n", hh.ID, err)
+		}
+	}
+}
+
+// Dispatch is a middleware which serves the requests of principals from a
+// household with the routes of their household
+func (h households) Dispatch(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, rq *http.Request) {
+		p, ok := _principalOf(rq)
+		if !ok || p.Household == "" {
+			next.ServeHTTP(wr, rq)
+			return
+		}
+
+		if router, err := h.Router(p.Household); errors.Is(err, errHouseholdNotFound) {
+			Response{wr}.Forbidden(fmt.Errorf("household %s of key %q not found", p.Household, p.Name), rq)
+		} else if err != nil {
+			Response{wr}.Fault(err, rq)
+		} else {
+			router.ServeHTTP(wr, rq)
+		}
+	})
+}
+
+func (h households) list(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	list := make([]household, 0)
+	if err := h.dbInstance.Order("id").Find(&list).Error; err != nil {
+		response.Fault(err, rq)
+	} else if output, err := json.Marshal(list); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
+
+// create a household with its tables and, optionally, default resources
+func (h households) create(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	var hh household
+	if payload, err := ioutil.ReadAll(rq.Body); err != nil { // TODO: avoid ioutil because of memory issues?
+		response.Fault(err, rq)
+		return
+	} else if err := json.Unmarshal(payload, &hh); err != nil {
+		response.Wrong(err, rq)
+		return
+	}
+
+	if err := h.dbInstance.Create(&hh).Error; err != nil {
+		response.Wrong(err, rq)
+		return
+	}
+
+	if _, err := h.Router(hh.ID); err != nil {
+		response.Fault(err, rq)
+		return
+	}
+
+	if hh.Resources != "" {
+		db, err := _householdDB(h.dbInstance, hh.ID)
+		if err == nil {
+			err = _installResources(db, h.dbBatchSize, hh.Resources)
+		}
+
+		if err != nil {
+			response.Fault(err, rq)
+			return
+		}
+	}
+
+	if output, err := json.Marshal(hh); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/lexndru/expenses"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+var (
+	householdsDBInstance = sqlite.Open("file:households?mode=memory&cache=shared")
+	householdsHttpRouter *mux.Router
+	householdsDB         *gorm.DB
+)
+
+func init() {
+	if db, err := gorm.Open(householdsDBInstance, &gorm.Config{}); err != nil {
+		panic(err)
+	} else {
+		householdsHttpRouter = mux.NewRouter()
+		householdsDB = db
+
+		expenses.Install(db)
+
+		k, h := keys{db, 10}, households{db, 10}
+		for _, mod := range []interface{ Install() error }{k, h, journal{db, 10}} {
+			if err := mod.Install(); err != nil {
+				panic(err)
+			}
+		}
+
+		router := householdsHttpRouter.PathPrefix(API_PREFIX).Subrouter()
+		router.Use(k.Authenticate)
+		router.Use(h.Dispatch)
+
+		registry{db, 10}.Setup(router)
+		journal{db, 10}.Setup(router)
+		backups{db, 10}.Setup(router)
+		h.Setup(router)
+	}
+}
+
+func TestHouseholdIsolation(t *testing.T) {
+	_, admin, err := _createKey(householdsDB, "root", "admin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(method, target, key, body string, status int) []byte {
+		rq := httptest.NewRequest(method, API_PREFIX+target, strings.NewReader(body))
+		rq.Header.Set("X-Api-Key", key)
+
+		buf := httptest.NewRecorder()
+		householdsHttpRouter.ServeHTTP(buf, rq)
+
+		reply := buf.Result()
+		if reply.StatusCode != status {
+			t.Fatalf("Expected %d for %s %s but got %v", status, method, target, reply.StatusCode)
+		}
+
+		output, _ := io.ReadAll(reply.Body)
+		return output
+	}
+
+	serve("POST", "/households", admin, `{"id":"Smith!","name":"Smith"}`, http.StatusBadRequest)
+	serve("POST", "/households", admin, `{"id":"smith","name":"Smith","resources":"xx_XX"}`, http.StatusBadRequest)
+	serve("POST", "/households", admin, `{"id":"smith","name":"Smith","resources":"ro_RO"}`, http.StatusOK)
+	serve("POST", "/households", admin, `{"id":"jones","name":"Jones"}`, http.StatusOK)
+
+	_, smith, err := _createKey(householdsDB, "smith", "registry:write journal:read backup:read", "smith")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, jones, err := _createKey(householdsDB, "jones", "registry:write journal:read", "jones")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := _createKey(householdsDB, "nobody", "admin", "nobody"); err == nil {
+		t.Fatal("Expected no key for a missing household")
+	}
+
+	var labels []expenses.Label
+	if err := json.Unmarshal(serve("GET", "/registry/labels", smith, "", http.StatusOK), &labels); err != nil || len(labels) == 0 {
+		t.Fatalf("Expected default labels installed for smith but got %d (%v)", len(labels), err)
+	}
+
+	if err := json.Unmarshal(serve("GET", "/registry/labels", jones, "", http.StatusOK), &labels); err != nil || len(labels) != 0 {
+		t.Fatalf("Expected no labels for jones but got %d (%v)", len(labels), err)
+	}
+
+	serve("POST", "/registry/transactions", smith, `[
+		{"date":"2021-05-01T00:00:00Z","amount":-4000,"label":"?","sender":"Me","receiver":"Netflix","signature":"family"}
+	]`, http.StatusOK)
+
+	var reg expenses.Transactions
+	for key, expected := range map[string]int{smith: 1, jones: 0, admin: 0} {
+		if err := json.Unmarshal(serve("GET", "/registry/transactions", key, "", http.StatusOK), &reg); err != nil || len(reg) != expected {
+			t.Fatalf("Expected %d transactions but got %d (%v)", expected, len(reg), err)
+		}
+	}
+
+	serve("HEAD", "/journal/family", smith, "", http.StatusOK)
+
+	var usage journalStoreUsage
+	if err := json.Unmarshal(serve("GET", "/journal", jones, "", http.StatusOK), &usage); err != nil || len(usage.Signatures) != 0 {
+		t.Fatalf("Expected no journal of smith for jones but got %+v (%v)", usage, err)
+	}
+
+	serve("GET", "/households", smith, "", http.StatusForbidden)
+	serve("GET", "/backup", jones, "", http.StatusForbidden)
+
+	archive := serve("GET", "/backup", smith, "", http.StatusOK)
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range zr.File {
+		if file.Name != "reg_transactions.json" {
+			continue
+		}
+
+		fd, _ := file.Open()
+		content, _ := io.ReadAll(fd)
+		fd.Close()
+
+		if !strings.Contains(string(content), "Netflix") {
+			t.Fatalf("Expected backup of smith transactions but got %s", content)
+		}
+
+		return
+	}
+
+	t.Fatal("Expected transactions in the backup of smith")
+}
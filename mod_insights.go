@@ -0,0 +1,380 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lexndru/expenses"
+
+	"gorm.io/gorm"
+)
+
+type insights struct {
+	dbInstance  *gorm.DB
+	dbBatchSize int
+}
+
+func (i insights) Setup(router *mux.Router) {
+	router.HandleFunc("/insights/labels", i.labels).Methods(http.MethodGet)
+	router.HandleFunc("/insights/actors", i.actors).Methods(http.MethodGet)
+	router.HandleFunc("/insights/signatures", i.signatures).Methods(http.MethodGet)
+	router.HandleFunc("/insights/periods/{unit:day|week|month|year}", i.periods).Methods(http.MethodGet)
+	router.HandleFunc("/insights/balance", i.balance).Methods(http.MethodGet)
+	router.HandleFunc("/insights/merchants", i.merchants).Methods(http.MethodGet)
+	router.HandleFunc("/insights/deltas", i.deltas).Methods(http.MethodGet)
+}
+
+// insight is an aggregated row of amounts, where expense is always positive
+// and net is income minus expense
+type insight struct {
+	Name    string `json:"name"`
+	Parent  string `json:"parent,omitempty"`
+	Income  int64  `json:"income"`
+	Expense int64  `json:"expense"`
+	Net     int64  `json:"net"`
+	Count   int64  `json:"count"`
+}
+
+type insightDelta struct {
+	insight
+
+	IncomeDelta  int64   `json:"income_delta"`
+	ExpenseDelta int64   `json:"expense_delta"`
+	ExpenseRatio float64 `json:"expense_ratio"`
+}
+
+// insightFilter narrows down transactions by date range and signatures and
+// it's shared by every insight route
+type insightFilter struct {
+	from       *time.Time
+	to         *time.Time
+	signatures []string
+}
+
+const INSIGHTS_TOP_MERCHANTS = 10
+
+const insightColumns = `sum(case when amount > 0 then amount else 0 end) as income,
+	sum(case when amount < 0 then -amount else 0 end) as expense,
+	sum(amount) as net, count(*) as count`
+
+func (f insightFilter) Scope(db *gorm.DB) *gorm.DB {
+	if f.from != nil {
+		db = db.Where("date >= ?", *f.from)
+	}
+
+	if f.to != nil { // the whole day, not just its midnight
+		db = db.Where("date < ?", f.to.AddDate(0, 0, 1))
+	}
+
+	if len(f.signatures) > 0 {
+		db = db.Where("signature in ?", f.signatures)
+	}
+
+	return db
+}
+
+func _parseInsightFilter(rq *http.Request) (f insightFilter, err error) {
+	query := rq.URL.Query()
+
+	parseDate := func(key string) (*time.Time, error) {
+		if value := query.Get(key); value == "" {
+			return nil, nil
+		} else if date, err := time.ParseInLocation("2006-01-02", value, time.Local); err != nil {
+			return nil, fmt.Errorf("%s must be a date as YYYY-MM-DD, got %q", key, value)
+		} else {
+			return &date, nil
+		}
+	}
+
+	if f.from, err = parseDate("from"); err != nil {
+		return
+	}
+
+	if f.to, err = parseDate("to"); err != nil {
+		return
+	}
+
+	for _, value := range query["signature"] {
+		for _, signature := range strings.Split(value, ",") {
+			if signature = strings.TrimSpace(signature); signature != "" {
+				f.signatures = append(f.signatures, signature)
+			}
+		}
+	}
+
+	if granted, ok := _grantedSignatures(rq); ok {
+		for _, signature := range f.signatures {
+			if !_isGranted(rq, signature) {
+				err = accessDenied{Reason: fmt.Sprintf("signature %s is not granted", signature), Signature: signature, Required: ROLE_VIEWER}
+				return
+			}
+		}
+
+		if len(f.signatures) == 0 {
+			f.signatures = granted
+		}
+	}
+
+	return
+}
+
+// _transactionsOf is the base query for every insight: filtered transactions
+// without linked transfers
+func _transactionsOf(db *gorm.DB, f insightFilter) *gorm.DB {
+	return db.Session(&gorm.Session{NewDB: true}).Model(&expenses.Transaction{}).Scopes(_withoutTransfers, f.Scope)
+}
+
+func _tableOf(db *gorm.DB, model interface{}) string {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		panic(err) // models are known at compile time
+	}
+
+	return stmt.Schema.Table
+}
+
+// _dateFormat returns the SQL expression to truncate dates to a unit, which
+// is different for every supported database driver
+func _dateFormat(unit string) string {
+	layouts := map[string][3]string{ // psql, mysql, sqlite
+		"day":   {"YYYY-MM-DD", "%Y-%m-%d", "%Y-%m-%d"},
+		"week":  {`IYYY-"W"IW`, "%x-W%v", "%Y-W%W"},
+		"month": {"YYYY-MM", "%Y-%m", "%Y-%m"},
+		"year":  {"YYYY", "%Y", "%Y"},
+	}
+
+	layout := layouts[unit]
+
+	switch DRIVER {
+	case "psql":
+		return fmt.Sprintf("to_char(date, '%s')", layout[0])
+	case "mysql":
+		return fmt.Sprintf("date_format(date, '%s')", layout[1])
+	default:
+		return fmt.Sprintf("strftime('%s', date)", layout[2])
+	}
+}
+
+func _groupInsights(db *gorm.DB, f insightFilter, expr string) ([]insight, error) {
+	rows := make([]insight, 0)
+
+	query := _transactionsOf(db, f).Select(expr + " as name, " + insightColumns).Group("name").Order("name")
+	if err := query.Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+// _labelInsights aggregates amounts per label where transactions with details
+// are split into their breakdown; with rollup enabled every label includes the
+// amounts of its children
+func _labelInsights(db *gorm.DB, f insightFilter, rollup bool) ([]insight, error) {
+	trxTable := _tableOf(db, &expenses.Transaction{})
+	dlsTable := _tableOf(db, &expenses.Details{})
+
+	withDetails := db.Session(&gorm.Session{NewDB: true}).Model(&expenses.Details{}).Select("transaction_uuid")
+
+	plain := _transactionsOf(db, f).Select("label_name as name, amount").Where("uuid not in (?)", withDetails)
+	split := db.Session(&gorm.Session{NewDB: true}).Table(dlsTable+" d").
+		Select("d.label_name as name, case when t.amount < 0 then -d.amount else d.amount end as amount").
+		Joins("join "+trxTable+" t on t.uuid = d.transaction_uuid").
+		Where("t.uuid in (?)", _transactionsOf(db, f).Select("uuid"))
+
+	rows := make([]insight, 0)
+	sql := "select name, " + insightColumns + " from (? union all ?) entries group by name order by name"
+	if err := db.Raw(sql, plain, split).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	parents, err := _labelParents(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if !rollup {
+		for i := range rows {
+			rows[i].Parent = parents[rows[i].Name]
+		}
+
+		return rows, nil
+	}
+
+	totals := make(map[string]*insight)
+	for _, row := range rows {
+		for _, label := range _labelLineage(parents, row.Name) {
+			if _, ok := totals[label]; !ok {
+				totals[label] = &insight{Name: label, Parent: parents[label]}
+			}
+
+			totals[label].Income += row.Income
+			totals[label].Expense += row.Expense
+			totals[label].Net += row.Net
+			totals[label].Count += row.Count
+		}
+	}
+
+	rolled := make([]insight, 0, len(totals))
+	for _, total := range totals {
+		rolled = append(rolled, *total)
+	}
+
+	sort.Slice(rolled, func(i, j int) bool {
+		return rolled[i].Name < rolled[j].Name
+	})
+
+	return rolled, nil
+}
+
+func _deltaInsights(rows []insight) []insightDelta {
+	deltas := make([]insightDelta, len(rows))
+
+	for i, row := range rows {
+		deltas[i].insight = row
+		if i == 0 {
+			continue // nothing to compare the first month with
+		}
+
+		prev := rows[i-1]
+		deltas[i].IncomeDelta = row.Income - prev.Income
+		deltas[i].ExpenseDelta = row.Expense - prev.Expense
+
+		if prev.Expense != 0 {
+			deltas[i].ExpenseRatio = float64(deltas[i].ExpenseDelta) / float64(prev.Expense)
+		}
+	}
+
+	return deltas
+}
+
+func (i insights) labels(wr http.ResponseWriter, rq *http.Request) {
+	_resolveInsightRequest(i.dbInstance, wr, rq, func(f insightFilter) (interface{}, error) {
+		return _labelInsights(i.dbInstance, f, rq.URL.Query().Get("rollup") != "false")
+	})
+}
+
+func (i insights) actors(wr http.ResponseWriter, rq *http.Request) {
+	_resolveInsightRequest(i.dbInstance, wr, rq, func(f insightFilter) (interface{}, error) {
+		return _groupInsights(i.dbInstance, f, "case when amount < 0 then receiver_name else sender_name end")
+	})
+}
+
+func (i insights) signatures(wr http.ResponseWriter, rq *http.Request) {
+	_resolveInsightRequest(i.dbInstance, wr, rq, func(f insightFilter) (interface{}, error) {
+		return _groupInsights(i.dbInstance, f, "signature")
+	})
+}
+
+func (i insights) periods(wr http.ResponseWriter, rq *http.Request) {
+	unit := mux.Vars(rq)["unit"]
+
+	_resolveInsightRequest(i.dbInstance, wr, rq, func(f insightFilter) (interface{}, error) {
+		return _groupInsights(i.dbInstance, f, _dateFormat(unit))
+	})
+}
+
+func (i insights) balance(wr http.ResponseWriter, rq *http.Request) {
+	_resolveInsightRequest(i.dbInstance, wr, rq, func(f insightFilter) (interface{}, error) {
+		total := insight{Name: "balance"}
+		err := _transactionsOf(i.dbInstance, f).Select(insightColumns).Scan(&total).Error
+		total.Name = "balance"
+
+		return total, err
+	})
+}
+
+func (i insights) merchants(wr http.ResponseWriter, rq *http.Request) {
+	top := INSIGHTS_TOP_MERCHANTS
+	if value := rq.URL.Query().Get("top"); value != "" {
+		if n, err := strconv.Atoi(value); err != nil || n < 1 {
+			Response{wr}.Wrong(fmt.Errorf("top must be a positive number, got %q", value), rq)
+			return
+		} else {
+			top = n
+		}
+	}
+
+	_resolveInsightRequest(i.dbInstance, wr, rq, func(f insightFilter) (interface{}, error) {
+		rows := make([]insight, 0)
+
+		query := _transactionsOf(i.dbInstance, f).Where("amount < 0").
+			Select("receiver_name as name, " + insightColumns).
+			Group("receiver_name").Order("expense DESC").Limit(top)
+
+		return rows, query.Scan(&rows).Error
+	})
+}
+
+func (i insights) deltas(wr http.ResponseWriter, rq *http.Request) {
+	_resolveInsightRequest(i.dbInstance, wr, rq, func(f insightFilter) (interface{}, error) {
+		if rows, err := _groupInsights(i.dbInstance, f, _dateFormat("month")); err != nil {
+			return nil, err
+		} else {
+			return _deltaInsights(rows), nil
+		}
+	})
+}
+
+// _resolveInsightRequest shares the response cache with the registry, but the
+// key includes the query string because insights depend on filters
+func _resolveInsightRequest(db *gorm.DB, wr http.ResponseWriter, rq *http.Request, compute func(insightFilter) (interface{}, error)) {
+	startTime := time.Now()
+	response := Response{wr}
+
+	key := _restrictedKey(rq, _scoped(db, rq.URL.RequestURI()))
+	if cached, ok := _cacheLoad(key); ok {
+		response.Okay(cached, true, time.Since(startTime), rq)
+		return // no need to continue
+	}
+
+	f, err := _parseInsightFilter(rq)
+	if errors.As(err, &accessDenied{}) {
+		response.Forbidden(err, rq)
+		return
+	} else if err != nil {
+		response.Wrong(err, rq)
+		return
+	}
+
+	if data, err := compute(f); err != nil {
+		response.Fault(err, rq)
+	} else if out, err := expenses.ToJson(data); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(out, false, time.Since(startTime), rq)
+		_cacheStore(key, out)
+	}
+}
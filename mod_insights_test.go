@@ -0,0 +1,232 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lexndru/expenses"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+var (
+	insightsDBInstance = sqlite.Open("file::memory:")
+	insightsHttpRouter *mux.Router
+)
+
+func init() {
+	if db, err := gorm.Open(insightsDBInstance, &gorm.Config{}); err != nil {
+		panic(err)
+	} else {
+		insightsHttpRouter = mux.NewRouter()
+
+		expenses.Install(db)
+
+		trf := transfers{db, 10}
+		if err := trf.Install(); err != nil {
+			panic(err)
+		}
+
+		mod := insights{db, 10}
+		mod.Setup(insightsHttpRouter)
+
+		reg := registry{db, 10}
+		reg.Setup(insightsHttpRouter)
+
+		home := expenses.NewLabel("Casă", nil)
+		food := expenses.NewLabel("Alimente", &home)
+		water := expenses.NewLabel("Apă", &home)
+		labels := expenses.Labels{home, food, water, expenses.NewLabel("Salariu", nil)}
+		if err := labels.Push(expenses.PushContext{Storage: db, BatchSize: 10}); err != nil {
+			panic(err)
+		}
+
+		day := func(m time.Month, d int) time.Time {
+			return time.Date(2021, m, d, 0, 0, 0, 0, time.UTC)
+		}
+
+		out, in := "5c1f1d62-0000-4000-8000-000000000001", "5c1f1d62-0000-4000-8000-000000000002"
+
+		seed := expenses.Transactions{
+			{Date: day(1, 5), Amount: 500000, LabelName: "Salariu", SenderName: "Work", ReceiverName: "Me", Signature: "card"},
+			{Date: day(1, 10), Amount: -20000, LabelName: "Alimente", SenderName: "Me", ReceiverName: "Market", Signature: "card"},
+			{Date: day(2, 10), Amount: -30000, LabelName: "Casă", SenderName: "Me", ReceiverName: "Market", Signature: "card",
+				Details: []*expenses.Details{{LabelName: "Alimente", Amount: 25000}, {LabelName: "Apă", Amount: 5000}}},
+			{Date: day(2, 12), Amount: -4000, LabelName: "Apă", SenderName: "Me", ReceiverName: "Apa Nova", Signature: "cash"},
+			{UUID: &out, Date: day(2, 15), Amount: -100000, LabelName: "Economii", SenderName: "Me", ReceiverName: "Me", Signature: "card"},
+			{UUID: &in, Date: day(2, 15), Amount: 100000, LabelName: "Economii", SenderName: "Me", ReceiverName: "Me", Signature: "savings"},
+		}
+
+		if err := seed.Push(expenses.PushContext{Storage: db, BatchSize: 10}); err != nil {
+			panic(err)
+		}
+
+		if err := db.Create(&transfer{OutgoingUUID: out, IncomingUUID: in, Amount: 100000}).Error; err != nil {
+			panic(err)
+		}
+	}
+}
+
+func _requestInsights(t *testing.T, path string, into interface{}) *http.Response {
+	buf := httptest.NewRecorder()
+	insightsHttpRouter.ServeHTTP(buf, httptest.NewRequest("GET", path, nil))
+	reply := buf.Result()
+
+	if into != nil && reply.StatusCode == http.StatusOK {
+		body, _ := io.ReadAll(reply.Body)
+		if err := json.Unmarshal(body, into); err != nil {
+			t.Fatalf("Unexpected insight response %s: %s", body, err)
+		}
+	}
+
+	return reply
+}
+
+func TestLabelInsightsWithRollup(t *testing.T) {
+	var rows []insight
+	if reply := _requestInsights(t, "/insights/labels", &rows); reply.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 OK but got %v", reply.StatusCode)
+	}
+
+	totals := make(map[string]insight)
+	for _, row := range rows {
+		totals[row.Name] = row
+	}
+
+	if _, ok := totals["Economii"]; ok {
+		t.Fatal("Expected linked transfers to be left out")
+	}
+
+	if food := totals["Alimente"]; food.Expense != 45000 || food.Parent != "Casă" {
+		t.Fatalf("Expected 45000 spent on Alimente from plain and split transactions but got %+v", food)
+	}
+
+	if home := totals["Casă"]; home.Expense != 54000 {
+		t.Fatalf("Expected children to roll up into 54000 spent on Casă but got %+v", home)
+	}
+
+	var flat []insight
+	_requestInsights(t, "/insights/labels?rollup=false&signature=card", &flat)
+
+	for _, row := range flat {
+		if row.Name == "Casă" {
+			t.Fatalf("Expected no own amounts on Casă without rollup but got %+v", row)
+		}
+	}
+}
+
+func TestPeriodAndBalanceInsights(t *testing.T) {
+	var months []insight
+	_requestInsights(t, "/insights/periods/month", &months)
+
+	if len(months) != 2 || months[0].Name != "2021-01" || months[1].Expense != 34000 {
+		t.Fatalf("Expected two months with 34000 spent in february but got %+v", months)
+	}
+
+	var total insight
+	_requestInsights(t, "/insights/balance?from=2021-02-01&to=2021-02-28", &total)
+
+	if total.Income != 0 || total.Expense != 34000 || total.Count != 2 {
+		t.Fatalf("Expected february balance without transfers but got %+v", total)
+	}
+
+	var deltas []insightDelta
+	_requestInsights(t, "/insights/deltas", &deltas)
+
+	if len(deltas) != 2 || deltas[1].ExpenseDelta != 14000 {
+		t.Fatalf("Expected month over month expense delta 14000 but got %+v", deltas)
+	}
+
+	if reply := _requestInsights(t, "/insights/balance?from=yesterday", nil); reply.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 Bad Request for wrong date filter but got %v", reply.StatusCode)
+	}
+}
+
+func TestMerchantInsightsAreCached(t *testing.T) {
+	var top []insight
+	_requestInsights(t, "/insights/merchants?top=1", &top)
+
+	if len(top) != 1 || top[0].Name != "Market" || top[0].Expense != 50000 {
+		t.Fatalf("Expected Market as top merchant but got %+v", top)
+	}
+
+	if reply := _requestInsights(t, "/insights/merchants?top=1", nil); reply.Header.Get("X-Cache") != "true" {
+		t.Fatal("Expected second call to be served from cache")
+	}
+
+	var actors []insight
+	_requestInsights(t, "/insights/actors?signature=cash", &actors)
+
+	if len(actors) != 1 || actors[0].Name != "Apa Nova" {
+		t.Fatalf("Expected one actor for cash signature but got %+v", actors)
+	}
+}
+
+func TestInsightsAfterRegistryWrites(t *testing.T) {
+	write := func(path, payload string) {
+		buf := httptest.NewRecorder()
+		insightsHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", path, strings.NewReader(payload)))
+
+		if reply := buf.Result(); reply.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 OK after POST %s but got %v", path, reply.StatusCode)
+		}
+	}
+
+	write("/registry/transactions", `[
+		{"date":"2021-02-28T18:30:00Z","amount":-1500,"label":"Alimente","sender":"Me","receiver":"Kiosk","signature":"evening"}
+	]`)
+
+	var total insight
+	if _requestInsights(t, "/insights/balance?signature=evening&to=2021-02-28", &total); total.Count != 1 {
+		t.Fatalf("Expected the last day to be included but got %+v", total)
+	}
+
+	_requestInsights(t, "/insights/labels?signature=evening", nil)
+	if reply := _requestInsights(t, "/insights/labels?signature=evening", nil); reply.Header.Get("X-Cache") != "true" {
+		t.Fatal("Expected second call to be served from cache")
+	}
+
+	for _, change := range []func(){
+		func() { write("/registry/labels", `[{"name":"Cadouri"}]`) },
+		func() { write("/registry/actors", `[{"name":"Florărie"}]`) },
+	} {
+		_requestInsights(t, "/insights/labels?signature=evening", nil)
+		if change(); _requestInsights(t, "/insights/labels?signature=evening", nil).Header.Get("X-Cache") == "true" {
+			t.Fatal("Expected insights to be computed again after a registry write")
+		}
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+type jobs struct {
+	dbInstance  *gorm.DB
+	dbBatchSize int
+}
+
+func (j jobs) Setup(router *mux.Router) {
+	router.HandleFunc("/jobs", j.list).Methods(http.MethodGet)
+	router.HandleFunc("/jobs/{id:[a-f0-9-]+}", j.read).Methods(http.MethodGet)
+	router.HandleFunc("/jobs/{id:[a-f0-9-]+}", j.cancel).Methods(http.MethodDelete)
+}
+
+const (
+	JOB_QUEUED    = "queued"
+	JOB_RUNNING   = "running"
+	JOB_DONE      = "done"
+	JOB_FAILED    = "failed"
+	JOB_CANCELLED = "cancelled"
+)
+
+const (
+	JOBS_CONCURRENCY = 2
+	JOBS_RETENTION   = 24 * time.Hour
+)
+
+// jobTask is the work of a job; it should stop when ctx is done and report
+// its progress as a fraction between 0 and 1 whenever it can
+type jobTask func(ctx context.Context, progress func(float64)) (interface{}, error)
+
+type job struct {
+	ID        string          `json:"id"`
+	Kind      string          `json:"kind"`
+	Signature string          `json:"signature,omitempty"`
+	Status    string          `json:"status"`
+	Progress  float64         `json:"progress"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Created   time.Time       `json:"created"`
+	Started   *time.Time      `json:"started,omitempty"`
+	Finished  *time.Time      `json:"finished,omitempty"`
+
+	tenant string
+	cancel context.CancelFunc
+}
+
+func (jb job) IsActive() bool {
+	return jb.Status == JOB_QUEUED || jb.Status == JOB_RUNNING
+}
+
+// jobRunner runs long tasks (evaluations, imports, backups, reports) in the
+// background, a few at a time, and keeps finished jobs around for a while so
+// their results can be read
+type jobRunner struct {
+	lock      sync.Mutex
+	jobs      map[string]*job
+	slots     chan struct{}
+	retention time.Duration
+}
+
+var runner = newJobRunner(JOBS_CONCURRENCY, JOBS_RETENTION)
+
+func newJobRunner(concurrency int, retention time.Duration) *jobRunner {
+	return &jobRunner{
+		jobs:      make(map[string]*job),
+		slots:     make(chan struct{}, concurrency),
+		retention: retention,
+	}
+}
+
+// Start queues a task of a household and returns its job right away
+func (r *jobRunner) Start(tenant, kind, signature string, task jobTask) job {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	jb := &job{
+		ID:        uuid.New().String(),
+		Kind:      kind,
+		Signature: signature,
+		Status:    JOB_QUEUED,
+		Created:   time.Now(),
+		tenant:    tenant,
+		cancel:    cancel,
+	}
+
+	r.lock.Lock()
+	r.prune(jb.Created)
+	r.jobs[jb.ID] = jb
+	snapshot := *jb
+	r.lock.Unlock()
+
+	go r.run(ctx, jb, task)
+
+	return snapshot
+}
+
+func (r *jobRunner) run(ctx context.Context, jb *job, task jobTask) {
+	defer jb.cancel()
+
+	select {
+	case r.slots <- struct{}{}:
+		defer func() { <-r.slots }()
+	case <-ctx.Done():
+		r.finish(jb, nil, ctx.Err())
+		return
+	}
+
+	r.update(jb, func(jb *job) {
+		started := time.Now()
+		jb.Status, jb.Started = JOB_RUNNING, &started
+	})
+
+	result, err := task(ctx, func(progress float64) {
+		r.update(jb, func(jb *job) {
+			jb.Progress = progress
+		})
+	})
+
+	r.finish(jb, result, err)
+}
+
+func (r *jobRunner) update(jb *job, fn func(*job)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	fn(jb)
+}
+
+func (r *jobRunner) finish(jb *job, result interface{}, err error) {
+	r.update(jb, func(jb *job) {
+		finished := time.Now()
+		jb.Finished = &finished
+
+		switch {
+		case errors.Is(err, context.Canceled):
+			jb.Status = JOB_CANCELLED
+		case err != nil:
+			jb.Status, jb.Error = JOB_FAILED, err.Error()
+		default:
+			jb.Status, jb.Progress = JOB_DONE, 1
+		}
+
+		if jb.Status != JOB_DONE || result == nil {
+			return
+		}
+
+		// results are kept as JSON so they don't change after the job is done
+		if output, err := json.Marshal(result); err != nil {
+			jb.Status, jb.Error = JOB_FAILED, err.Error()
+		} else {
+			jb.Result = output
+		}
+	})
+}
+
+// prune forgets jobs finished longer than retention ago; expects the lock
+func (r *jobRunner) prune(now time.Time) {
+	for id, jb := range r.jobs {
+		if jb.Finished != nil && now.Sub(*jb.Finished) > r.retention {
+			delete(r.jobs, id)
+		}
+	}
+}
+
+func (r *jobRunner) Get(tenant, id string) (job, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if jb, ok := r.jobs[id]; ok && jb.tenant == tenant {
+		return *jb, true
+	}
+
+	return job{}, false
+}
+
+// List returns the jobs of a household of a kind and/or signature (all if
+// empty), newest first
+func (r *jobRunner) List(tenant, kind, signature string) []job {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.prune(time.Now())
+
+	list := make([]job, 0, len(r.jobs))
+	for _, jb := range r.jobs {
+		if jb.tenant != tenant {
+			continue
+		}
+
+		if (kind == "" || jb.Kind == kind) && (signature == "" || jb.Signature == signature) {
+			list = append(list, *jb)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Created.Equal(list[j].Created) {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].Created.After(list[j].Created)
+	})
+
+	return list
+}
+
+// Cancel stops an active job, or forgets a finished one
+func (r *jobRunner) Cancel(tenant, id string) (job, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	jb, ok := r.jobs[id]
+	if !ok || jb.tenant != tenant {
+		return job{}, false
+	}
+
+	if jb.IsActive() {
+		jb.cancel() // the job is marked as cancelled once its task returns
+	} else {
+		delete(r.jobs, id)
+	}
+
+	return *jb, true
+}
+
+func (j jobs) list(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	query := rq.URL.Query()
+	list := make([]job, 0)
+	for _, jb := range runner.List(_tenantOf(j.dbInstance), query.Get("kind"), query.Get("signature")) {
+		if _isGranted(rq, jb.Signature) {
+			list = append(list, jb)
+		}
+	}
+
+	if output, err := json.Marshal(list); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
+
+func (j jobs) read(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	params := mux.Vars(rq)
+	id := params["id"]
+
+	if jb, ok := runner.Get(_tenantOf(j.dbInstance), id); !ok {
+		response.Missing(fmt.Errorf("job %s not found", id), rq)
+	} else if output, err := json.Marshal(jb); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
+
+func (j jobs) cancel(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	params := mux.Vars(rq)
+	id := params["id"]
+
+	if jb, ok := runner.Cancel(_tenantOf(j.dbInstance), id); !ok {
+		response.Missing(fmt.Errorf("job %s not found", id), rq)
+	} else if output, err := json.Marshal(jb); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
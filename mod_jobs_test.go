@@ -0,0 +1,196 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func _waitForJob(t *testing.T, id string) job {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if jb, ok := runner.Get("", id); ok && !jb.IsActive() {
+			return jb
+		}
+	}
+
+	t.Fatalf("Expected job %s to finish in time", id)
+	return job{}
+}
+
+func TestJobRunner(t *testing.T) {
+	done := runner.Start("", "test", "jobs-signature", func(ctx context.Context, progress func(float64)) (interface{}, error) {
+		progress(0.5)
+		return map[string]int{"answer": 42}, nil
+	})
+
+	if jb := _waitForJob(t, done.ID); jb.Status != JOB_DONE || jb.Progress != 1 || string(jb.Result) != `{"answer":42}` {
+		t.Fatalf("Expected job to be done with its result but got %+v", jb)
+	}
+
+	failed := runner.Start("", "test", "jobs-signature", func(ctx context.Context, progress func(float64)) (interface{}, error) {
+		return nil, errors.New("broken")
+	})
+
+	if jb := _waitForJob(t, failed.ID); jb.Status != JOB_FAILED || jb.Error != "broken" {
+		t.Fatalf("Expected job to fail but got %+v", jb)
+	}
+
+	started := make(chan bool)
+	blocked := runner.Start("", "test", "jobs-signature", func(ctx context.Context, progress func(float64)) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	<-started
+	if jb, ok := runner.Cancel("", blocked.ID); !ok || jb.Status != JOB_RUNNING {
+		t.Fatalf("Expected running job to be cancelled but got %+v", jb)
+	}
+
+	if jb := _waitForJob(t, blocked.ID); jb.Status != JOB_CANCELLED || jb.Finished == nil {
+		t.Fatalf("Expected job to be cancelled but got %+v", jb)
+	}
+
+	if list := runner.List("", "test", "jobs-signature"); len(list) != 3 || list[0].ID != blocked.ID {
+		t.Fatalf("Expected 3 jobs newest first but got %+v", list)
+	}
+
+	runner.Cancel("", done.ID) // finished jobs are forgotten
+	if _, ok := runner.Get("", done.ID); ok {
+		t.Fatal("Expected finished job to be forgotten once deleted")
+	}
+}
+
+func TestEvaluationJob(t *testing.T) {
+	router := mux.NewRouter()
+	jobs{journalModule.dbInstance, 10}.Setup(router)
+
+	buf := httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/journal/test-signature/jobs", nil))
+
+	var started job
+	if err := json.NewDecoder(buf.Result().Body).Decode(&started); err != nil {
+		t.Fatal(err)
+	}
+
+	if started.ID == "" || started.Kind != JOB_EVALUATION || buf.Result().Header.Get("Location") != API_PREFIX+"/jobs/"+started.ID {
+		t.Fatalf("Expected an evaluation job but got %+v", started)
+	}
+
+	_waitForJob(t, started.ID)
+
+	buf = httptest.NewRecorder()
+	router.ServeHTTP(buf, httptest.NewRequest("GET", "/jobs/"+started.ID, nil))
+
+	var finished job
+	if err := json.NewDecoder(buf.Result().Body).Decode(&finished); err != nil {
+		t.Fatal(err)
+	}
+
+	var patterns tendency
+	if finished.Status != JOB_DONE || json.Unmarshal(finished.Result, &patterns) != nil || len(patterns) == 0 {
+		t.Fatalf("Expected evaluation job to be done with patterns but got %+v", finished)
+	}
+
+	buf = httptest.NewRecorder()
+	router.ServeHTTP(buf, httptest.NewRequest("DELETE", "/jobs/"+started.ID, nil))
+	if reply := buf.Result(); reply.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 OK on delete but got %v", reply.StatusCode)
+	}
+
+	buf = httptest.NewRecorder()
+	router.ServeHTTP(buf, httptest.NewRequest("GET", "/jobs/"+started.ID, nil))
+	if reply := buf.Result(); reply.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 Not Found after delete but got %v", reply.StatusCode)
+	}
+}
+
+func TestEvaluationProgressAndCancel(t *testing.T) {
+	var payload []string
+	for day := 1; day <= 25; day++ {
+		payload = append(payload, fmt.Sprintf(`{"date":"2021-01-%02dT00:00:00Z","amount":-%d,"label":"Mancare","sender":"Me","receiver":"Lidl","signature":"batched-signature"}`, day, 1000+day))
+	}
+
+	buf := httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/registry/transactions", strings.NewReader("["+strings.Join(payload, ",")+"]")))
+	if reply := buf.Result(); reply.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 OK after POST but got %v", reply.StatusCode)
+	}
+
+	var pulled []float64
+	if err := _evaluateContext(context.Background(), journalModule, "batched-signature", func(progress float64) {
+		if progress < 0.5 {
+			pulled = append(pulled, progress)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rs, ok := _remembered(journalModule.dbInstance, "batched-signature"); len(pulled) != 2 || !ok || len(rs.records) != 25 {
+		t.Fatalf("Expected 25 records pulled in batches of 10 but got %v", pulled)
+	}
+
+	// cancelled once everything is pulled, so while computing
+	_forget(journalModule.dbInstance, "batched-signature")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := _evaluateContext(ctx, journalModule, "batched-signature", func(progress float64) {
+		if progress >= 0.5 {
+			cancel()
+		}
+	}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a cancelled evaluation but got %v", err)
+	} else if _, ok := _remembered(journalModule.dbInstance, "batched-signature"); ok {
+		t.Fatal("Expected nothing kept of a cancelled evaluation")
+	}
+
+	records := make([]record, 2*JOURNAL_COMPUTE_STEP+1)
+	for i := range records {
+		records[i] = record{Sender: "Me", Receiver: "Lidl", Label: "Mancare", Date: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), Amount: -1000}
+	}
+
+	var computed []float64
+	if _, err := _computeContext(context.Background(), records, func(done float64) { computed = append(computed, done) }); err != nil || len(computed) != 2 {
+		t.Fatalf("Expected progress every %d records but got %v (%v)", JOURNAL_COMPUTE_STEP, computed, err)
+	}
+
+	if _, err := _computeContext(ctx, records, func(float64) {}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected computing to stop once cancelled but got %v", err)
+	}
+}
@@ -29,6 +29,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
@@ -44,6 +45,7 @@ import (
 	"github.com/lexndru/expenses"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type journal struct {
@@ -51,13 +53,72 @@ type journal struct {
 	dbBatchSize int
 }
 
+func (j journal) Install() error {
+	return j.dbInstance.AutoMigrate(&journalModel{}, &journalFeedback{}, &journalSetting{})
+}
+
 func (j journal) Setup(router *mux.Router) {
+	router.HandleFunc("/journal", j.loaded).Methods(http.MethodGet)
 	router.HandleFunc("/journal/{signature:[a-z0-9-]+}", j.evaluateWithoutOutput).Methods(http.MethodHead)
 	router.HandleFunc("/journal/{signature:[a-z0-9-]+}", j.evaluate).Methods(http.MethodGet)
 	router.HandleFunc("/journal/{signature:[a-z0-9-]+}", j.analyze).Methods(http.MethodPost)
 	router.HandleFunc("/journal/{signature:[a-z0-9-]+}/download", j.download).Methods(http.MethodGet)
+	router.HandleFunc("/journal/{signature:[a-z0-9-]+}/rebuild", j.rebuild).Methods(http.MethodPost)
+	router.HandleFunc("/journal/{signature:[a-z0-9-]+}/jobs", j.startEvaluation).Methods(http.MethodPost)
+	router.HandleFunc("/journal/{signature:[a-z0-9-]+}/categorize", j.categorize).Methods(http.MethodPost)
+	router.HandleFunc("/journal/{signature:[a-z0-9-]+}/feedback", j.feedback).Methods(http.MethodPost)
+	router.HandleFunc("/journal/{signature:[a-z0-9-]+}/feedback/stats", j.feedbackStatistics).Methods(http.MethodGet)
+	router.HandleFunc("/journal/{signature:[a-z0-9-]+}/classifier", j.readClassifier).Methods(http.MethodGet)
+	router.HandleFunc("/journal/{signature:[a-z0-9-]+}/classifier", j.writeClassifier).Methods(http.MethodPut)
+	router.HandleFunc("/journal/{signature:[a-z0-9-]+}/evaluation", j.evaluation).Methods(http.MethodGet)
+	router.HandleFunc("/journal/{signature:[a-z0-9-]+}/recurring", j.recurring).Methods(http.MethodGet)
+	router.HandleFunc("/journal/{signature:[a-z0-9-]+}/anomalies", j.anomalies).Methods(http.MethodGet)
+	router.HandleFunc("/journal/{signature:[a-z0-9-]+}/forecast", j.forecast).Methods(http.MethodGet)
+}
+
+func init() {
+	registryHooks = append(registryHooks, _learn) // keep models current on every write
+}
+
+func (j journal) rebuild(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	params := mux.Vars(rq)
+	signature := params["signature"]
+
+	jb := runner.Start(_tenantOf(j.dbInstance), JOB_REBUILD, signature, func(ctx context.Context, progress func(float64)) (interface{}, error) {
+		err := _evaluateContext(ctx, j, signature, progress)
+		if err != nil {
+			log.Printf("warning: background rebuild of %s failed: %s\n", signature, err)
+		}
+		return nil, err
+	})
+
+	output := fmt.Sprintf(`{"signature":%q,"status":"rebuilding","job":%q}`, signature, jb.ID)
+	response.Okay([]byte(output), false, time.Since(startTime), rq)
+}
+
+// exportedRecord is a record as downloaded in JSON formats, see ToSlice
+type exportedRecord struct {
+	Sender   string      `json:"sender"`
+	Receiver string      `json:"receiver"`
+	Label    string      `json:"label"`
+	Date     string      `json:"date"`
+	Amount   json.Number `json:"amount"`
+	Parent   string      `json:"parent"`
 }
 
+const (
+	DOWNLOAD_CSV    = "csv"
+	DOWNLOAD_NDJSON = "ndjson"
+	DOWNLOAD_JSON   = "json"
+)
+
+// download exports the records of a signature (evaluated first if needed) as
+// CSV with headers, NDJSON or JSON; CSV values are separated by ?sep, either
+// a comma or a semicolon (escaped as %3B or spelled out) which also makes the
+// decimal mark a comma for Excel in ro_RO; ?from and ?to filter by date
 func (j journal) download(wr http.ResponseWriter, rq *http.Request) {
 	response := Response{wr}
 	params := mux.Vars(rq)
@@ -65,17 +126,100 @@ func (j journal) download(wr http.ResponseWriter, rq *http.Request) {
 	signature := params["signature"]
 	startTime := time.Now()
 
+	query := rq.URL.Query()
+
+	format := DOWNLOAD_CSV
+	if value := query.Get("format"); value != "" {
+		if value != DOWNLOAD_CSV && value != DOWNLOAD_NDJSON && value != DOWNLOAD_JSON {
+			response.Wrong(fmt.Errorf("format must be one of csv, ndjson or json, got %q", value), rq)
+			return
+		}
+
+		format = value
+	}
+
+	separator, decimalMark := ',', "."
+	if value := query.Get("sep"); value == ";" || value == "semicolon" {
+		separator, decimalMark = ';', ","
+	} else if value != "" && value != "," {
+		response.Wrong(fmt.Errorf("sep must be a comma or a semicolon, got %q", value), rq)
+		return
+	}
+
+	var from, to time.Time
+	for name, value := range map[string]*time.Time{"from": &from, "to": &to} {
+		if text := query.Get(name); text != "" {
+			date, err := time.ParseInLocation("2006-01-02", text, time.Local)
+			if err != nil {
+				response.Wrong(fmt.Errorf("%s must be a date as YYYY-MM-DD, got %q", name, text), rq)
+				return
+			}
+
+			*value = date
+		}
+	}
+
+	_, cached := _remembered(j.dbInstance, signature)
+
+	rs, err := _withRecords(j, signature)
+	if err != nil {
+		response.Fault(err, rq)
+		return
+	}
+
+	var records collection
+	for _, record := range rs.records {
+		// to is inclusive, so it covers the whole day and not just its midnight
+		if (!from.IsZero() && record.Date.Before(from)) || (!to.IsZero() && !record.Date.Before(to.AddDate(0, 0, 1))) {
+			continue
+		}
+
+		records = append(records, record)
+	}
+
 	buf := &bytes.Buffer{}
-	out := csv.NewWriter(buf)
 
-	if rs, ok := memory[signature]; ok {
-		for _, record := range rs.records {
-			out.Write(record.ToSlice())
+	switch format {
+	case DOWNLOAD_CSV:
+		out := csv.NewWriter(buf)
+		out.Comma = separator
+
+		out.Write(recordColumns)
+		for _, record := range records {
+			out.Write(record.ToSlice(decimalMark))
+		}
+
+		out.Flush() // finish writing
+	case DOWNLOAD_NDJSON, DOWNLOAD_JSON:
+		rows := make([]exportedRecord, len(records))
+		for i, record := range records {
+			value := record.ToSlice(".")
+			rows[i] = exportedRecord{value[0], value[1], value[2], value[3], json.Number(value[4]), value[5]}
+		}
+
+		if format == DOWNLOAD_JSON {
+			output, err := json.Marshal(rows)
+			if err != nil {
+				response.Fault(err, rq)
+				return
+			}
+
+			response.Okay(output, cached, time.Since(startTime), rq)
+			return
+		}
+
+		out := json.NewEncoder(buf)
+		for _, row := range rows {
+			if err := out.Encode(row); err != nil {
+				response.Fault(err, rq)
+				return
+			}
 		}
+
+		wr.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
 	}
 
-	out.Flush() // finish writing
-	response.OkayStream(buf.Bytes(), true, time.Since(startTime), rq)
+	response.OkayStream(buf.Bytes(), cached, time.Since(startTime), rq)
 }
 
 func (j journal) evaluateWithoutOutput(wr http.ResponseWriter, rq *http.Request) {
@@ -92,6 +236,38 @@ func (j journal) evaluateWithoutOutput(wr http.ResponseWriter, rq *http.Request)
 	}
 }
 
+const (
+	JOB_EVALUATION = "evaluation"
+	JOB_REBUILD    = "rebuild"
+)
+
+// startEvaluation evaluates a signature in the background, for histories too
+// large to evaluate within the request timeout; the result of the job is the
+// same as of GET on the journal
+func (j journal) startEvaluation(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	params := mux.Vars(rq)
+	signature := params["signature"]
+
+	jb := runner.Start(_tenantOf(j.dbInstance), JOB_EVALUATION, signature, func(ctx context.Context, progress func(float64)) (interface{}, error) {
+		if err := _evaluateContext(ctx, j, signature, progress); err != nil {
+			return nil, err
+		}
+
+		rs, _ := _remembered(j.dbInstance, signature)
+		return rs.patterns, nil
+	})
+
+	if output, err := json.Marshal(jb); err != nil {
+		response.Fault(err, rq)
+	} else {
+		wr.Header().Set("Location", API_PREFIX+"/jobs/"+jb.ID)
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
+
 func (j journal) evaluate(wr http.ResponseWriter, rq *http.Request) {
 	response := Response{wr}
 	startTime := time.Now()
@@ -102,7 +278,7 @@ func (j journal) evaluate(wr http.ResponseWriter, rq *http.Request) {
 	if err := _evaluate(j, signature); err != nil {
 		response.Fault(err, rq)
 	} else {
-		if cache, ok := memory[signature]; ok {
+		if cache, ok := _remembered(j.dbInstance, signature); ok {
 			if out, err := json.Marshal(cache.patterns); err != nil {
 				response.Fault(err, rq)
 			} else {
@@ -132,19 +308,11 @@ func (j journal) analyze(wr http.ResponseWriter, rq *http.Request) {
 				return records[i].Date.After(records[j].Date)
 			})
 
-			newestRecord := records[0].Date
-			oldestRecord := records[len(records)-1].Date
-
-			var reg expenses.Transactions
-			ctx := expenses.PullContext{
-				Storage: j.dbInstance.Where("signature = ? and date between ? and ?", signature, oldestRecord, newestRecord),
-				Limit:   j.dbBatchSize,
-			}
-
-			if err := reg.Pull(ctx); err != nil {
+			if reg, err := _pullAround(j, signature, records); err != nil {
 				response.Fault(err, rq)
 			} else {
-				research := _research(reg, records, signature)
+				_prepare(j, signature)
+				research := _research(j.dbInstance, reg, records, signature)
 				if out, err := json.Marshal(research); err != nil {
 					response.Fault(err, rq)
 				} else {
@@ -157,6 +325,21 @@ func (j journal) analyze(wr http.ResponseWriter, rq *http.Request) {
 	}
 }
 
+// _pullAround returns the registry transactions of a signature within the
+// dates of the given records, which must be sorted from newest to oldest
+func _pullAround(j journal, signature string, records collection) (reg expenses.Transactions, err error) {
+	newestRecord := records[0].Date
+	oldestRecord := records[len(records)-1].Date
+
+	ctx := expenses.PullContext{
+		Storage: j.dbInstance.Where("signature = ? and date between ? and ?", signature, oldestRecord, newestRecord),
+		Limit:   j.dbBatchSize,
+	}
+
+	err = reg.Pull(ctx)
+	return
+}
+
 type similarity struct {
 	Grade  int                  `json:"grade"`
 	Mirror record               `json:"record"`
@@ -166,16 +349,20 @@ type similarity struct {
 type statement struct {
 	record
 
-	Calculated map[string]pointbus `json:"$calculated"`
-	Similarity []similarity        `json:"$similarity"`
+	Calculated map[string]pointbus      `json:"$calculated"`
+	Predicted  map[string]float64       `json:"$predicted"`
+	Explained  map[string][]explanation `json:"$explained"`
+	Similarity []similarity             `json:"$similarity"`
 }
 
-func _research(reg expenses.Transactions, records collection, signature string) []statement {
+func _research(db *gorm.DB, reg expenses.Transactions, records collection, signature string) []statement {
 	var statements = make([]statement, len(records))
 
 	for index, record := range records {
 		statements[index].record = record // inherit?
 		statements[index].Calculated = make(map[string]pointbus)
+		statements[index].Predicted = make(map[string]float64)
+		statements[index].Explained = make(map[string][]explanation)
 		statements[index].Similarity = make([]similarity, 0)
 
 		// look for duplicate or similar transactions
@@ -191,75 +378,63 @@ func _research(reg expenses.Transactions, records collection, signature string)
 			}
 		}
 
-		rs, ok := memory[signature]
+		rs, ok := _remembered(db, signature)
 		if !ok {
 			continue
 		}
 
 		// look for labels based on previous calculated patterns
-		if features, ok := rs.patterns[record.Party()]; ok {
-			score := make(map[string]pointbus) // keep track of feature/label points
-
-			for _, feature := range features {
-				var points pointbus
-
-				if len(feature.Amounts) == 0 {
-					log.Printf("warning: feature \"%s\" has no amounts\n", feature.Category)
-					continue // should not be the case, but best to be safe than crash
-				}
-
-				if (feature.Polarity[0] == 0 && record.Amount > 0) || (feature.Polarity[1] == 0 && record.Amount < 0) {
-					continue // feature is not about this record because polarity for in/out is against amount sign
-				}
+		score, reasons := rs.patterns.Explain(record)
+		predicted := make(map[string]float64)
+		if classifier, ok := _classifierOf(db, signature); ok {
+			predicted = classifier.Predict(record)
+		}
 
-				absValue := int(record.Amount)
-				if absValue < 0 {
-					absValue *= -1
-				}
+		_penalize(db, signature, record.Party(), score, predicted)
+		statements[index].Calculated = score
+		statements[index].Predicted = predicted
 
-				if len(feature.Amounts) > 1 {
-					if _isBetweenAmountDeviation(feature.Amounts, absValue) {
-						points[0] += 1
-					}
-				} else if _isBetweenAmountAprox(feature.Amounts[0], absValue) {
-					points[1] += 1
-				}
-
-				if feature.HasMonth(record.Date.Month()) {
-					points[2] += 1
-				}
+		for label := range score {
+			statements[index].Explained[label] = reasons[label] // dismissed labels are left out
+		}
+	}
 
-				if feature.HasWeekday(record.Date.Weekday()) {
-					points[3] += 1
-				}
+	return statements
+}
 
-				if feature.HasDay(record.Date.Day()) {
-					points[4] += 1
-				}
+// Points scores every label learned for the party of a record; a label gets
+// a point per matched feature (see pointbus)
+func (t tendency) Points(record record) map[string]pointbus {
+	score, _ := t.Explain(record)
+	return score
+}
 
-				if _total(points[:]...) == 0 {
-					continue // no points means this feature is not what we need
-				}
+// Explain is like Points but it also keeps the reasons behind the points of
+// every matched feature of a label
+func (t tendency) Explain(record record) (map[string]pointbus, map[string][]explanation) {
+	score := make(map[string]pointbus) // keep track of feature/label points
+	reasons := make(map[string][]explanation)
 
-				// append polarity avg. as popolarity measurement
-				points[5] += (feature.Polarity[0] + feature.Polarity[1]) / 2
+	for _, feature := range t[record.Party()] {
+		points, reason, ok := feature.Score(record)
+		if !ok {
+			continue
+		}
 
-				if accPoints, ok := score[feature.Category]; ok {
-					var totalPoints pointbus
-					for i := 0; i < cap(totalPoints); i++ {
-						totalPoints[i] = points[i] + accPoints[i]
-					}
-					score[feature.Category] = totalPoints
-				} else {
-					score[feature.Category] = points
-				}
+		if accPoints, ok := score[feature.Category]; ok {
+			var totalPoints pointbus
+			for i := 0; i < cap(totalPoints); i++ {
+				totalPoints[i] = points[i] + accPoints[i]
 			}
-
-			statements[index].Calculated = score
+			score[feature.Category] = totalPoints
+		} else {
+			score[feature.Category] = points
 		}
+
+		reasons[feature.Category] = append(reasons[feature.Category], reason)
 	}
 
-	return statements
+	return score, reasons
 }
 
 type collection []record
@@ -271,21 +446,37 @@ type record struct {
 	Date     time.Time `json:"date"`
 	Amount   int64     `json:"amount"`
 	Parent   string    `json:"parent"`
+	Headers  string    `json:"headers,omitempty"`
 }
 
-func (r record) ToSlice() []string {
+// recordColumns are the names of the values of record.ToSlice
+var recordColumns = []string{"sender", "receiver", "label", "date", "amount", "parent"}
+
+// ToSlice returns the record as text with an ISO date and a decimal amount
+// using the given decimal mark, e.g. a comma for spreadsheets in ro_RO
+func (r record) ToSlice(decimalMark string) []string {
 	var out = make([]string, 6)
 
 	out[0] = r.Sender
 	out[1] = r.Receiver
 	out[2] = r.Label
-	out[3] = fmt.Sprintf("%d", r.Date.Unix())
-	out[4] = fmt.Sprintf("%d", r.Amount)
+	out[3] = r.Date.Format("2006-01-02")
+	out[4] = _decimal(r.Amount, decimalMark)
 	out[5] = r.Parent
 
 	return out
 }
 
+// _decimal formats an amount in minor units (e.g. bani) with two decimals
+func _decimal(amount int64, decimalMark string) string {
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+
+	return fmt.Sprintf("%s%d%s%02d", sign, amount/100, decimalMark, amount%100)
+}
+
 func (r record) ToFeature() feature {
 	polarity := [2]int{0, 0} // in, out
 	absValue := int(r.Amount)
@@ -332,35 +523,85 @@ func (r record) CompareWith(r2 record) int {
 }
 
 func (r record) CompareWithTransaction(t expenses.Transaction) int {
+	return r.CompareWithTolerance(t, tolerance{})
+}
+
+// tolerance of fuzzy comparisons: bank statements often post card payments
+// days after the receipt and tips change the amount slightly; the amount may
+// differ by the greater of Amount and Percent of the record amount
+type tolerance struct {
+	Days    int
+	Amount  int64
+	Percent float64
+}
+
+// CompareWithTolerance grades the similarity of a transaction like
+// CompareWithTransaction but the date and the amount only have to be within
+// tolerance (with the same sign) and actor names are compared normalized
+func (r record) CompareWithTolerance(t expenses.Transaction, tol tolerance) int {
 	var grade int // similarity grade
 
-	if t.Amount == r.Amount && t.Date.Equal(r.Date) {
-		senderName := t.SenderName
-		if name, ok := _fromHeaders(t.Headers, "sender="); ok {
-			senderName = name
-		}
+	if (t.Amount < 0) != (r.Amount < 0) {
+		return grade
+	}
 
-		if senderName == r.Sender {
-			grade += 1
-		}
+	allowed := tol.Amount
+	if percent := int64(math.Abs(float64(r.Amount)) * tol.Percent); percent > allowed {
+		allowed = percent
+	}
 
-		receiverName := t.ReceiverName
-		if name, ok := _fromHeaders(t.Headers, "receiver="); ok {
-			receiverName = name
-		}
+	if diff := t.Amount - r.Amount; diff > allowed || -diff > allowed {
+		return grade
+	}
 
-		if receiverName == r.Receiver {
-			grade += 2
-		}
+	if gap := _daysBetween(r.Date, t.Date); gap > tol.Days || -gap > tol.Days {
+		return grade
+	}
 
-		if t.LabelName == r.Label {
-			grade += 4
-		}
+	senderName := t.SenderName
+	if name, ok := _fromHeaders(t.Headers, "sender="); ok {
+		senderName = name
+	}
+
+	if _normalizeName(senderName) == _normalizeName(r.Sender) {
+		grade += 1
+	}
+
+	receiverName := t.ReceiverName
+	if name, ok := _fromHeaders(t.Headers, "receiver="); ok {
+		receiverName = name
+	}
+
+	if _normalizeName(receiverName) == _normalizeName(r.Receiver) {
+		grade += 2
+	}
+
+	if t.LabelName == r.Label {
+		grade += 4
 	}
 
 	return grade
 }
 
+// CompareWithTransfer grades a transaction as the other side of a transfer:
+// the amount must be opposite and the date within tolerance, then the grade
+// of the mirrored record is added on top of the base grade 8
+func (r record) CompareWithTransfer(t expenses.Transaction, tolerance time.Duration) int {
+	if t.Amount != -r.Amount || r.Amount == 0 {
+		return 0
+	}
+
+	if gap := t.Date.Sub(r.Date); gap > tolerance || gap < -tolerance {
+		return 0
+	}
+
+	mirror := r
+	mirror.Amount = t.Amount
+	mirror.Date = t.Date
+
+	return 8 + mirror.CompareWithTransaction(t)
+}
+
 type feature struct {
 	Category string
 	Polarity [2]int
@@ -403,6 +644,15 @@ func (f *feature) Update(r record) error {
 	return nil
 }
 
+func (f feature) clone() feature {
+	f.Amounts = append([]int(nil), f.Amounts...)
+	f.Weekdays = append([]time.Weekday(nil), f.Weekdays...)
+	f.Months = append([]time.Month(nil), f.Months...)
+	f.Days = append([]int(nil), f.Days...)
+
+	return f
+}
+
 func (f feature) HasMonth(month time.Month) bool {
 	for _, m := range f.Months {
 		if m == month {
@@ -433,31 +683,334 @@ func (f feature) HasDay(day int) bool {
 	return false
 }
 
+// Score gives the points of a record against the feature with the reasons
+// behind them; it's not ok when nothing matched or the feature is not about
+// this kind of record
+func (f feature) Score(record record) (points pointbus, reason explanation, ok bool) {
+	if len(f.Amounts) == 0 {
+		log.Printf("warning: feature \"%s\" has no amounts\n", f.Category)
+		return // should not be the case, but best to be safe than crash
+	}
+
+	if (f.Polarity[0] == 0 && record.Amount > 0) || (f.Polarity[1] == 0 && record.Amount < 0) {
+		return // feature is not about this record because polarity for in/out is against amount sign
+	}
+
+	absValue := int(record.Amount)
+	if absValue < 0 {
+		absValue *= -1
+	}
+
+	if len(f.Amounts) > 1 {
+		if min, max := _amountDeviationBand(f.Amounts, absValue); min <= absValue && absValue <= max {
+			points[0] += 1
+			reason.Amount = &amountBand{Kind: AMOUNT_DEVIATION, Min: min, Max: max}
+		}
+	} else if min, max := _amountAproxBand(f.Amounts[0]); min <= absValue && absValue <= max {
+		points[1] += 1
+		reason.Amount = &amountBand{Kind: AMOUNT_APPROXIMATION, Min: min, Max: max}
+	}
+
+	if month := record.Date.Month(); f.HasMonth(month) {
+		points[2] += 1
+		reason.Month = month.String()
+	}
+
+	if weekday := record.Date.Weekday(); f.HasWeekday(weekday) {
+		points[3] += 1
+		reason.Weekday = weekday.String()
+	}
+
+	if day := record.Date.Day(); f.HasDay(day) {
+		points[4] += 1
+		reason.Day = day
+	}
+
+	if _total(points[:]...) == 0 {
+		return // no points means this feature is not what we need
+	}
+
+	// append polarity avg. as popolarity measurement
+	points[5] += (f.Polarity[0] + f.Polarity[1]) / 2
+
+	reason.History = f.History()
+	return points, reason, true
+}
+
+// History of a feature in a readable form, to explain its predictions
+func (f feature) History() history {
+	h := history{
+		Amounts:  append([]int(nil), f.Amounts...),
+		Months:   make([]string, len(f.Months)),
+		Weekdays: make([]string, len(f.Weekdays)),
+		Days:     append([]int(nil), f.Days...),
+		Incoming: f.Polarity[0],
+		Outgoing: f.Polarity[1],
+	}
+
+	for i, month := range f.Months {
+		h.Months[i] = month.String()
+	}
+
+	for i, weekday := range f.Weekdays {
+		h.Weekdays[i] = weekday.String()
+	}
+
+	return h
+}
+
+const (
+	AMOUNT_DEVIATION     = "deviation"
+	AMOUNT_APPROXIMATION = "approximation"
+)
+
+// amountBand is the range of amounts (absolute values) a feature accepts: a
+// deviation band around the median of many historical amounts or the range
+// between the nearest round values of a single one
+type amountBand struct {
+	Kind string `json:"kind"`
+	Min  int    `json:"min"`
+	Max  int    `json:"max"`
+}
+
+// history of a feature: the amounts, months, weekdays and days of month of
+// the records it learned from, and how many were incoming or outgoing
+type history struct {
+	Amounts  []int    `json:"amounts"`
+	Months   []string `json:"months"`
+	Weekdays []string `json:"weekdays"`
+	Days     []int    `json:"days"`
+	Incoming int      `json:"incoming"`
+	Outgoing int      `json:"outgoing"`
+}
+
+// explanation is why a feature matched a record, one field per pointbus slot
+// that scored, e.g. "paid ~120 RON to this actor on the 5th for 6 months" is
+// an amount band, a day and the months of the history
+type explanation struct {
+	Amount  *amountBand `json:"amount,omitempty"`
+	Month   string      `json:"month,omitempty"`
+	Weekday string      `json:"weekday,omitempty"`
+	Day     int         `json:"day,omitempty"`
+	History history     `json:"history"`
+}
+
+// pointbus holds the points of a label for a record, one slot per feature:
+//
+//	[0] amount within the deviation band of many historical amounts
+//	[1] amount within the approximate range of a single historical amount
+//	[2] month seen before
+//	[3] weekday seen before
+//	[4] day of month seen before
+//	[5] popularity, half the number of records the matched features learned from
 type pointbus [6]int
 
 type routines map[string]map[string][]feature
 
 type tendency map[string][]feature // flatten routines
 
+// Learn updates the model with a new record the same way _calculate does:
+// the latest feature of the category is updated if the record is from the
+// same or the next month, otherwise a new feature is started
+func (t tendency) Learn(r record) {
+	party := r.Party()
+	features := append([]feature(nil), t[party]...)
+
+	for index, f := range features {
+		if f.Category != r.Label {
+			continue
+		}
+
+		// features of a category are kept together, the latest one first
+		if len(f.Months) > 0 {
+			lastMonth, month := f.Months[0], r.Date.Month()
+			if month == lastMonth || lastMonth+1 == month || (lastMonth == 12 && month == 1) {
+				f = f.clone() // readers may still hold the previous model
+				if month != lastMonth {
+					f.Months = append([]time.Month{month}, f.Months...)
+				}
+
+				if err := f.Update(r); err != nil {
+					log.Printf("warning: learn features error: %s\n", err)
+				} else {
+					features[index] = f
+					t[party] = features
+				}
+
+				return
+			}
+		}
+
+		t[party] = append(features[:index], append([]feature{r.ToFeature()}, features[index:]...)...)
+		return
+	}
+
+	t[party] = append(features, r.ToFeature())
+}
+
 type results struct {
 	records  collection
 	patterns tendency
+	computed time.Time
+	recalled bool // patterns of a persisted model, without records
 }
 
-var memory = make(map[string]results)
+// memory holds the results of evaluated signatures, the least recently used
+// are evicted when it's full (see journalStore)
+var memory = newJournalStore(0)
+
+func _remembered(db *gorm.DB, signature string) (results, bool) {
+	return memory.Load(_scoped(db, signature))
+}
+
+func _memorize(db *gorm.DB, signature string, rs results) {
+	memory.Store(_scoped(db, signature), rs)
+}
+
+func _forget(db *gorm.DB, signature string) {
+	memory.Drop(_scoped(db, signature))
+}
+
+// journalModel is the persisted tendency of a signature, so the patterns
+// learned by the journal survive restarts and can be part of backups
+type journalModel struct {
+	Signature  string    `json:"signature" gorm:"type: varchar(36); primaryKey"`
+	Version    int       `json:"version" gorm:"not null"`
+	Patterns   string    `json:"patterns" gorm:"type: text; not null"`
+	Records    int       `json:"records" gorm:"not null"`
+	ComputedAt time.Time `json:"computed_at" gorm:"not null"`
+}
+
+// JOURNAL_MODEL_VERSION must change whenever the structure of features does,
+// so older persisted models are ignored instead of misread
+const JOURNAL_MODEL_VERSION = 1
+
+func _persist(db *gorm.DB, signature string, rs results) error {
+	patterns, err := json.Marshal(rs.patterns)
+	if err != nil {
+		return err
+	}
+
+	model := journalModel{
+		Signature:  signature,
+		Version:    JOURNAL_MODEL_VERSION,
+		Patterns:   string(patterns),
+		Records:    len(rs.records),
+		ComputedAt: rs.computed,
+	}
+
+	return db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&model).Error
+}
+
+// _recall returns the results of a signature from memory or, on first use
+// after a restart, the patterns of the last persisted model without records
+func _recall(db *gorm.DB, signature string) (results, bool) {
+	if rs, ok := _remembered(db, signature); ok {
+		return rs, true
+	}
+
+	var model journalModel
+	if err := db.Where("signature = ? and version = ?", signature, JOURNAL_MODEL_VERSION).Limit(1).Find(&model).Error; err != nil {
+		log.Printf("warning: cannot load journal model of %s: %s\n", signature, err)
+		return results{}, false
+	} else if model.Signature == "" {
+		return results{}, false
+	}
+
+	rs := results{computed: model.ComputedAt, recalled: true}
+	if err := json.Unmarshal([]byte(model.Patterns), &rs.patterns); err != nil {
+		log.Printf("warning: corrupted journal model of %s: %s\n", signature, err)
+		return results{}, false
+	}
+
+	_memorize(db, signature, rs)
+
+	return rs, true
+}
 
 func _evaluate(j journal, signature string) error {
-	var reg expenses.Transactions
+	return _evaluateContext(context.Background(), j, signature, func(float64) {})
+}
 
-	ctx := expenses.PullContext{
-		Storage: j.dbInstance.Where("signature = ?", signature),
-		Limit:   j.dbBatchSize,
+// _evaluateContext is _evaluate which stops once ctx is done, without keeping
+// anything, and reports its progress along the way: transactions are pulled
+// in batches up to half of it and computed up to 90%
+func _evaluateContext(ctx context.Context, j journal, signature string, progress func(float64)) error {
+	startTime := time.Now()
+	storage := j.dbInstance.WithContext(ctx).Where("signature = ?", signature).Session(&gorm.Session{})
+
+	var total int64
+	if err := storage.Model(&expenses.Transaction{}).Count(&total).Error; err != nil {
+		return err
+	}
+
+	batch := j.dbBatchSize
+	if batch < 1 {
+		batch = int(total) // a single batch
+	}
+
+	reg := make(expenses.Transactions, 0, total)
+	for offset := 0; offset < int(total); offset += batch {
+		var page expenses.Transactions
+
+		pullCtx := expenses.PullContext{
+			Storage: storage.Order("date desc, amount desc, uuid"), // stable between batches
+			Limit:   batch,
+			Offset:  offset,
+		}
+
+		if err := page.Pull(pullCtx); err != nil {
+			return err
+		} else if len(page) == 0 {
+			break // removed meanwhile
+		}
+
+		reg = append(reg, page...)
+		progress(0.5 * float64(len(reg)) / float64(total))
 	}
 
-	if err := reg.Pull(ctx); err != nil {
+	progress(0.5)
+	records := _toRecords(reg)
+	patterns, err := _computeContext(ctx, records, func(done float64) {
+		progress(0.5 + 0.4*done)
+	})
+
+	if err != nil {
 		return err
 	}
 
+	progress(0.9)
+	rs := results{
+		records:  records,
+		patterns: patterns,
+		computed: time.Now(),
+	}
+
+	_memorize(j.dbInstance, signature, rs)
+	evaluationDurations.Observe(time.Since(startTime).Seconds())
+
+	return _persist(j.dbInstance, signature, rs)
+}
+
+// _withRecords returns the results of a signature with all its records, so
+// it evaluates the signature if they were not loaded, e.g. after a restart or
+// an eviction since records are not persisted with the model
+func _withRecords(j journal, signature string) (results, error) {
+	if rs, ok := _remembered(j.dbInstance, signature); ok && !rs.recalled {
+		return rs, nil
+	}
+
+	if err := _evaluate(j, signature); err != nil {
+		return results{}, err
+	}
+
+	rs, _ := _remembered(j.dbInstance, signature)
+	return rs, nil
+}
+
+// _toRecords flattens transactions into records and splits the ones with a
+// detailed breakdown of the amount into a record per detail
+func _toRecords(reg expenses.Transactions) collection {
 	var records = make(collection, 0, cap(reg))
 
 	for _, trx := range reg {
@@ -486,12 +1039,71 @@ func _evaluate(j journal, signature string) error {
 		}
 	}
 
-	memory[signature] = results{
-		records:  records,
-		patterns: _compute(records),
+	return records
+}
+
+// _learn is called after transactions are written to the registry and it
+// updates the models already computed for their signatures incrementally
+func _learn(db *gorm.DB, reg expenses.Transactions) {
+	bySignature := make(map[string]expenses.Transactions)
+	for _, trx := range reg {
+		bySignature[trx.Signature] = append(bySignature[trx.Signature], trx)
 	}
 
-	return nil
+	for signature, trxs := range bySignature {
+		if rs, ok := _recall(db, signature); !ok {
+			continue // nothing to update, the first evaluation computes everything
+		} else if rs.recalled {
+			// without records it's unknown what the patterns already learned
+			if err := _evaluate(journal{db, args.batchSize}, signature); err != nil {
+				log.Printf("warning: cannot evaluate journal of %s: %s\n", signature, err)
+			}
+			continue
+		}
+
+		recalled := false
+		rs, ok := memory.Update(_scoped(db, signature), func(rs results) results {
+			if recalled = rs.recalled; recalled {
+				return rs // evicted and recalled in the meantime
+			}
+
+			known := make(map[string]bool, len(rs.records))
+			for _, r := range rs.records {
+				known[r.Parent] = true
+			}
+
+			patterns := make(tendency, len(rs.patterns))
+			for party, features := range rs.patterns {
+				patterns[party] = features
+			}
+
+			records := append(collection(nil), rs.records...)
+			for _, r := range _toRecords(trxs) {
+				if known[r.Parent] {
+					continue // upserted transactions need a full rebuild
+				}
+
+				records = append(records, r)
+				if r.Label != UNNAMED_ENTRY {
+					patterns.Learn(r)
+				}
+			}
+
+			sort.SliceStable(records, func(i, j int) bool {
+				return records[i].Date.After(records[j].Date)
+			})
+
+			return results{records: records, patterns: patterns, computed: time.Now()}
+		})
+
+		if !ok || recalled {
+			continue // evicted in the meantime, evaluated on next use
+		}
+
+		if err := _persist(db, signature, rs); err != nil {
+			log.Printf("warning: cannot persist journal model of %s: %s\n", signature, err)
+		}
+	}
 }
 
 func _fromHeaders(headers string, keyword string) (string, bool) {
@@ -524,10 +1136,34 @@ func _fromTransaction(t expenses.Transaction) record {
 		Date:     t.Date,
 		Amount:   t.Amount,
 		Parent:   *t.UUID,
+		Headers:  t.Headers,
 	}
 }
 
-func _isBetweenAmountDeviation(amounts []int, value int) bool {
+// nameReplacer folds Romanian diacritics, both the comma and the cedilla
+// forms which are used interchangeably by banks
+var nameReplacer = strings.NewReplacer(
+	"ș", "s", "ş", "s", "ț", "t", "ţ", "t",
+	"ă", "a", "â", "a", "î", "i",
+)
+
+// _normalizeName makes actor names comparable regardless of letter case,
+// diacritics and whitespace, e.g. "  Ştefan  CEL Mare" is "stefan cel mare"
+func _normalizeName(name string) string {
+	return strings.Join(strings.Fields(nameReplacer.Replace(strings.ToLower(name))), " ")
+}
+
+// _daysBetween counts calendar days from a to b, negative if b is before a
+func _daysBetween(a, b time.Time) int {
+	a = time.Date(a.Year(), a.Month(), a.Day(), 0, 0, 0, 0, time.UTC)
+	b = time.Date(b.Year(), b.Month(), b.Day(), 0, 0, 0, 0, time.UTC)
+
+	return int(math.Round(b.Sub(a).Hours() / 24))
+}
+
+// _amountDeviationBand is the range around the median of the amounts (value
+// included) as wide as the median relative gap between consecutive amounts
+func _amountDeviationBand(amounts []int, value int) (int, int) {
 	var allAmounts = make([]int, len(amounts))
 	copy(allAmounts, amounts)
 
@@ -569,10 +1205,12 @@ func _isBetweenAmountDeviation(amounts []int, value int) bool {
 	min := amountMedian - dif
 	max := amountMedian + dif
 
-	return int(min) <= value && value <= int(max)
+	return int(min), int(max)
 }
 
-func _isBetweenAmountAprox(amount int, value int) bool {
+// _amountAproxBand is the range between the round values nearest to amount,
+// e.g. 40.00 and 50.00 for 45.99
+func _amountAproxBand(amount int) (int, int) {
 	digits := len(fmt.Sprintf("%d", amount)) - 2 // -2 point decimals
 
 	pow10 := float64(_power(10, digits))
@@ -581,30 +1219,71 @@ func _isBetweenAmountAprox(amount int, value int) bool {
 	min := math.Floor(ratio) * pow10
 	max := math.Ceil(ratio) * pow10
 
-	return int(min) <= value && value <= int(max)
+	return int(min), int(max)
 }
 
 const UNNAMED_ENTRY = "?"
 
+// JOURNAL_COMPUTE_STEP is how many records are computed between checks for
+// cancellation and progress reports
+const JOURNAL_COMPUTE_STEP = 1000
+
 func _compute(records []record) tendency {
+	conclusion, _ := _computeContext(context.Background(), records, func(float64) {})
+	return conclusion
+}
+
+// _computeContext is _compute which stops once ctx is done and reports the
+// fraction of records computed along the way
+func _computeContext(ctx context.Context, records []record, progress func(float64)) (tendency, error) {
 	model := make(routines)
 
 	for i := len(records) - 1; i > 0; i-- {
+		if done := len(records) - i; done%JOURNAL_COMPUTE_STEP == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			progress(float64(done) / float64(len(records)))
+		}
+
 		if record := records[i]; record.Label != UNNAMED_ENTRY {
 			// TODO: refactor the calculate part into something less procedural?
 			_calculate(model, record.Party(), records[i-1].Date.Month(), record)
 		}
 	}
 
+	popularity := func(features []feature) (total int) {
+		for _, f := range features {
+			total += f.Polarity[0] + f.Polarity[1]
+		}
+		return
+	}
+
 	conclusion := make(tendency)
 	for party, categories := range model {
+		names := make([]string, 0, len(categories))
+		for name := range categories {
+			names = append(names, name)
+		}
+
+		// most popular categories come first and the flatten model is the
+		// same on every compute, which matters once it's persisted
+		sort.Slice(names, func(i, j int) bool {
+			a, b := popularity(categories[names[i]]), popularity(categories[names[j]])
+			if a == b {
+				return names[i] < names[j]
+			}
+			return a > b
+		})
+
 		conclusion[party] = make([]feature, 0)
-		for _, features := range categories {
-			conclusion[party] = append(conclusion[party], features...)
+		for _, name := range names {
+			conclusion[party] = append(conclusion[party], categories[name]...)
 		}
 	}
 
-	return conclusion
+	return conclusion, ctx.Err()
 }
 
 func _calculate(model routines, party string, nextMonth time.Month, record record) {
@@ -0,0 +1,284 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	ANOMALY_AMOUNT    = "amount"
+	ANOMALY_NEW_ACTOR = "new_actor"
+	ANOMALY_LABEL     = "label"
+)
+
+const (
+	// ANOMALIES_DAYS is the default period to look for anomalies, up to today
+	ANOMALIES_DAYS = 30
+
+	// ANOMALY_MIN_HISTORY amounts of a party are needed to know what's usual
+	ANOMALY_MIN_HISTORY = 3
+
+	// ANOMALY_AMOUNT_SCORE is the modified z-score (distance from the median
+	// in median absolute deviations) above which an amount is unusual
+	ANOMALY_AMOUNT_SCORE = 3.5
+
+	// ANOMALY_NEW_ACTOR_AMOUNT is the default amount above which a first
+	// payment to an actor is flagged
+	ANOMALY_NEW_ACTOR_AMOUNT = 50000
+
+	// ANOMALY_LABEL_RATIO of spending in a label to its trailing average of
+	// the previous ANOMALY_TRAILING_PERIODS periods is flagged
+	ANOMALY_LABEL_RATIO      = 1.5
+	ANOMALY_TRAILING_PERIODS = 3
+)
+
+type anomaly struct {
+	Kind     string  `json:"kind"`
+	Severity float64 `json:"severity"` // between 0.5 and 1 for anything flagged
+	Reason   string  `json:"reason"`
+	Record   *record `json:"record,omitempty"`
+	Label    string  `json:"label,omitempty"`
+	Amount   int64   `json:"amount"`
+	Usual    int64   `json:"usual"`
+}
+
+// anomalies lists unusual transactions and spending of a signature between
+// ?from and ?to (the last ANOMALIES_DAYS days by default); ?new changes the
+// amount above which first payments to an actor are flagged
+func (j journal) anomalies(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	params := mux.Vars(rq)
+	signature := params["signature"]
+
+	query := rq.URL.Query()
+	to := _day(time.Now())
+	from := to.AddDate(0, 0, -ANOMALIES_DAYS+1)
+
+	for name, value := range map[string]*time.Time{"from": &from, "to": &to} {
+		if text := query.Get(name); text != "" {
+			date, err := time.Parse("2006-01-02", text)
+			if err != nil {
+				response.Wrong(fmt.Errorf("%s must be a date as YYYY-MM-DD, got %q", name, text), rq)
+				return
+			}
+
+			*value = date
+		}
+	}
+
+	if to.Before(from) {
+		response.Wrong(fmt.Errorf("period from %s to %s is empty", from.Format("2006-01-02"), to.Format("2006-01-02")), rq)
+		return
+	}
+
+	newActor := int64(ANOMALY_NEW_ACTOR_AMOUNT)
+	if text := query.Get("new"); text != "" {
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil || n < 0 {
+			response.Wrong(fmt.Errorf("new must be a positive amount, got %q", text), rq)
+			return
+		}
+
+		newActor = n
+	}
+
+	rs, err := _withRecords(j, signature)
+	if err != nil {
+		response.Fault(err, rq)
+		return
+	}
+
+	if output, err := json.Marshal(_detectAnomalies(rs, from, to, newActor)); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
+
+// _detectAnomalies flags records between from and to (both included) with
+// an unusual amount for their party or a large first payment to an actor,
+// and labels with spending well above their trailing average
+func _detectAnomalies(rs results, from, to time.Time, newActor int64) []anomaly {
+	findings := make([]anomaly, 0)
+
+	to = to.AddDate(0, 0, 1) // include the last day
+	within := func(date time.Time) bool {
+		return !date.Before(from) && date.Before(to)
+	}
+
+	seen := make(map[string]time.Time) // first date of every party
+	for _, r := range rs.records {
+		if first, ok := seen[r.Party()]; !ok || r.Date.Before(first) {
+			seen[r.Party()] = r.Date
+		}
+	}
+
+	for i := range rs.records {
+		r := rs.records[i]
+		if !within(r.Date) {
+			continue
+		}
+
+		if finding, ok := _amountAnomaly(rs.patterns, r); ok {
+			findings = append(findings, finding)
+		}
+
+		if r.Amount < 0 && -r.Amount >= newActor && seen[r.Party()].Equal(r.Date) {
+			findings = append(findings, anomaly{
+				Kind:     ANOMALY_NEW_ACTOR,
+				Severity: _severity(float64(-r.Amount), float64(newActor)),
+				Reason:   fmt.Sprintf("first payment to %s is %d", r.Receiver, -r.Amount),
+				Record:   &r,
+				Amount:   -r.Amount,
+			})
+		}
+	}
+
+	findings = append(findings, _labelAnomalies(rs.records, from, to)...)
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Severity > findings[j].Severity
+	})
+
+	return findings
+}
+
+// _amountAnomaly compares the amount of a record with the amounts learned by
+// the features of its party with the same direction
+func _amountAnomaly(patterns tendency, r record) (anomaly, bool) {
+	var amounts []int
+	for _, f := range patterns[r.Party()] {
+		if (r.Amount < 0 && f.Polarity[1] > 0) || (r.Amount > 0 && f.Polarity[0] > 0) {
+			amounts = append(amounts, f.Amounts...)
+		}
+	}
+
+	if len(amounts) < ANOMALY_MIN_HISTORY {
+		return anomaly{}, false
+	}
+
+	absValue := math.Abs(float64(r.Amount))
+
+	median := _median(amounts)
+	deviations := make([]int, len(amounts))
+	for i, amount := range amounts {
+		deviations[i] = int(math.Abs(float64(amount) - median))
+	}
+
+	// scaled like a standard deviation but never zero for constant amounts
+	spread := math.Max(1.4826*_median(deviations), math.Max(median*0.01, 1))
+	score := math.Abs(absValue-median) / spread
+
+	if score < ANOMALY_AMOUNT_SCORE {
+		return anomaly{}, false
+	}
+
+	return anomaly{
+		Kind:     ANOMALY_AMOUNT,
+		Severity: _severity(score, ANOMALY_AMOUNT_SCORE),
+		Reason:   fmt.Sprintf("amount %d is far from the usual %d of %s", int64(absValue), int64(median), r.Party()),
+		Record:   &r,
+		Amount:   int64(absValue),
+		Usual:    int64(median),
+	}, true
+}
+
+// _labelAnomalies compares spending per label in the period from-to with the
+// average of the same label in the periods of equal length before it
+func _labelAnomalies(records collection, from, to time.Time) []anomaly {
+	length := to.Sub(from)
+	trailingFrom := from.Add(-length * ANOMALY_TRAILING_PERIODS)
+
+	current := make(map[string]int64)
+	trailing := make(map[string]int64)
+	for _, r := range records {
+		if r.Amount >= 0 || r.Label == UNNAMED_ENTRY {
+			continue // only spending is compared
+		}
+
+		if !r.Date.Before(from) && r.Date.Before(to) {
+			current[r.Label] -= r.Amount
+		} else if !r.Date.Before(trailingFrom) && r.Date.Before(from) {
+			trailing[r.Label] -= r.Amount
+		}
+	}
+
+	var labels []string
+	for label := range current {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	var findings []anomaly
+	for _, label := range labels {
+		average := float64(trailing[label]) / ANOMALY_TRAILING_PERIODS
+		if average == 0 {
+			continue // nothing to compare with
+		}
+
+		if ratio := float64(current[label]) / average; ratio >= ANOMALY_LABEL_RATIO {
+			findings = append(findings, anomaly{
+				Kind:     ANOMALY_LABEL,
+				Severity: _severity(ratio, ANOMALY_LABEL_RATIO),
+				Reason:   fmt.Sprintf("spending in %s is %.1f times the average of the previous %d periods", label, ratio, ANOMALY_TRAILING_PERIODS),
+				Label:    label,
+				Amount:   current[label],
+				Usual:    int64(average),
+			})
+		}
+	}
+
+	return findings
+}
+
+// _severity grows from 0.5 at the limit towards 1 for values far beyond it
+func _severity(value, limit float64) float64 {
+	return math.Round(value/(value+limit)*1000) / 1000
+}
+
+func _median(ns []int) float64 {
+	sorted := append([]int(nil), ns...)
+	sort.Ints(sorted)
+
+	if len(sorted)%2 == 1 {
+		return float64(sorted[len(sorted)/2])
+	}
+
+	return float64(sorted[len(sorted)/2-1]+sorted[len(sorted)/2]) / 2
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDetectAnomalies(t *testing.T) {
+	date := func(m time.Month, d int) time.Time {
+		return time.Date(2021, m, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	var records collection
+	for m := time.January; m <= time.June; m++ {
+		amount := int64(-4000)
+		if m == time.June {
+			amount = -25000 // unusual
+		}
+
+		records = append(records, record{Sender: "Me", Receiver: "Netflix", Label: "Abonamente", Date: date(m, 5), Amount: amount})
+		records = append(records, record{Sender: "Me", Receiver: "Kaufland", Label: "Mâncare", Date: date(m, 12), Amount: -20000 - int64(m)*100})
+	}
+
+	records = append(records, record{Sender: "Me", Receiver: "Kaufland", Label: "Mâncare", Date: date(time.June, 20), Amount: -45000})
+	records = append(records, record{Sender: "Me", Receiver: "Dealer", Label: "Mașină", Date: date(time.June, 10), Amount: -120000})
+	records = append(records, record{Sender: "Me", Receiver: "Brutărie", Label: "Mâncare", Date: date(time.June, 11), Amount: -1000})
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Date.After(records[j].Date)
+	})
+
+	rs := results{records: records, patterns: _compute(records)}
+
+	findings := _detectAnomalies(rs, date(time.June, 1), date(time.June, 30), ANOMALY_NEW_ACTOR_AMOUNT)
+
+	kinds := make(map[string][]anomaly)
+	for _, finding := range findings {
+		kinds[finding.Kind] = append(kinds[finding.Kind], finding)
+
+		if finding.Severity < 0.5 || finding.Severity > 1 || finding.Reason == "" {
+			t.Fatalf("Expected severity and reason of every finding but got %+v", finding)
+		}
+	}
+
+	amounts := kinds[ANOMALY_AMOUNT]
+	if len(amounts) != 2 || amounts[0].Record.Receiver != "Netflix" || amounts[0].Usual != 4000 {
+		t.Fatalf("Expected Netflix amount to be the most unusual but got %+v", amounts)
+	}
+
+	if amounts[1].Record.Receiver != "Kaufland" || amounts[1].Amount != 45000 {
+		t.Fatalf("Expected the large grocery bill to be unusual but got %+v", amounts[1])
+	}
+
+	if actors := kinds[ANOMALY_NEW_ACTOR]; len(actors) != 1 || actors[0].Record.Receiver != "Dealer" {
+		t.Fatalf("Expected a large first payment to be flagged, not small ones, but got %+v", actors)
+	}
+
+	labels := make(map[string]bool)
+	for _, finding := range kinds[ANOMALY_LABEL] {
+		labels[finding.Label] = true
+	}
+
+	if len(labels) != 2 || !labels["Abonamente"] || !labels["Mâncare"] {
+		t.Fatalf("Expected spending spikes of two labels without history of new ones but got %+v", kinds[ANOMALY_LABEL])
+	}
+
+	for i := 1; i < len(findings); i++ {
+		if findings[i-1].Severity < findings[i].Severity {
+			t.Fatal("Expected findings sorted by severity")
+		}
+	}
+
+	if none := _detectAnomalies(rs, date(time.April, 1), date(time.April, 30), ANOMALY_NEW_ACTOR_AMOUNT); len(none) != 0 {
+		t.Fatalf("Expected nothing unusual in April but got %+v", none)
+	}
+}
+
+func TestAnomaliesEndpoint(t *testing.T) {
+	for query, status := range map[string]int{
+		"?from=2020-02-01&to=2020-02-29": http.StatusOK,
+		"?from=2020-02-29&to=2020-02-01": http.StatusBadRequest,
+		"?from=yesterday":                http.StatusBadRequest,
+		"?new=-1":                        http.StatusBadRequest,
+	} {
+		buf := httptest.NewRecorder()
+		journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("GET", "/journal/test-signature/anomalies"+query, nil))
+
+		if reply := buf.Result(); reply.StatusCode != status {
+			t.Fatalf("Expected %d for %s but got %v", status, query, reply.StatusCode)
+		}
+	}
+}
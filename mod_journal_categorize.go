@@ -0,0 +1,308 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lexndru/expenses"
+)
+
+// default confidence thresholds for categorization: suggestions scoring at
+// least CATEGORIZE_ACCEPT are written to the registry, the ones between the
+// two thresholds are returned for review and the rest are left unmatched
+const (
+	CATEGORIZE_ACCEPT = 0.75
+	CATEGORIZE_REVIEW = 0.25
+)
+
+type suggestion struct {
+	Label      string   `json:"label"`
+	Confidence float64  `json:"confidence"`
+	Points     pointbus `json:"points"`
+
+	Explained []explanation `json:"explained"`
+}
+
+type categorized struct {
+	record
+
+	Suggestions []suggestion `json:"suggestions"`
+}
+
+type categorization struct {
+	Accepted  []categorized `json:"accepted"`
+	Review    []categorized `json:"review"`
+	Unmatched []categorized `json:"unmatched"`
+	Skipped   int           `json:"skipped"`
+}
+
+func (j journal) categorize(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	params := mux.Vars(rq)
+	signature := params["signature"]
+
+	accept, review, err := _categorizeThresholds(rq)
+	if err != nil {
+		response.Wrong(err, rq)
+		return
+	}
+
+	payload, err := ioutil.ReadAll(rq.Body)
+	if err != nil { // TODO: avoid ioutil because of memory issues?
+		response.Wrong(err, rq)
+		return
+	}
+
+	var records collection
+	if err := json.Unmarshal(payload, &records); err != nil {
+		response.Wrong(err, rq)
+		return
+	}
+
+	out := categorization{
+		Accepted:  make([]categorized, 0),
+		Review:    make([]categorized, 0),
+		Unmatched: make([]categorized, 0),
+	}
+
+	var pending collection
+	for _, record := range records {
+		if record.Label == "" || record.Label == UNNAMED_ENTRY {
+			pending = append(pending, record)
+		} else {
+			out.Skipped++ // already categorized by the client
+		}
+	}
+
+	if len(pending) > 0 {
+		sort.Slice(pending, func(i, j int) bool {
+			return pending[i].Date.After(pending[j].Date)
+		})
+
+		reg, err := _pullAround(j, signature, pending)
+		if err != nil {
+			response.Fault(err, rq)
+			return
+		}
+
+		_prepare(j, signature)
+
+		var keys []string
+		for _, record := range pending {
+			if _, err := uuid.Parse(record.Parent); err == nil {
+				keys = append(keys, record.Parent)
+			}
+		}
+
+		// parents are written by key, so stored ones are relabeled with care
+		stored, err := _transactionsByUUID(j.dbInstance.Preload("Details"), keys, j.dbBatchSize)
+		if err != nil {
+			response.Fault(err, rq)
+			return
+		}
+
+		var writes expenses.Transactions
+		for _, st := range _research(j.dbInstance, reg, pending, signature) {
+			item := categorized{record: st.record, Suggestions: _suggest(st)}
+
+			if len(item.Suggestions) == 0 || item.Suggestions[0].Confidence < review {
+				out.Unmatched = append(out.Unmatched, item)
+				continue
+			}
+
+			if item.Suggestions[0].Confidence < accept {
+				out.Review = append(out.Review, item)
+				continue
+			}
+
+			trx, ok := _categorizedTransaction(st, item.Suggestions[0].Label, signature, stored)
+			if !ok {
+				out.Review = append(out.Review, item) // ambiguous registry match
+				continue
+			}
+
+			item.Label = trx.LabelName
+			item.Parent = *trx.UUID
+			writes = append(writes, trx)
+			out.Accepted = append(out.Accepted, item)
+		}
+
+		if len(writes) > 0 {
+			ctx := expenses.PushContext{Storage: j.dbInstance, BatchSize: j.dbBatchSize}
+			if err := writes.Push(ctx); err != nil {
+				response.Fault(err, rq)
+				return
+			}
+
+			importedTransactions.Add(float64(len(writes)), "categorize")
+			for _, hook := range registryHooks {
+				hook(j.dbInstance, writes)
+			}
+
+			_cacheReset()
+		}
+	}
+
+	if output, err := json.Marshal(out); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
+
+func _categorizeThresholds(rq *http.Request) (accept, review float64, err error) {
+	accept, review = CATEGORIZE_ACCEPT, CATEGORIZE_REVIEW
+	query := rq.URL.Query()
+
+	if value := query.Get("accept"); value != "" {
+		if accept, err = strconv.ParseFloat(value, 64); err != nil {
+			return
+		}
+	}
+
+	if value := query.Get("review"); value != "" {
+		if review, err = strconv.ParseFloat(value, 64); err != nil {
+			return
+		}
+	}
+
+	if review < 0 || accept > 1 || review > accept {
+		err = errors.New("thresholds must satisfy 0 <= review <= accept <= 1")
+	}
+
+	return
+}
+
+// _suggest turns the predictions of a statement into suggestions sorted by
+// confidence; the popularity slot of the calculated points breaks ties
+func _suggest(st statement) []suggestion {
+	var suggestions = make([]suggestion, 0, len(st.Predicted))
+
+	for label, confidence := range st.Predicted {
+		if label == "" || label == UNNAMED_ENTRY {
+			continue
+		}
+
+		suggestions = append(suggestions, suggestion{
+			Label:      label,
+			Confidence: math.Round(confidence*1000) / 1000,
+			Points:     st.Calculated[label],
+			Explained:  st.Explained[label],
+		})
+	}
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Confidence != suggestions[j].Confidence {
+			return suggestions[i].Confidence > suggestions[j].Confidence
+		}
+
+		if suggestions[i].Points[5] != suggestions[j].Points[5] {
+			return suggestions[i].Points[5] > suggestions[j].Points[5]
+		}
+
+		return suggestions[i].Label < suggestions[j].Label
+	})
+
+	return suggestions
+}
+
+// _categorizedTransaction builds the registry transaction for an accepted
+// suggestion: an existing transaction between the same parties, or the one
+// stored with the key of the parent, is relabeled, otherwise a new one is
+// created; it's not safe to relabel transactions which already have a label
+// or details, which belong to another signature, or when more than one
+// transaction matches
+func _categorizedTransaction(st statement, label, signature string, stored map[string]expenses.Transaction) (expenses.Transaction, bool) {
+	var matches []expenses.Transaction
+	for _, sim := range st.Similarity {
+		if sim.Grade&3 == 3 { // same sender and same receiver
+			matches = append(matches, sim.Parent)
+		}
+	}
+
+	if len(matches) > 1 {
+		return expenses.Transaction{}, false
+	}
+
+	if len(matches) == 1 {
+		return _relabeled(matches[0], label)
+	}
+
+	key := st.Parent
+	if _, err := uuid.Parse(key); err != nil {
+		// deterministic so the same record categorized twice is written once
+		name := fmt.Sprintf("signature=%s %s", signature, st.record.Party())
+		name = fmt.Sprintf("%s date=%s amount=%d", name, st.Date.Format("2006-01-02"), st.Amount)
+		key = uuid.NewSHA1(uuid.NameSpaceOID, []byte(name)).String()
+	} else if trx, ok := stored[key]; ok {
+		if trx.Signature != signature {
+			return expenses.Transaction{}, false
+		}
+
+		return _relabeled(trx, label)
+	}
+
+	trx := expenses.Transaction{
+		UUID:         &key,
+		Date:         st.Date,
+		Amount:       st.Amount,
+		LabelName:    label,
+		SenderName:   st.Sender,
+		ReceiverName: st.Receiver,
+		Signature:    signature,
+	}
+
+	return trx, true
+}
+
+// _relabeled labels an existing transaction unless it's already categorized
+func _relabeled(trx expenses.Transaction, label string) (expenses.Transaction, bool) {
+	if trx.LabelName == label {
+		return trx, true // already categorized, e.g. the same request twice
+	}
+
+	if len(trx.Details) > 0 || (trx.LabelName != "" && trx.LabelName != UNNAMED_ENTRY) {
+		return expenses.Transaction{}, false
+	}
+
+	trx.LabelName = label
+	return trx, true
+}
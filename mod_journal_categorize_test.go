@@ -0,0 +1,174 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lexndru/expenses"
+)
+
+func TestCategorizeRecords(t *testing.T) {
+	buf := httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/registry/transactions", strings.NewReader(`[
+		{"date":"2021-01-05T00:00:00Z","amount":-4000,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"categorize-signature"},
+		{"date":"2021-02-05T00:00:00Z","amount":-4000,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"categorize-signature"},
+		{"date":"2021-03-05T00:00:00Z","amount":-4000,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"categorize-signature"},
+		{"date":"2021-04-05T00:00:00Z","amount":-4000,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"categorize-signature"},
+		{"date":"2021-02-14T00:00:00Z","amount":-25000,"label":"Cadouri","sender":"Me","receiver":"Florărie","signature":"categorize-signature"},
+		{"date":"2021-03-08T00:00:00Z","amount":-9000,"label":"Cadouri","sender":"Me","receiver":"Florărie","signature":"categorize-signature"},
+		{"date":"2021-03-20T00:00:00Z","amount":-3000,"label":"Casă","sender":"Me","receiver":"Florărie","signature":"categorize-signature"}
+	]`)))
+
+	if reply := buf.Result(); reply.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 OK after POST but got %v", reply.StatusCode)
+	}
+
+	journalHttpRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("HEAD", "/journal/categorize-signature", nil))
+
+	payload := `[
+		{"sender":"Me","receiver":"Netflix","amount":-4000,"date":"2021-05-05T00:00:00Z","parent":"row-1"},
+		{"sender":"Me","receiver":"Florărie","amount":-5000,"date":"2021-05-20T00:00:00Z","parent":"row-2"},
+		{"sender":"Me","receiver":"Unknown","amount":-100,"date":"2021-05-21T00:00:00Z","parent":"row-3"},
+		{"sender":"Me","receiver":"Netflix","amount":-4000,"date":"2021-05-05T00:00:00Z","label":"Abonamente","parent":"row-4"}
+	]`
+
+	categorize := func(query string) (out categorization) {
+		buf := httptest.NewRecorder()
+		journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/journal/categorize-signature/categorize"+query, strings.NewReader(payload)))
+
+		if reply := buf.Result(); reply.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 OK after categorize but got %v", reply.StatusCode)
+		}
+
+		body, _ := io.ReadAll(buf.Result().Body)
+		if err := json.Unmarshal(body, &out); err != nil {
+			t.Fatal(err)
+		}
+
+		return
+	}
+
+	out := categorize("")
+	if len(out.Accepted) != 1 || len(out.Review) != 1 || len(out.Unmatched) != 1 || out.Skipped != 1 {
+		t.Fatalf("Expected 1 accepted, 1 review, 1 unmatched and 1 skipped but got %+v", out)
+	}
+
+	if accepted := out.Accepted[0]; accepted.Label != "Abonamente" || accepted.Suggestions[0].Confidence != 1 {
+		t.Fatalf("Expected Netflix to be accepted as Abonamente but got %+v", accepted)
+	}
+
+	if review := out.Review[0]; review.Suggestions[0].Label != "Cadouri" || review.Suggestions[0].Confidence != 0.25 {
+		t.Fatalf("Expected tie to be broken by popularity but got %+v", review.Suggestions)
+	}
+
+	var written expenses.Transaction
+	if err := journalModule.dbInstance.First(&written, "uuid = ?", out.Accepted[0].Parent).Error; err != nil {
+		t.Fatalf("Expected accepted record to be written: %s", err)
+	}
+
+	if written.LabelName != "Abonamente" || written.Signature != "categorize-signature" {
+		t.Fatalf("Expected written transaction with label and signature but got %+v", written)
+	}
+
+	// the same request again must not write duplicates
+	if again := categorize(""); len(again.Accepted) != 1 || again.Accepted[0].Parent != *written.UUID {
+		t.Fatalf("Expected the existing transaction to be matched but got %+v", again.Accepted)
+	}
+
+	var count int64
+	journalModule.dbInstance.Model(&expenses.Transaction{}).Where("signature = ? and receiver_name = ?", "categorize-signature", "Netflix").Count(&count)
+	if count != 5 {
+		t.Fatalf("Expected 5 Netflix transactions but got %d", count)
+	}
+
+	if out := categorize("?accept=0.2&review=0.1"); len(out.Accepted) != 2 || len(out.Review) != 0 {
+		t.Fatalf("Expected lower thresholds to accept more but got %+v", out)
+	}
+
+	// a parent of another signature must not be overwritten
+	foreign := "00000000-0000-4000-8000-000000000031"
+	journalHttpRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/registry/transactions", strings.NewReader(`[
+		{"uuid":"`+foreign+`","date":"2020-01-05T00:00:00Z","amount":-100,"label":"","sender":"Kid","receiver":"Shop","signature":"foreign-signature"}
+	]`)))
+
+	payload = `[{"sender":"Me","receiver":"Netflix","amount":-4000,"date":"2023-01-05T00:00:00Z","parent":"` + foreign + `"}]`
+	if out := categorize(""); len(out.Accepted) != 0 || len(out.Review) != 1 {
+		t.Fatalf("Expected a foreign parent to be left for review but got %+v", out)
+	}
+
+	var untouched expenses.Transaction
+	if err := journalModule.dbInstance.First(&untouched, "uuid = ?", foreign).Error; err != nil {
+		t.Fatal(err)
+	} else if untouched.Signature != "foreign-signature" || untouched.SenderName != "Kid" {
+		t.Fatalf("Expected transaction of another signature untouched but got %+v", untouched)
+	}
+
+	// a stored parent which doesn't match the record is only relabeled if it's
+	// not categorized yet, and keeps everything else it was stored with
+	labeled, unlabeled := "00000000-0000-4000-8000-000000000032", "00000000-0000-4000-8000-000000000132"
+	for _, parent := range []expenses.Transaction{
+		{UUID: &labeled, Date: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), Amount: -700, LabelName: "Casă", SenderName: "Me", ReceiverName: "Kiosk", Signature: "categorize-signature", Flags: 4, Headers: "row=1"},
+		{UUID: &unlabeled, Date: time.Date(2020, 6, 2, 0, 0, 0, 0, time.UTC), Amount: -800, LabelName: UNNAMED_ENTRY, SenderName: "Me", ReceiverName: "Kiosk", Signature: "categorize-signature", Flags: 4, Headers: "row=2"},
+	} {
+		if err := journalModule.dbInstance.Create(&parent).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	payload = `[{"sender":"Me","receiver":"Netflix","amount":-4000,"date":"2023-02-05T00:00:00Z","parent":"` + labeled + `"}]`
+	if out := categorize(""); len(out.Accepted) != 0 || len(out.Review) != 1 {
+		t.Fatalf("Expected a labeled parent to be left for review but got %+v", out)
+	}
+
+	payload = `[{"sender":"Me","receiver":"Netflix","amount":-4000,"date":"2023-03-05T00:00:00Z","parent":"` + unlabeled + `"}]`
+	if out := categorize(""); len(out.Accepted) != 1 || out.Accepted[0].Parent != unlabeled {
+		t.Fatalf("Expected an unlabeled parent to be relabeled but got %+v", out)
+	}
+
+	for key, expected := range map[string]string{labeled: "Casă", unlabeled: "Abonamente"} {
+		var parent expenses.Transaction
+		if err := journalModule.dbInstance.First(&parent, "uuid = ?", key).Error; err != nil {
+			t.Fatal(err)
+		} else if parent.LabelName != expected || parent.ReceiverName != "Kiosk" || parent.Flags != 4 || parent.Headers == "" {
+			t.Fatalf("Expected stored parent labeled %s with its flags and headers but got %+v", expected, parent)
+		}
+	}
+
+	buf = httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/journal/categorize-signature/categorize?accept=0.1&review=0.5", strings.NewReader(payload)))
+	if reply := buf.Result(); reply.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 Bad Request for inverted thresholds but got %v", reply.StatusCode)
+	}
+}
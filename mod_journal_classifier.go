@@ -0,0 +1,440 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Classifier predicts the labels of records after learning from labeled ones;
+// predictions are scores between 0 and 1 per label, the higher the better
+type Classifier interface {
+	Train(records collection)
+	Predict(r record) map[string]float64
+}
+
+const (
+	CLASSIFIER_HEURISTIC = "heuristic"
+	CLASSIFIER_BAYES     = "bayes"
+)
+
+// classifiers builds every available classifier from the results of a journal
+// evaluation; empty results give an untrained classifier
+var classifiers = map[string]func(rs results) Classifier{
+	CLASSIFIER_HEURISTIC: func(rs results) Classifier {
+		return &heuristic{patterns: rs.patterns} // already computed on evaluation
+	},
+	CLASSIFIER_BAYES: func(rs results) Classifier {
+		c := &bayes{}
+		c.Train(rs.records)
+		return c
+	},
+}
+
+// HEURISTIC_FULL_STRENGTH is the number of matched feature points (slots 0
+// to 4 of a pointbus) at which a label is considered a perfect fit, e.g. the
+// amount and the day of month; matched months and weekdays are a bonus
+const HEURISTIC_FULL_STRENGTH = 2
+
+// heuristic is the original journal classifier based on the recurrence of
+// amounts, months, weekdays and days of the month (see tendency)
+type heuristic struct {
+	patterns tendency
+}
+
+func (h *heuristic) Train(records collection) {
+	sorted := append(collection(nil), records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Date.After(sorted[j].Date)
+	})
+
+	h.patterns = _compute(sorted)
+}
+
+// Predict scores a label by how well it fits on its own (matched points out
+// of HEURISTIC_FULL_STRENGTH) weighted by its share among all labels
+func (h *heuristic) Predict(r record) map[string]float64 {
+	var strengths float64
+
+	score := h.patterns.Points(r)
+	for _, points := range score {
+		strengths += float64(_total(points[:5]...))
+	}
+
+	predicted := make(map[string]float64, len(score))
+	for label, points := range score {
+		strength := float64(_total(points[:5]...))
+		fit := math.Min(1, strength/HEURISTIC_FULL_STRENGTH)
+		predicted[label] = fit * strength / strengths
+	}
+
+	return predicted
+}
+
+// BAYES_MIN_PROBABILITY hides labels too unlikely to be worth suggesting
+const BAYES_MIN_PROBABILITY = 0.001
+
+// bayes is a multinomial naive Bayes classifier over the tokens of a record:
+// actor names, headers and the order of magnitude of the amount
+type bayes struct {
+	documents  int
+	labels     map[string]int            // documents per label
+	tokens     map[string]map[string]int // token occurrences per label
+	totals     map[string]int            // all tokens per label
+	vocabulary map[string]bool
+}
+
+func (b *bayes) Train(records collection) {
+	b.documents = 0
+	b.labels = make(map[string]int)
+	b.tokens = make(map[string]map[string]int)
+	b.totals = make(map[string]int)
+	b.vocabulary = make(map[string]bool)
+
+	for _, r := range records {
+		if r.Label == "" || r.Label == UNNAMED_ENTRY {
+			continue
+		}
+
+		if _, ok := b.tokens[r.Label]; !ok {
+			b.tokens[r.Label] = make(map[string]int)
+		}
+
+		for _, token := range _tokenize(r) {
+			b.tokens[r.Label][token]++
+			b.totals[r.Label]++
+			b.vocabulary[token] = true
+		}
+
+		b.labels[r.Label]++
+		b.documents++
+	}
+}
+
+func (b *bayes) Predict(r record) map[string]float64 {
+	predicted := make(map[string]float64)
+	if b.documents == 0 {
+		return predicted
+	}
+
+	tokens := _tokenize(r)
+	vocabulary := float64(len(b.vocabulary))
+
+	// log probabilities with Laplace smoothing, normalized with softmax
+	logs := make(map[string]float64, len(b.labels))
+	best := math.Inf(-1)
+	for label, documents := range b.labels {
+		value := math.Log(float64(documents) / float64(b.documents))
+		for _, token := range tokens {
+			value += math.Log(float64(b.tokens[label][token]+1) / (float64(b.totals[label]) + vocabulary))
+		}
+
+		logs[label] = value
+		best = math.Max(best, value)
+	}
+
+	var sum float64
+	for label, value := range logs {
+		logs[label] = math.Exp(value - best)
+		sum += logs[label]
+	}
+
+	for label, value := range logs {
+		if probability := value / sum; probability >= BAYES_MIN_PROBABILITY {
+			predicted[label] = probability
+		}
+	}
+
+	return predicted
+}
+
+func _tokenize(r record) []string {
+	tokens := []string{
+		"sender:" + strings.ToLower(r.Sender),
+		"receiver:" + strings.ToLower(r.Receiver),
+		"amount:" + _amountBucket(r.Amount),
+	}
+
+	for _, field := range strings.Fields(strings.ToLower(r.Headers)) {
+		tokens = append(tokens, "header:"+field)
+	}
+
+	return tokens
+}
+
+// _amountBucket groups amounts by sign and half orders of magnitude, so
+// 40.00 and 45.00 are alike but 40.00 and 400.00 are not
+func _amountBucket(amount int64) string {
+	if amount == 0 {
+		return "zero"
+	}
+
+	sign := "in"
+	if amount < 0 {
+		sign, amount = "out", -amount
+	}
+
+	return fmt.Sprintf("%s%d", sign, int(math.Log10(float64(amount))*2))
+}
+
+// journalSetting keeps per signature preferences of the journal
+type journalSetting struct {
+	Signature  string `json:"signature" gorm:"type: varchar(36); primaryKey"`
+	Classifier string `json:"classifier" gorm:"not null"`
+}
+
+type trainedClassifier struct {
+	name       string
+	computed   time.Time
+	records    int
+	classifier Classifier
+}
+
+var (
+	classifierMemory = make(map[scoped]trainedClassifier)
+	classifierLock   sync.RWMutex
+)
+
+func _classifierOf(db *gorm.DB, signature string) (Classifier, bool) {
+	classifierLock.RLock()
+	defer classifierLock.RUnlock()
+
+	trained, ok := classifierMemory[_scoped(db, signature)]
+	return trained.classifier, ok
+}
+
+// _recallClassifier (re)trains the selected classifier of a signature when
+// there's none yet or when the results of the journal changed since
+func _recallClassifier(j journal, signature string) {
+	classifierLock.RLock()
+	trained, ok := classifierMemory[_scoped(j.dbInstance, signature)]
+	classifierLock.RUnlock()
+
+	if !ok {
+		var setting journalSetting
+		if err := j.dbInstance.Where("signature = ?", signature).Limit(1).Find(&setting).Error; err != nil {
+			log.Printf("warning: cannot load journal settings of %s: %s\n", signature, err)
+		}
+
+		trained.name = CLASSIFIER_HEURISTIC
+		if _, ok := classifiers[setting.Classifier]; ok {
+			trained.name = setting.Classifier
+		}
+	}
+
+	rs, ok := _remembered(j.dbInstance, signature)
+	if !ok {
+		return // nothing to learn from
+	}
+
+	if trained.name != CLASSIFIER_HEURISTIC {
+		var err error
+		if rs, err = _withRecords(j, signature); err != nil {
+			log.Printf("warning: cannot evaluate %s for classifier: %s\n", signature, err)
+			return
+		}
+	}
+
+	if trained.classifier != nil && trained.computed.Equal(rs.computed) && trained.records == len(rs.records) {
+		return // still current
+	}
+
+	trained.computed = rs.computed
+	trained.records = len(rs.records)
+	trained.classifier = classifiers[trained.name](rs)
+
+	classifierLock.Lock()
+	defer classifierLock.Unlock()
+
+	if _, ok := _remembered(j.dbInstance, signature); ok { // unless evicted meanwhile
+		classifierMemory[_scoped(j.dbInstance, signature)] = trained
+	}
+}
+
+func _forgetClassifier(db *gorm.DB, signature string) {
+	_dropClassifier(_scoped(db, signature))
+}
+
+func _dropClassifier(key scoped) {
+	classifierLock.Lock()
+	defer classifierLock.Unlock()
+
+	delete(classifierMemory, key)
+}
+
+// _prepare loads everything needed by _research for a signature: the model
+// (from storage after a restart), the feedback and the selected classifier
+func _prepare(j journal, signature string) {
+	_recall(j.dbInstance, signature)
+	_recallFeedback(j.dbInstance, signature)
+	_recallClassifier(j, signature)
+}
+
+func (j journal) readClassifier(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	params := mux.Vars(rq)
+	setting := journalSetting{Signature: params["signature"]}
+
+	if err := j.dbInstance.Where("signature = ?", setting.Signature).Limit(1).Find(&setting).Error; err != nil {
+		response.Fault(err, rq)
+		return
+	}
+
+	if _, ok := classifiers[setting.Classifier]; !ok {
+		setting.Classifier = CLASSIFIER_HEURISTIC
+	}
+
+	_resolveClassifierSetting(setting, startTime, response, rq)
+}
+
+func (j journal) writeClassifier(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	params := mux.Vars(rq)
+
+	payload, err := ioutil.ReadAll(rq.Body)
+	if err != nil { // TODO: avoid ioutil because of memory issues?
+		response.Wrong(err, rq)
+		return
+	}
+
+	var setting journalSetting
+	if err := json.Unmarshal(payload, &setting); err != nil {
+		response.Wrong(err, rq)
+		return
+	}
+
+	if _, ok := classifiers[setting.Classifier]; !ok {
+		response.Wrong(fmt.Errorf("unknown classifier %q", setting.Classifier), rq)
+		return
+	}
+
+	setting.Signature = params["signature"]
+	if err := j.dbInstance.Clauses(clause.OnConflict{UpdateAll: true}).Create(&setting).Error; err != nil {
+		response.Fault(err, rq)
+		return
+	}
+
+	_forgetClassifier(j.dbInstance, setting.Signature) // retrained on next use
+	_resolveClassifierSetting(setting, startTime, response, rq)
+}
+
+func _resolveClassifierSetting(setting journalSetting, startTime time.Time, response Response, rq *http.Request) {
+	available := make([]string, 0, len(classifiers))
+	for name := range classifiers {
+		available = append(available, name)
+	}
+	sort.Strings(available)
+
+	out := struct {
+		journalSetting
+		Available []string `json:"available"`
+	}{setting, available}
+
+	if output, err := json.Marshal(out); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
+
+// _holdout splits records by time: the newest fraction is held out to test
+// a classifier trained on the rest, like it would predict future records
+func _holdout(records collection, fraction float64) (train, test collection) {
+	sorted := append(collection(nil), records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Date.After(sorted[j].Date)
+	})
+
+	split := int(math.Round(float64(len(sorted)) * fraction))
+	return sorted[split:], sorted[:split]
+}
+
+// _accuracy is the share of labeled records for which the top prediction of
+// a classifier is the actual label
+func _accuracy(c Classifier, test collection) float64 {
+	return _assess(c, test).Top1
+}
+
+// _ranked returns the predicted labels from the best to the worst score
+func _ranked(predicted map[string]float64) []string {
+	labels := make([]string, 0, len(predicted))
+	for label := range predicted {
+		labels = append(labels, label)
+	}
+
+	sort.Slice(labels, func(i, j int) bool {
+		a, b := predicted[labels[i]], predicted[labels[j]]
+		if a == b {
+			return labels[i] < labels[j]
+		}
+		return a > b
+	})
+
+	return labels
+}
+
+func _topPrediction(predicted map[string]float64) (string, float64) {
+	if ranked := _ranked(predicted); len(ranked) > 0 {
+		return ranked[0], predicted[ranked[0]]
+	}
+
+	return "", 0
+}
+
+// _benchmark trains every available classifier on the same records and
+// reports their accuracy on the held out ones
+func _benchmark(records collection, fraction float64) map[string]float64 {
+	train, test := _holdout(records, fraction)
+
+	out := make(map[string]float64, len(classifiers))
+	for name, build := range classifiers {
+		c := build(results{})
+		c.Train(train)
+		out[name] = _accuracy(c, test)
+	}
+
+	return out
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// classifierRecords generates a year of household records where groceries
+// vary in amount and day, utilities are monthly and the same shop sells
+// both electronics and gifts which are told apart only by headers
+func classifierRecords() collection {
+	random := rand.New(rand.NewSource(42))
+	start := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	var records collection
+	for day := 0; day < 365; day++ {
+		date := start.AddDate(0, 0, day)
+
+		if date.Weekday() == time.Saturday {
+			records = append(records, record{Sender: "Me", Receiver: "Kaufland", Label: "Mâncare", Date: date, Amount: -int64(5000 + random.Intn(25000)), Headers: "mcc=5411"})
+		}
+
+		if date.Day() == 15 {
+			records = append(records, record{Sender: "Me", Receiver: "Enel", Label: "Utilități", Date: date, Amount: -int64(18000 + random.Intn(4000)), Headers: "mcc=4900"})
+		}
+
+		if date.Day() == 10 {
+			records = append(records, record{Sender: "Employer", Receiver: "Me", Label: "Salariu", Date: date, Amount: 800000, Headers: "sepa"})
+		}
+
+		if day%9 == 0 {
+			if random.Intn(2) == 0 {
+				records = append(records, record{Sender: "Me", Receiver: "eMAG", Label: "Electronice", Date: date, Amount: -int64(10000 + random.Intn(90000)), Headers: "mcc=5732"})
+			} else {
+				records = append(records, record{Sender: "Me", Receiver: "eMAG", Label: "Cadouri", Date: date, Amount: -int64(10000 + random.Intn(90000)), Headers: "mcc=5945"})
+			}
+		}
+	}
+
+	return records
+}
+
+func TestClassifiersOnHeldOutRecords(t *testing.T) {
+	accuracy := _benchmark(classifierRecords(), 0.2)
+
+	if len(accuracy) != len(classifiers) {
+		t.Fatalf("Expected accuracy of every classifier but got %v", accuracy)
+	}
+
+	if accuracy[CLASSIFIER_BAYES] < 0.95 {
+		t.Fatalf("Expected naive Bayes to tell labels apart by headers but got %v", accuracy)
+	}
+
+	if accuracy[CLASSIFIER_HEURISTIC] <= 0 {
+		t.Fatalf("Expected heuristic to predict some labels but got %v", accuracy)
+	}
+}
+
+func TestSelectClassifierPerSignature(t *testing.T) {
+	put := func(payload string) *http.Response {
+		buf := httptest.NewRecorder()
+		journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("PUT", "/journal/classify-signature/classifier", strings.NewReader(payload)))
+		return buf.Result()
+	}
+
+	if reply := put(`{"classifier":"oracle"}`); reply.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 Bad Request for unknown classifier but got %v", reply.StatusCode)
+	}
+
+	if reply := put(`{"classifier":"bayes"}`); reply.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 OK after PUT but got %v", reply.StatusCode)
+	}
+
+	buf := httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("GET", "/journal/classify-signature/classifier", nil))
+
+	var setting journalSetting
+	body, _ := io.ReadAll(buf.Result().Body)
+	if err := json.Unmarshal(body, &setting); err != nil || setting.Classifier != CLASSIFIER_BAYES {
+		t.Fatalf("Expected bayes classifier to be selected but got %s", body)
+	}
+
+	buf = httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/registry/transactions", strings.NewReader(`[
+		{"date":"2021-01-05T00:00:00Z","amount":-20000,"label":"Electronice","sender":"Me","receiver":"eMAG","headers":"mcc=5732","signature":"classify-signature"},
+		{"date":"2021-01-06T00:00:00Z","amount":-21000,"label":"Cadouri","sender":"Me","receiver":"eMAG","headers":"mcc=5945","signature":"classify-signature"},
+		{"date":"2021-02-05T00:00:00Z","amount":-22000,"label":"Electronice","sender":"Me","receiver":"eMAG","headers":"mcc=5732","signature":"classify-signature"},
+		{"date":"2021-02-06T00:00:00Z","amount":-23000,"label":"Cadouri","sender":"Me","receiver":"eMAG","headers":"mcc=5945","signature":"classify-signature"}
+	]`)))
+
+	if reply := buf.Result(); reply.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 OK after POST but got %v", reply.StatusCode)
+	}
+
+	journalHttpRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("HEAD", "/journal/classify-signature", nil))
+
+	buf = httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/journal/classify-signature", strings.NewReader(`[
+		{"sender":"Me","receiver":"eMAG","amount":-22500,"date":"2021-03-06T00:00:00Z","headers":"mcc=5945"}
+	]`)))
+
+	var outcome []statement
+	body, _ = io.ReadAll(buf.Result().Body)
+	if err := json.Unmarshal(body, &outcome); err != nil || len(outcome) != 1 {
+		t.Fatalf("Expected one statement but got %s", body)
+	}
+
+	if best, _ := _topPrediction(outcome[0].Predicted); best != "Cadouri" {
+		t.Fatalf("Expected Cadouri to be predicted from headers but got %v", outcome[0].Predicted)
+	}
+}
+
+func BenchmarkClassifiers(b *testing.B) {
+	train, test := _holdout(classifierRecords(), 0.2)
+
+	for name, build := range classifiers {
+		b.Run(name, func(b *testing.B) {
+			c := build(results{})
+			for i := 0; i < b.N; i++ {
+				c.Train(train)
+				for _, r := range test {
+					c.Predict(r)
+				}
+			}
+
+			b.ReportMetric(_accuracy(c, test), "accuracy")
+		})
+	}
+}
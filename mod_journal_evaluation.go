@@ -0,0 +1,180 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lexndru/expenses"
+)
+
+// JOURNAL_EVALUATION_HOLDOUT is the default fraction of the newest records
+// held out from training to test predictions on
+const JOURNAL_EVALUATION_HOLDOUT = 0.2
+
+// assessment measures predictions of a classifier against actual labels
+type assessment struct {
+	Tested    int                       `json:"tested"`
+	Covered   int                       `json:"covered"`
+	Top1      float64                   `json:"top1"`
+	Top3      float64                   `json:"top3"`
+	Coverage  float64                   `json:"coverage"`
+	Confusion map[string]map[string]int `json:"confusion"` // actual label, top prediction
+}
+
+// _assess predicts every labeled record of the test set; records without any
+// prediction are counted in the confusion matrix as UNNAMED_ENTRY
+func _assess(c Classifier, test collection) assessment {
+	var top1, top3 int
+
+	out := assessment{Confusion: make(map[string]map[string]int)}
+	for _, r := range test {
+		if r.Label == "" || r.Label == UNNAMED_ENTRY {
+			continue
+		}
+
+		out.Tested++
+		if _, ok := out.Confusion[r.Label]; !ok {
+			out.Confusion[r.Label] = make(map[string]int)
+		}
+
+		ranked := _ranked(c.Predict(r))
+		if len(ranked) == 0 {
+			out.Confusion[r.Label][UNNAMED_ENTRY]++
+			continue
+		}
+
+		out.Covered++
+		out.Confusion[r.Label][ranked[0]]++
+
+		for i := 0; i < len(ranked) && i < 3; i++ {
+			if ranked[i] == r.Label {
+				if i == 0 {
+					top1++
+				}
+				top3++
+			}
+		}
+	}
+
+	if out.Tested > 0 {
+		out.Top1 = float64(top1) / float64(out.Tested)
+		out.Top3 = float64(top3) / float64(out.Tested)
+		out.Coverage = float64(out.Covered) / float64(out.Tested)
+	}
+
+	return out
+}
+
+type evaluation struct {
+	Signature  string  `json:"signature"`
+	Classifier string  `json:"classifier"`
+	Holdout    float64 `json:"holdout"`
+	Trained    int     `json:"trained"`
+	Split      string  `json:"split"` // date of the oldest tested record
+
+	assessment
+}
+
+// evaluation trains a classifier on the older records of a signature and
+// reports how well it predicts the newer ones
+func (j journal) evaluation(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	params := mux.Vars(rq)
+	out := evaluation{Signature: params["signature"], Holdout: JOURNAL_EVALUATION_HOLDOUT}
+
+	query := rq.URL.Query()
+	if value := query.Get("holdout"); value != "" {
+		holdout, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			response.Wrong(err, rq)
+			return
+		} else if holdout <= 0 || holdout >= 1 {
+			response.Wrong(errors.New("holdout must be between 0 and 1"), rq)
+			return
+		}
+
+		out.Holdout = holdout
+	}
+
+	out.Classifier = query.Get("classifier")
+	if out.Classifier == "" {
+		var setting journalSetting
+		if err := j.dbInstance.Where("signature = ?", out.Signature).Limit(1).Find(&setting).Error; err != nil {
+			response.Fault(err, rq)
+			return
+		}
+
+		out.Classifier = setting.Classifier
+		if _, ok := classifiers[out.Classifier]; !ok {
+			out.Classifier = CLASSIFIER_HEURISTIC
+		}
+	}
+
+	build, ok := classifiers[out.Classifier]
+	if !ok {
+		response.Wrong(fmt.Errorf("unknown classifier %q", out.Classifier), rq)
+		return
+	}
+
+	var reg expenses.Transactions
+	ctx := expenses.PullContext{
+		Storage: j.dbInstance.Where("signature = ?", out.Signature),
+		Limit:   j.dbBatchSize,
+	}
+
+	if err := reg.Pull(ctx); err != nil {
+		response.Fault(err, rq)
+		return
+	}
+
+	train, test := _holdout(_toRecords(reg), out.Holdout)
+	if len(test) > 0 {
+		out.Split = test[len(test)-1].Date.Format("2006-01-02")
+	}
+
+	c := build(results{})
+	c.Train(train)
+
+	out.Trained = len(train)
+	out.assessment = _assess(c, test)
+
+	if output, err := json.Marshal(out); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lexndru/expenses"
+)
+
+func TestJournalEvaluation(t *testing.T) {
+	var reg expenses.Transactions
+	for _, r := range classifierRecords() {
+		key := uuid.New().String()
+		reg = append(reg, expenses.Transaction{
+			UUID:         &key,
+			Date:         r.Date,
+			Amount:       r.Amount,
+			LabelName:    r.Label,
+			SenderName:   r.Sender,
+			ReceiverName: r.Receiver,
+			Signature:    "evaluation-signature",
+			Headers:      r.Headers,
+		})
+	}
+
+	if err := reg.Push(expenses.PushContext{Storage: journalModule.dbInstance, BatchSize: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	journal{journalModule.dbInstance, len(reg)}.Setup(router) // no pagination
+
+	evaluate := func(query string) (out evaluation, status int) {
+		buf := httptest.NewRecorder()
+		router.ServeHTTP(buf, httptest.NewRequest("GET", "/journal/evaluation-signature/evaluation"+query, nil))
+
+		if status = buf.Result().StatusCode; status == http.StatusOK {
+			body, _ := io.ReadAll(buf.Result().Body)
+			if err := json.Unmarshal(body, &out); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return
+	}
+
+	out, status := evaluate("?classifier=bayes&holdout=0.25")
+	if status != http.StatusOK {
+		t.Fatalf("Expected 200 OK for evaluation but got %v", status)
+	}
+
+	if out.Trained+out.Tested != len(reg) || out.Tested != len(reg)/4 {
+		t.Fatalf("Expected a quarter of %d records to be tested but got %d and %d", len(reg), out.Trained, out.Tested)
+	}
+
+	if out.Top1 < 0.95 || out.Top3 < out.Top1 || out.Coverage != 1 {
+		t.Fatalf("Expected accurate predictions for every record but got %+v", out.assessment)
+	}
+
+	var total int
+	for _, predictions := range out.Confusion {
+		for _, count := range predictions {
+			total += count
+		}
+	}
+
+	if total != out.Tested || out.Confusion["Salariu"]["Salariu"] == 0 {
+		t.Fatalf("Expected confusion matrix of every tested record but got %v", out.Confusion)
+	}
+
+	if out, _ := evaluate(""); out.Classifier != CLASSIFIER_HEURISTIC || out.Holdout != JOURNAL_EVALUATION_HOLDOUT {
+		t.Fatalf("Expected defaults to be used but got %s and %v", out.Classifier, out.Holdout)
+	}
+
+	if _, status := evaluate("?holdout=1"); status != http.StatusBadRequest {
+		t.Fatalf("Expected 400 Bad Request for holdout out of range but got %v", status)
+	}
+
+	if _, status := evaluate("?classifier=oracle"); status != http.StatusBadRequest {
+		t.Fatalf("Expected 400 Bad Request for unknown classifier but got %v", status)
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"gorm.io/gorm"
+)
+
+// journalFeedback is an accept/reject decision of a client about a label
+// suggested by the journal for a party (see record.Party)
+type journalFeedback struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Signature string    `json:"signature" gorm:"type: varchar(36); index; not null"`
+	Party     string    `json:"party" gorm:"not null"`
+	Label     string    `json:"label" gorm:"not null"`
+	Accepted  bool      `json:"accepted" gorm:"not null"`
+	CreatedAt time.Time `json:"date" gorm:"index"`
+}
+
+// decision is the payload of a feedback request; the party can be given as
+// is or through its sender and receiver
+type decision struct {
+	Party    string    `json:"party"`
+	Sender   string    `json:"sender"`
+	Receiver string    `json:"receiver"`
+	Label    string    `json:"label"`
+	Accepted bool      `json:"accepted"`
+	Date     time.Time `json:"date"`
+}
+
+// JOURNAL_FEEDBACK_DISMISS is the number of rejections (net of acceptances)
+// after which a label is no longer suggested for a party
+const JOURNAL_FEEDBACK_DISMISS = 3
+
+// tally counts accepted [0] and rejected [1] decisions of a label
+type tally [2]int
+
+func (t tally) Penalty() int {
+	if net := t[1] - t[0]; net > 0 {
+		return net
+	}
+
+	return 0
+}
+
+var (
+	feedbackMemory = make(map[scoped]map[string]map[string]tally) // signature, party, label
+	feedbackLock   sync.RWMutex
+)
+
+func (j journal) feedback(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	params := mux.Vars(rq)
+	signature := params["signature"]
+
+	payload, err := ioutil.ReadAll(rq.Body)
+	if err != nil { // TODO: avoid ioutil because of memory issues?
+		response.Wrong(err, rq)
+		return
+	}
+
+	var decisions []decision
+	if err := json.Unmarshal(payload, &decisions); err != nil {
+		response.Wrong(err, rq)
+		return
+	}
+
+	entries := make([]journalFeedback, len(decisions))
+	for i, d := range decisions {
+		party := d.Party
+		if party == "" && (d.Sender != "" || d.Receiver != "") {
+			party = record{Sender: d.Sender, Receiver: d.Receiver}.Party()
+		}
+
+		if party == "" || d.Label == "" {
+			response.Wrong(errors.New("feedback requires a party and a label"), rq)
+			return
+		}
+
+		entries[i] = journalFeedback{
+			Signature: signature,
+			Party:     party,
+			Label:     d.Label,
+			Accepted:  d.Accepted,
+			CreatedAt: d.Date, // zero means now
+		}
+	}
+
+	if len(entries) > 0 {
+		if err := j.dbInstance.CreateInBatches(&entries, j.dbBatchSize).Error; err != nil {
+			response.Fault(err, rq)
+			return
+		}
+
+		_forgetFeedback(j.dbInstance, signature) // reloaded on next use
+	}
+
+	if out, err := json.Marshal(entries); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(out, false, time.Since(startTime), rq)
+	}
+}
+
+type feedbackStats struct {
+	Period   string  `json:"period"`
+	Accepted int     `json:"accepted"`
+	Rejected int     `json:"rejected"`
+	Accuracy float64 `json:"accuracy"`
+}
+
+func (s *feedbackStats) Add(accepted bool) {
+	if accepted {
+		s.Accepted++
+	} else {
+		s.Rejected++
+	}
+
+	s.Accuracy = float64(s.Accepted) / float64(s.Accepted+s.Rejected)
+}
+
+// feedbackStatistics reports the share of accepted suggestions per month and
+// overall, so it's visible whether the auto-labeling gets better over time
+func (j journal) feedbackStatistics(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	params := mux.Vars(rq)
+	signature := params["signature"]
+
+	var entries []journalFeedback
+	if err := j.dbInstance.Where("signature = ?", signature).Order("created_at").Find(&entries).Error; err != nil {
+		response.Fault(err, rq)
+		return
+	}
+
+	var out struct {
+		Total   feedbackStats   `json:"total"`
+		Periods []feedbackStats `json:"periods"`
+	}
+
+	out.Total.Period = "total"
+	out.Periods = make([]feedbackStats, 0)
+
+	for _, entry := range entries {
+		period := entry.CreatedAt.Format("2006-01")
+		if n := len(out.Periods); n == 0 || out.Periods[n-1].Period != period {
+			out.Periods = append(out.Periods, feedbackStats{Period: period})
+		}
+
+		out.Periods[len(out.Periods)-1].Add(entry.Accepted)
+		out.Total.Add(entry.Accepted)
+	}
+
+	if output, err := json.Marshal(out); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
+
+// _recallFeedback loads the decisions of a signature into memory unless they
+// are already there
+func _recallFeedback(db *gorm.DB, signature string) {
+	feedbackLock.RLock()
+	_, ok := feedbackMemory[_scoped(db, signature)]
+	feedbackLock.RUnlock()
+
+	if ok {
+		return
+	}
+
+	var entries []journalFeedback
+	if err := db.Where("signature = ?", signature).Find(&entries).Error; err != nil {
+		log.Printf("warning: cannot load journal feedback of %s: %s\n", signature, err)
+		return
+	}
+
+	tallies := make(map[string]map[string]tally)
+	for _, entry := range entries {
+		if _, ok := tallies[entry.Party]; !ok {
+			tallies[entry.Party] = make(map[string]tally)
+		}
+
+		t := tallies[entry.Party][entry.Label]
+		if entry.Accepted {
+			t[0]++
+		} else {
+			t[1]++
+		}
+		tallies[entry.Party][entry.Label] = t
+	}
+
+	feedbackLock.Lock()
+	defer feedbackLock.Unlock()
+
+	feedbackMemory[_scoped(db, signature)] = tallies
+}
+
+func _forgetFeedback(db *gorm.DB, signature string) {
+	_dropFeedback(_scoped(db, signature))
+}
+
+func _dropFeedback(key scoped) {
+	feedbackLock.Lock()
+	defer feedbackLock.Unlock()
+
+	delete(feedbackMemory, key)
+}
+
+// _penaltiesOf returns the labels of a party with the net number of times
+// they were rejected, if any
+func _penaltiesOf(db *gorm.DB, signature, party string) map[string]int {
+	feedbackLock.RLock()
+	defer feedbackLock.RUnlock()
+
+	penalties := make(map[string]int)
+	for label, t := range feedbackMemory[_scoped(db, signature)][party] {
+		if penalty := t.Penalty(); penalty > 0 {
+			penalties[label] = penalty
+		}
+	}
+
+	return penalties
+}
+
+// _penalize lowers the popularity and the predicted score of labels rejected
+// for a party and drops the ones rejected too many times
+func _penalize(db *gorm.DB, signature, party string, score map[string]pointbus, predicted map[string]float64) {
+	for label, penalty := range _penaltiesOf(db, signature, party) {
+		if penalty >= JOURNAL_FEEDBACK_DISMISS {
+			delete(score, label)
+			delete(predicted, label)
+			continue
+		}
+
+		if points, ok := score[label]; ok {
+			points[5] -= penalty
+			score[label] = points
+		}
+
+		if value, ok := predicted[label]; ok {
+			predicted[label] = value / float64(1+penalty)
+		}
+	}
+}
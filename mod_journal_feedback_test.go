@@ -0,0 +1,127 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFeedbackAdjustsSuggestions(t *testing.T) {
+	buf := httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/registry/transactions", strings.NewReader(`[
+		{"date":"2021-01-05T00:00:00Z","amount":-4000,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"feedback-signature"},
+		{"date":"2021-02-05T00:00:00Z","amount":-4000,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"feedback-signature"},
+		{"date":"2021-03-05T00:00:00Z","amount":-4000,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"feedback-signature"}
+	]`)))
+
+	if reply := buf.Result(); reply.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 OK after POST but got %v", reply.StatusCode)
+	}
+
+	journalHttpRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("HEAD", "/journal/feedback-signature", nil))
+
+	analyze := func() map[string]pointbus {
+		buf := httptest.NewRecorder()
+		journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/journal/feedback-signature", strings.NewReader(`[
+			{"sender":"Me","receiver":"Netflix","amount":-4000,"date":"2021-04-05T00:00:00Z","parent":"xxx"}
+		]`)))
+
+		var outcome []statement
+		body, _ := io.ReadAll(buf.Result().Body)
+		if err := json.Unmarshal(body, &outcome); err != nil || len(outcome) != 1 {
+			t.Fatalf("Expected one statement but got %s", body)
+		}
+
+		return outcome[0].Calculated
+	}
+
+	feedback := func(payload string) {
+		buf := httptest.NewRecorder()
+		journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/journal/feedback-signature/feedback", strings.NewReader(payload)))
+
+		if reply := buf.Result(); reply.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 OK after feedback but got %v", reply.StatusCode)
+		}
+	}
+
+	before, ok := analyze()["Abonamente"]
+	if !ok {
+		t.Fatal("Expected Abonamente to be suggested before any feedback")
+	}
+
+	feedback(`[
+		{"sender":"Me","receiver":"Netflix","label":"Abonamente","accepted":false,"date":"2021-04-06T00:00:00Z"}
+	]`)
+
+	if after := analyze()["Abonamente"]; after[5] != before[5]-1 {
+		t.Fatalf("Expected popularity to drop by 1 after a rejection but got %v and %v", before, after)
+	}
+
+	feedback(`[
+		{"party":"sender=Me receiver=Netflix","label":"Abonamente","accepted":false,"date":"2021-05-06T00:00:00Z"},
+		{"party":"sender=Me receiver=Netflix","label":"Abonamente","accepted":true,"date":"2021-05-07T00:00:00Z"},
+		{"party":"sender=Me receiver=Netflix","label":"Abonamente","accepted":false,"date":"2021-05-08T00:00:00Z"},
+		{"party":"sender=Me receiver=Netflix","label":"Abonamente","accepted":false,"date":"2021-05-09T00:00:00Z"}
+	]`)
+
+	if _, ok := analyze()["Abonamente"]; ok {
+		t.Fatal("Expected Abonamente to be dismissed after repeated rejections")
+	}
+
+	buf = httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/journal/feedback-signature/feedback", strings.NewReader(`[{"label":"Abonamente"}]`)))
+	if reply := buf.Result(); reply.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 Bad Request without party but got %v", reply.StatusCode)
+	}
+
+	buf = httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("GET", "/journal/feedback-signature/feedback/stats", nil))
+
+	var stats struct {
+		Total   feedbackStats   `json:"total"`
+		Periods []feedbackStats `json:"periods"`
+	}
+
+	body, _ := io.ReadAll(buf.Result().Body)
+	if err := json.Unmarshal(body, &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Total.Accepted != 1 || stats.Total.Rejected != 4 || stats.Total.Accuracy != 0.2 {
+		t.Fatalf("Expected 1 accepted and 4 rejected decisions but got %+v", stats.Total)
+	}
+
+	if len(stats.Periods) != 2 || stats.Periods[0].Period != "2021-04" || stats.Periods[1].Accuracy != 0.25 {
+		t.Fatalf("Expected accuracy for April and May but got %+v", stats.Periods)
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// FORECAST_DAYS is the default number of days to forecast, at most
+	// FORECAST_MAX_DAYS can be asked for
+	FORECAST_DAYS     = 90
+	FORECAST_MAX_DAYS = 366
+
+	// FORECAST_LOOKBACK_DAYS of history give the average discretionary
+	// spending, i.e. anything but recurring payments
+	FORECAST_LOOKBACK_DAYS = 90
+
+	// FORECAST_BAND_Z is the number of standard deviations of discretionary
+	// spending in the confidence bands (90% for a normal distribution)
+	FORECAST_BAND_Z = 1.645
+)
+
+type expectedPayment struct {
+	Sender   string `json:"sender"`
+	Receiver string `json:"receiver"`
+	Label    string `json:"label"`
+	Amount   int64  `json:"amount"`
+}
+
+type balance struct {
+	Date     time.Time         `json:"date"`
+	Balance  int64             `json:"balance"`
+	Low      int64             `json:"low"`
+	High     int64             `json:"high"`
+	Payments []expectedPayment `json:"payments,omitempty"`
+}
+
+type forecast struct {
+	Signature     string    `json:"signature"`
+	Start         int64     `json:"start"`
+	Discretionary int64     `json:"discretionary"` // average daily spending
+	Days          []balance `json:"days"`
+	Lowest        *balance  `json:"lowest"`
+	BelowZero     *balance  `json:"below_zero"` // first day the low band dips below zero
+}
+
+// forecast projects the daily balance of a signature for ?days from today
+// (or ?at=YYYY-MM-DD) out of its recurring payments and the average of its
+// discretionary spending; ?balance is the starting balance if the registry
+// doesn't hold the whole history of the account
+func (j journal) forecast(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	params := mux.Vars(rq)
+	query := rq.URL.Query()
+
+	days := FORECAST_DAYS
+	if value := query.Get("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > FORECAST_MAX_DAYS {
+			response.Wrong(fmt.Errorf("days must be between 1 and %d, got %q", FORECAST_MAX_DAYS, value), rq)
+			return
+		}
+
+		days = n
+	}
+
+	at := _day(time.Now())
+	if value := query.Get("at"); value != "" {
+		date, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			response.Wrong(fmt.Errorf("at must be a date as YYYY-MM-DD, got %q", value), rq)
+			return
+		}
+
+		at = date
+	}
+
+	var start *int64
+	if value := query.Get("balance"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			response.Wrong(fmt.Errorf("balance must be an amount, got %q", value), rq)
+			return
+		}
+
+		start = &n
+	}
+
+	rs, err := _withRecords(j, params["signature"])
+	if err != nil {
+		response.Fault(err, rq)
+		return
+	}
+
+	out := _forecast(rs.records, at, days, start)
+	out.Signature = params["signature"]
+
+	if output, err := json.Marshal(out); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
+
+// _forecast starts from the balance at the given day (the sum of all records
+// until then unless given) and adds the expected recurring payments and the
+// average discretionary spending for every day after; bands use the range of
+// recurring amounts and the variation of discretionary spending
+func _forecast(records collection, at time.Time, days int, start *int64) forecast {
+	end := at.AddDate(0, 0, days)
+	whole := _wholeRecords(records)
+
+	var out forecast
+	if start != nil {
+		out.Start = *start
+	} else {
+		for _, r := range whole {
+			if !r.Date.After(at) {
+				out.Start += r.Amount
+			}
+		}
+	}
+
+	// expected payments by day, with the lowest and the highest amounts
+	type expected struct {
+		payments  []expectedPayment
+		low, high int64
+	}
+
+	schedule := make(map[string]*expected)
+	recurring := make(map[string]bool)
+
+	for _, p := range _detectRecurring(records, at) {
+		r := record{Sender: p.Sender, Receiver: p.Receiver}
+		recurring[fmt.Sprintf("%s in=%v", r.Party(), p.Incoming)] = true
+
+		typical, low, high := p.Amount.Typical, p.Amount.Min, p.Amount.Max
+		if !p.Incoming {
+			typical, low, high = -typical, -high, -low
+		}
+
+		next := _cadenceOf(p.Cadence).Next
+		for date := p.Expected; !date.After(end); date = next(date) {
+			if !date.After(at) {
+				continue // overdue, late payments are not guessed
+			}
+
+			key := date.Format("2006-01-02")
+			if _, ok := schedule[key]; !ok {
+				schedule[key] = &expected{}
+			}
+
+			day := schedule[key]
+			day.payments = append(day.payments, expectedPayment{p.Sender, p.Receiver, p.Label, typical})
+			day.low += low
+			day.high += high
+		}
+	}
+
+	// discretionary spending per day in the lookback period
+	lookback := at.AddDate(0, 0, -FORECAST_LOOKBACK_DAYS)
+	spending := make([]float64, FORECAST_LOOKBACK_DAYS)
+	for _, r := range whole {
+		key := fmt.Sprintf("%s in=%v", r.Party(), r.Amount > 0)
+		if r.Amount >= 0 || recurring[key] || !r.Date.After(lookback) || r.Date.After(at) {
+			continue
+		}
+
+		if index := _daysBetween(lookback, r.Date) - 1; index >= 0 && index < len(spending) {
+			spending[index] += float64(r.Amount)
+		}
+	}
+
+	var mean, variance float64
+	for _, amount := range spending {
+		mean += amount / float64(len(spending))
+	}
+	for _, amount := range spending {
+		variance += (amount - mean) * (amount - mean) / float64(len(spending))
+	}
+
+	out.Discretionary = int64(math.Round(mean))
+	out.Days = make([]balance, 0, days)
+
+	balanceNow, low, high := float64(out.Start), float64(out.Start), float64(out.Start)
+	for n := 1; n <= days; n++ {
+		date := at.AddDate(0, 0, n)
+
+		balanceNow += mean
+		low += mean
+		high += mean
+
+		var payments []expectedPayment
+		if day, ok := schedule[date.Format("2006-01-02")]; ok {
+			for _, p := range day.payments {
+				balanceNow += float64(p.Amount)
+			}
+
+			low += float64(day.low)
+			high += float64(day.high)
+			payments = day.payments
+		}
+
+		band := FORECAST_BAND_Z * math.Sqrt(variance*float64(n))
+		out.Days = append(out.Days, balance{
+			Date:     date,
+			Balance:  int64(math.Round(balanceNow)),
+			Low:      int64(math.Round(low - band)),
+			High:     int64(math.Round(high + band)),
+			Payments: payments,
+		})
+	}
+
+	for i := range out.Days {
+		day := &out.Days[i]
+		if out.Lowest == nil || day.Balance < out.Lowest.Balance {
+			out.Lowest = day
+		}
+
+		if out.BelowZero == nil && day.Low < 0 {
+			out.BelowZero = day
+		}
+	}
+
+	return out
+}
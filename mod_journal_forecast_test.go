@@ -0,0 +1,116 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestForecastBalance(t *testing.T) {
+	date := func(m time.Month, d int) time.Time {
+		return time.Date(2021, m, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	var records collection
+	for m := time.January; m <= time.June; m++ {
+		records = append(records, record{Sender: "Employer", Receiver: "Me", Label: "Salariu", Date: date(m, 10), Amount: 800000})
+		records = append(records, record{Sender: "Me", Receiver: "Landlord", Label: "Chirie", Date: date(m, 1), Amount: -300000})
+		records = append(records, record{Sender: "Me", Receiver: "Netflix", Label: "Abonamente", Date: date(m, 5), Amount: -4000})
+	}
+
+	for d := date(time.April, 2); d.Before(date(time.July, 1)); d = d.AddDate(0, 0, 3) {
+		records = append(records, record{Sender: "Me", Receiver: "Kaufland", Label: "Mâncare", Date: d, Amount: -9000 - int64(d.Day()%4)*1000})
+	}
+
+	start := int64(50000)
+	out := _forecast(records, date(time.June, 30), 60, &start)
+
+	if len(out.Days) != 60 || !out.Days[0].Date.Equal(date(time.July, 1)) || out.Start != start {
+		t.Fatalf("Expected 60 days from July 1 with the given balance but got %d days", len(out.Days))
+	}
+
+	if out.Discretionary > -3000 || out.Discretionary < -4000 {
+		t.Fatalf("Expected discretionary spending of groceries every 3 days but got %d", out.Discretionary)
+	}
+
+	rent, salary := out.Days[0], out.Days[9]
+	if len(rent.Payments) != 1 || rent.Payments[0].Amount != -300000 || rent.Balance > start-300000 {
+		t.Fatalf("Expected rent on July 1 but got %+v", rent)
+	}
+
+	if len(salary.Payments) != 1 || salary.Payments[0].Label != "Salariu" || salary.Balance < out.Days[8].Balance+790000 {
+		t.Fatalf("Expected salary on July 10 but got %+v", salary)
+	}
+
+	if out.BelowZero == nil || !out.BelowZero.Date.Equal(date(time.July, 1)) {
+		t.Fatalf("Expected balance to dip below zero before payday but got %+v", out.BelowZero)
+	}
+
+	if out.Lowest == nil || !out.Lowest.Date.Equal(date(time.July, 9)) {
+		t.Fatalf("Expected lowest balance the day before payday but got %+v", out.Lowest)
+	}
+
+	for _, day := range out.Days {
+		if day.Low > day.Balance || day.Balance > day.High {
+			t.Fatalf("Expected balance within bands but got %+v", day)
+		}
+	}
+
+	if last := out.Days[59]; last.High-last.Low <= out.Days[1].High-out.Days[1].Low {
+		t.Fatal("Expected bands to widen over time")
+	}
+
+	var total int64
+	for _, r := range records {
+		total += r.Amount
+	}
+
+	if computed := _forecast(records, date(time.June, 30), 1, nil); computed.Start != total {
+		t.Fatalf("Expected starting balance to be the sum of records but got %d and %d", computed.Start, total)
+	}
+}
+
+func TestForecastEndpoint(t *testing.T) {
+	for query, status := range map[string]int{
+		"?days=30&at=2020-02-01": http.StatusOK,
+		"?days=0":                http.StatusBadRequest,
+		"?days=1000":             http.StatusBadRequest,
+		"?at=soon":               http.StatusBadRequest,
+		"?balance=lots":          http.StatusBadRequest,
+	} {
+		buf := httptest.NewRecorder()
+		journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("GET", "/journal/test-signature/forecast"+query, nil))
+
+		if reply := buf.Result(); reply.StatusCode != status {
+			t.Fatalf("Expected %d for %s but got %v", status, query, reply.StatusCode)
+		}
+	}
+}
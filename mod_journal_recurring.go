@@ -0,0 +1,297 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// cadence of recurring payments: the days expected between two payments and
+// how late a payment can be before it's considered missing
+type cadence struct {
+	Name  string
+	Min   int
+	Max   int
+	Grace int
+	Next  func(time.Time) time.Time
+}
+
+var cadences = []cadence{
+	{"weekly", 6, 8, 3, func(t time.Time) time.Time { return t.AddDate(0, 0, 7) }},
+	{"monthly", 27, 33, 7, func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+	{"yearly", 358, 372, 14, func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+}
+
+func _cadenceOf(name string) cadence {
+	for _, c := range cadences {
+		if c.Name == name {
+			return c
+		}
+	}
+
+	return cadences[1] // monthly
+}
+
+const (
+	// RECURRING_MIN_OCCURRENCES are needed before payments are called recurring
+	RECURRING_MIN_OCCURRENCES = 3
+
+	// RECURRING_REGULARITY is the share of intervals between payments which
+	// must match the cadence, so a late payment doesn't hide a subscription
+	RECURRING_REGULARITY = 0.75
+
+	// RECURRING_PRICE_TOLERANCE is how much a price can vary and still be the
+	// same, e.g. because of currency conversion
+	RECURRING_PRICE_TOLERANCE = 0.01
+)
+
+const (
+	ALERT_MISSING = "missing"
+	ALERT_PRICE   = "price"
+)
+
+type alert struct {
+	Kind     string     `json:"kind"`
+	Expected *time.Time `json:"expected,omitempty"`
+	Previous int64      `json:"previous,omitempty"`
+	Current  int64      `json:"current,omitempty"`
+}
+
+type amountRange struct {
+	Min     int64 `json:"min"`
+	Max     int64 `json:"max"`
+	Typical int64 `json:"typical"`
+	Last    int64 `json:"last"`
+}
+
+// payments is a series of recurring payments between the same actors
+type payments struct {
+	Sender      string      `json:"sender"`
+	Receiver    string      `json:"receiver"`
+	Incoming    bool        `json:"incoming"`
+	Label       string      `json:"label"`
+	Cadence     string      `json:"cadence"`
+	Occurrences int         `json:"occurrences"`
+	First       time.Time   `json:"first"`
+	Last        time.Time   `json:"last"`
+	Amount      amountRange `json:"amount"`
+	Expected    time.Time   `json:"expected"`
+	Alerts      []alert     `json:"alerts"`
+}
+
+// recurring lists subscriptions, bills and other regular payments of a
+// signature as of today or the date given with ?at=YYYY-MM-DD
+func (j journal) recurring(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	params := mux.Vars(rq)
+	signature := params["signature"]
+
+	at := time.Now()
+	if value := rq.URL.Query().Get("at"); value != "" {
+		date, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			response.Wrong(fmt.Errorf("at must be a date as YYYY-MM-DD, got %q", value), rq)
+			return
+		}
+
+		at = date
+	}
+
+	rs, err := _withRecords(j, signature)
+	if err != nil {
+		response.Fault(err, rq)
+		return
+	}
+
+	if output, err := json.Marshal(_detectRecurring(rs.records, at)); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
+
+// _detectRecurring groups records by party and direction of the amount and
+// keeps the series paid at a regular cadence, sorted by the next payment
+func _detectRecurring(records collection, at time.Time) []payments {
+	series := make(map[string]collection)
+	var keys []string
+
+	for _, r := range _wholeRecords(records) {
+		key := fmt.Sprintf("%s in=%v", r.Party(), r.Amount > 0)
+		if _, ok := series[key]; !ok {
+			keys = append(keys, key)
+		}
+		series[key] = append(series[key], r)
+	}
+
+	out := make([]payments, 0)
+	for _, key := range keys {
+		if p, ok := _recurringPayments(series[key], at); ok {
+			out = append(out, p)
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Expected.Before(out[j].Expected)
+	})
+
+	return out
+}
+
+// _wholeRecords joins the records split from the details of a transaction,
+// so a payment is counted once with its full amount
+func _wholeRecords(records collection) collection {
+	whole := make(collection, 0, len(records))
+	index := make(map[string]int)
+
+	for _, r := range records {
+		if i, ok := index[r.Parent]; ok && r.Parent != "" {
+			whole[i].Amount += r.Amount
+			continue
+		}
+
+		index[r.Parent] = len(whole)
+		whole = append(whole, r)
+	}
+
+	return whole
+}
+
+func _recurringPayments(records collection, at time.Time) (payments, bool) {
+	if len(records) < RECURRING_MIN_OCCURRENCES {
+		return payments{}, false
+	}
+
+	sorted := append(collection(nil), records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Date.Before(sorted[j].Date)
+	})
+
+	intervals := make([]int, len(sorted)-1)
+	for i := 1; i < len(sorted); i++ {
+		intervals[i-1] = _daysBetween(sorted[i-1].Date, sorted[i].Date)
+	}
+
+	var found *cadence
+	for i := range cadences {
+		var regular int
+		for _, days := range intervals {
+			if cadences[i].Min <= days && days <= cadences[i].Max {
+				regular++
+			}
+		}
+
+		if float64(regular) >= RECURRING_REGULARITY*float64(len(intervals)) {
+			found = &cadences[i]
+			break
+		}
+	}
+
+	if found == nil {
+		return payments{}, false
+	}
+
+	first, last := sorted[0], sorted[len(sorted)-1]
+
+	amounts := make([]int64, len(sorted))
+	labels := make(map[string]int)
+	for i, r := range sorted {
+		amounts[i] = r.Amount
+		if r.Amount < 0 {
+			amounts[i] = -r.Amount
+		}
+
+		if r.Label != UNNAMED_ENTRY {
+			labels[r.Label]++
+		}
+	}
+
+	p := payments{
+		Sender:      last.Sender,
+		Receiver:    last.Receiver,
+		Incoming:    last.Amount > 0,
+		Label:       UNNAMED_ENTRY,
+		Cadence:     found.Name,
+		Occurrences: len(sorted),
+		First:       first.Date,
+		Last:        last.Date,
+		Amount:      _amountRange(amounts),
+		Expected:    found.Next(last.Date),
+		Alerts:      make([]alert, 0),
+	}
+
+	for label, count := range labels {
+		if count > labels[p.Label] || (count == labels[p.Label] && label < p.Label) {
+			p.Label = label
+		}
+	}
+
+	if _daysBetween(p.Expected, at) > found.Grace {
+		expected := p.Expected
+		p.Alerts = append(p.Alerts, alert{Kind: ALERT_MISSING, Expected: &expected})
+	}
+
+	// prices only change for payments of a stable amount, bills vary anyway
+	previous := _amountRange(amounts[:len(amounts)-1])
+	if _withinPrice(previous.Min, previous.Max) && !_withinPrice(previous.Last, p.Amount.Last) {
+		p.Alerts = append(p.Alerts, alert{Kind: ALERT_PRICE, Previous: previous.Last, Current: p.Amount.Last})
+	}
+
+	return p, true
+}
+
+func _amountRange(amounts []int64) amountRange {
+	sorted := append([]int64(nil), amounts...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	return amountRange{
+		Min:     sorted[0],
+		Max:     sorted[len(sorted)-1],
+		Typical: sorted[len(sorted)/2],
+		Last:    amounts[len(amounts)-1],
+	}
+}
+
+func _withinPrice(a, b int64) bool {
+	diff := a - b
+	if diff < 0 {
+		diff = -diff
+	}
+
+	return float64(diff) <= RECURRING_PRICE_TOLERANCE*float64(a)
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectRecurringPayments(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	var records collection
+	for m := time.January; m <= time.July; m++ {
+		amount := int64(-4000)
+		if m == time.July {
+			amount = -4500 // price increase
+		}
+
+		records = append(records, record{Sender: "Me", Receiver: "Netflix", Label: "Abonamente", Date: date(2021, m, 5), Amount: amount})
+		records = append(records, record{Sender: "Me", Receiver: "Enel", Label: "Utilități", Date: date(2021, m, 14+int(m)%3), Amount: -15000 - int64(m)*1000})
+		records = append(records, record{Sender: "Me", Receiver: "Kaufland", Label: "Mâncare", Date: date(2021, m, int(m)*3), Amount: -9000})
+		records = append(records, record{Sender: "Me", Receiver: "Kaufland", Label: "Mâncare", Date: date(2021, m, int(m)*3+1), Amount: -7000})
+	}
+
+	for w := 0; w < 8; w++ {
+		records = append(records, record{Sender: "Me", Receiver: "World Class", Label: "Sport", Date: date(2021, time.May, 3).AddDate(0, 0, 7*w), Amount: -5000})
+	}
+
+	for y := 2018; y <= 2020; y++ {
+		records = append(records, record{Sender: "Me", Receiver: "Allianz", Label: "Asigurări", Date: date(y, time.March, 1), Amount: -60000})
+	}
+
+	// the last payment is split in details which are one payment
+	records = append(records, record{Sender: "Me", Receiver: "Allianz", Label: "Asigurări", Date: date(2021, time.March, 1), Amount: -40000, Parent: "policy"})
+	records = append(records, record{Sender: "Me", Receiver: "Allianz", Label: "Casă", Date: date(2021, time.March, 1), Amount: -20000, Parent: "policy"})
+
+	found := make(map[string]payments)
+	for _, p := range _detectRecurring(records, date(2021, time.July, 10)) {
+		found[p.Receiver] = p
+	}
+
+	if len(found) != 4 {
+		t.Fatalf("Expected 4 recurring payments but got %+v", found)
+	}
+
+	if _, ok := found["Kaufland"]; ok {
+		t.Fatal("Expected irregular groceries not to be recurring")
+	}
+
+	netflix := found["Netflix"]
+	if netflix.Cadence != "monthly" || !netflix.Expected.Equal(date(2021, time.August, 5)) || netflix.Label != "Abonamente" {
+		t.Fatalf("Expected monthly Netflix due on August 5 but got %+v", netflix)
+	}
+
+	if len(netflix.Alerts) != 1 || netflix.Alerts[0].Kind != ALERT_PRICE || netflix.Alerts[0].Previous != 4000 || netflix.Alerts[0].Current != 4500 {
+		t.Fatalf("Expected a price alert for Netflix but got %+v", netflix.Alerts)
+	}
+
+	if enel := found["Enel"]; enel.Cadence != "monthly" || len(enel.Alerts) != 0 || enel.Amount.Min != 16000 || enel.Amount.Max != 22000 {
+		t.Fatalf("Expected monthly bill of varying amounts without alerts but got %+v", enel)
+	}
+
+	gym := found["World Class"]
+	if gym.Cadence != "weekly" || len(gym.Alerts) != 1 || gym.Alerts[0].Kind != ALERT_MISSING {
+		t.Fatalf("Expected weekly gym payment to be missing but got %+v", gym)
+	}
+
+	if insurance := found["Allianz"]; insurance.Cadence != "yearly" || insurance.Occurrences != 4 || len(insurance.Alerts) != 0 {
+		t.Fatalf("Expected yearly insurance but got %+v", insurance)
+	}
+}
+
+func TestRecurringEndpoint(t *testing.T) {
+	buf := httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/registry/transactions", strings.NewReader(`[
+		{"date":"2021-01-20T00:00:00Z","amount":-3000,"label":"Abonamente","sender":"Me","receiver":"Spotify","signature":"recurring-signature"},
+		{"date":"2021-02-20T00:00:00Z","amount":-3000,"label":"Abonamente","sender":"Me","receiver":"Spotify","signature":"recurring-signature"},
+		{"date":"2021-03-20T00:00:00Z","amount":-3000,"label":"Abonamente","sender":"Me","receiver":"Spotify","signature":"recurring-signature"}
+	]`)))
+
+	if reply := buf.Result(); reply.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 OK after POST but got %v", reply.StatusCode)
+	}
+
+	buf = httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("GET", "/journal/recurring-signature/recurring?at=2021-05-01", nil))
+
+	var out []payments
+	body, _ := io.ReadAll(buf.Result().Body)
+	if err := json.Unmarshal(body, &out); err != nil || len(out) != 1 {
+		t.Fatalf("Expected one recurring payment but got %s", body)
+	}
+
+	if len(out[0].Alerts) != 1 || !out[0].Alerts[0].Expected.Equal(time.Date(2021, time.April, 20, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Expected April payment to be missing but got %+v", out[0].Alerts)
+	}
+
+	buf = httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("GET", "/journal/recurring-signature/recurring?at=tomorrow", nil))
+	if reply := buf.Result(); reply.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 Bad Request for wrong date but got %v", reply.StatusCode)
+	}
+}
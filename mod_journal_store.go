@@ -0,0 +1,248 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// journalStore is a bounded in-memory store of journal results with least
+// recently used eviction; its size is the number of records and features
+// held, evicted signatures are loaded from their persisted model on next use
+// but without records, so they're evaluated again where records are needed;
+// their classifier and feedback are released along with them
+type journalStore struct {
+	lock    sync.Mutex
+	limit   int // zero means unlimited
+	held    int
+	order   *list.List // most recently used first
+	entries map[scoped]*list.Element
+}
+
+type storedResults struct {
+	key      scoped
+	rs       results
+	features int
+	used     time.Time
+}
+
+func (s storedResults) Size() int {
+	return len(s.rs.records) + s.features
+}
+
+func newJournalStore(limit int) *journalStore {
+	return &journalStore{
+		limit:   limit,
+		order:   list.New(),
+		entries: make(map[scoped]*list.Element),
+	}
+}
+
+// SetLimit changes the maximum size of the store and evicts what's over it
+func (s *journalStore) SetLimit(limit int) {
+	s.lock.Lock()
+	s.limit = limit
+	evicted := s.evict(scoped{})
+	s.lock.Unlock()
+
+	_release(evicted)
+}
+
+func (s *journalStore) Load(key scoped) (results, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	element, ok := s.entries[key]
+	if !ok {
+		return results{}, false
+	}
+
+	s.order.MoveToFront(element)
+	stored := element.Value.(*storedResults)
+	stored.used = time.Now()
+
+	return stored.rs, true
+}
+
+func (s *journalStore) Store(key scoped, rs results) {
+	s.lock.Lock()
+	evicted := s.store(key, rs)
+	s.lock.Unlock()
+
+	_release(evicted)
+}
+
+// Update replaces the results of a signature with the ones returned by fn,
+// atomically, unless the signature is not in the store
+func (s *journalStore) Update(key scoped, fn func(results) results) (results, bool) {
+	s.lock.Lock()
+	element, ok := s.entries[key]
+	if !ok {
+		s.lock.Unlock()
+		return results{}, false
+	}
+
+	rs := fn(element.Value.(*storedResults).rs)
+	evicted := s.store(key, rs)
+	s.lock.Unlock()
+
+	_release(evicted)
+
+	return rs, true
+}
+
+func (s *journalStore) Drop(key scoped) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if element, ok := s.entries[key]; ok {
+		s.remove(element)
+	}
+}
+
+func (s *journalStore) store(key scoped, rs results) []scoped {
+	stored := &storedResults{key: key, rs: rs, used: time.Now()}
+	for _, features := range rs.patterns {
+		stored.features += len(features)
+	}
+
+	if element, ok := s.entries[key]; ok {
+		s.held -= element.Value.(*storedResults).Size()
+		element.Value = stored
+		s.order.MoveToFront(element)
+	} else {
+		s.entries[key] = s.order.PushFront(stored)
+	}
+
+	s.held += stored.Size()
+
+	return s.evict(key)
+}
+
+// evict the least recently used results until the store is within limits,
+// except for the given signature which was just stored, and returns the keys
+// of the evicted ones
+func (s *journalStore) evict(keep scoped) (evicted []scoped) {
+	for s.limit > 0 && s.held > s.limit {
+		element := s.order.Back()
+		if element == nil || element.Value.(*storedResults).key == keep {
+			return // nothing else to evict
+		}
+
+		evicted = append(evicted, element.Value.(*storedResults).key)
+		s.remove(element)
+	}
+
+	return
+}
+
+// _release drops the classifiers and feedback trained on evicted results,
+// it must not be called with the lock of the store held
+func _release(evicted []scoped) {
+	for _, key := range evicted {
+		_dropClassifier(key)
+		_dropFeedback(key)
+	}
+}
+
+func (s *journalStore) remove(element *list.Element) {
+	stored := element.Value.(*storedResults)
+
+	s.held -= stored.Size()
+	s.order.Remove(element)
+	delete(s.entries, stored.key)
+}
+
+type journalUsage struct {
+	Signature string    `json:"signature"`
+	Records   int       `json:"records"`
+	Features  int       `json:"features"`
+	Size      int       `json:"size"`
+	Computed  time.Time `json:"computed"`
+	Used      time.Time `json:"used"`
+}
+
+type journalStoreUsage struct {
+	Limit      int            `json:"limit"`
+	Held       int            `json:"held"`
+	Signatures []journalUsage `json:"signatures"`
+}
+
+// Usage reports the size of the store and of every signature of a household
+// in it, most recently used first
+func (s *journalStore) Usage(tenant string) journalStoreUsage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	usage := journalStoreUsage{Limit: s.limit, Held: s.held, Signatures: make([]journalUsage, 0, len(s.entries))}
+	for element := s.order.Front(); element != nil; element = element.Next() {
+		stored := element.Value.(*storedResults)
+		if stored.key.tenant != tenant {
+			continue
+		}
+
+		usage.Signatures = append(usage.Signatures, journalUsage{
+			Signature: stored.key.name,
+			Records:   len(stored.rs.records),
+			Features:  stored.features,
+			Size:      stored.Size(),
+			Computed:  stored.rs.computed,
+			Used:      stored.used,
+		})
+	}
+
+	return usage
+}
+
+// Each calls fn with the records and features held for every signature of
+// every household
+func (s *journalStore) Each(fn func(key scoped, records, features int)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for element := s.order.Front(); element != nil; element = element.Next() {
+		stored := element.Value.(*storedResults)
+		fn(stored.key, len(stored.rs.records), stored.features)
+	}
+}
+
+// loaded lists the signatures held in memory by the journal
+func (j journal) loaded(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	if output, err := json.Marshal(memory.Usage(_tenantOf(j.dbInstance))); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJournalStoreEviction(t *testing.T) {
+	some := func(n int) results {
+		return results{records: make(collection, n)}
+	}
+
+	store := newJournalStore(10)
+	store.Store(scoped{name: "first"}, some(4))
+	store.Store(scoped{name: "second"}, some(4))
+
+	if _, ok := store.Load(scoped{name: "first"}); !ok {
+		t.Fatal("Expected first signature to be held in memory")
+	}
+
+	store.Store(scoped{name: "third"}, some(4)) // second is the least recently used now
+	if _, ok := store.Load(scoped{name: "second"}); ok {
+		t.Fatal("Expected second signature to be evicted")
+	}
+
+	if usage := store.Usage(""); usage.Held != 8 || len(usage.Signatures) != 2 || usage.Signatures[0].Signature != "third" {
+		t.Fatalf("Expected first and third signatures held but got %+v", usage)
+	}
+
+	store.Store(scoped{name: "large"}, some(20)) // over the limit alone, but kept
+	if usage := store.Usage(""); usage.Held != 20 || len(usage.Signatures) != 1 {
+		t.Fatalf("Expected only the large signature held but got %+v", usage)
+	}
+
+	if _, ok := store.Update(scoped{name: "first"}, func(rs results) results { return rs }); ok {
+		t.Fatal("Expected no update of an evicted signature")
+	}
+
+	store.SetLimit(0)
+	store.Store(scoped{name: "first"}, some(4))
+	if usage := store.Usage(""); usage.Held != 24 || usage.Limit != 0 {
+		t.Fatalf("Expected unlimited store to hold everything but got %+v", usage)
+	}
+
+	store.Drop(scoped{name: "large"})
+	if usage := store.Usage(""); usage.Held != 4 || len(usage.Signatures) != 1 {
+		t.Fatalf("Expected dropped signature to be released but got %+v", usage)
+	}
+}
+
+func TestJournalLoaded(t *testing.T) {
+	journalHttpRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/journal/test-signature", nil))
+
+	buf := httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("GET", "/journal", nil))
+
+	var usage journalStoreUsage
+	if err := json.NewDecoder(buf.Result().Body).Decode(&usage); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, loaded := range usage.Signatures {
+		if loaded.Signature == "test-signature" && loaded.Size == loaded.Records+loaded.Features && !loaded.Computed.IsZero() {
+			return
+		}
+	}
+
+	t.Fatalf("Expected test-signature to be listed as loaded but got %+v", usage)
+}
+
+func _isClassified(signature string) bool {
+	_, ok := _classifierOf(journalModule.dbInstance, signature)
+	return ok
+}
+
+func TestJournalWriteAfterEviction(t *testing.T) {
+	memory.SetLimit(1) // every evaluation evicts the others
+	defer memory.SetLimit(0)
+
+	write := func(payload string) {
+		buf := httptest.NewRecorder()
+		journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/registry/transactions", strings.NewReader(payload)))
+
+		if reply := buf.Result(); reply.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 OK after POST but got %v", reply.StatusCode)
+		}
+	}
+
+	write(`[
+		{"date":"2021-01-05T00:00:00Z","amount":-4000,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"evicted-signature"},
+		{"date":"2021-02-05T00:00:00Z","amount":-4000,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"evicted-signature"},
+		{"date":"2021-03-05T00:00:00Z","amount":-1000,"label":"Abonamente","sender":"Me","receiver":"Spotify","signature":"evicted-signature"},
+		{"date":"2021-03-09T00:00:00Z","amount":-2500,"label":"Mancare","sender":"Me","receiver":"Lidl","signature":"evicted-signature"},
+		{"date":"2021-04-05T00:00:00Z","amount":-4000,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"evicted-signature"}
+	]`)
+
+	journalHttpRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("HEAD", "/journal/evicted-signature", nil))
+	if _prepare(journalModule, "evicted-signature"); !_isClassified("evicted-signature") {
+		t.Fatal("Expected a classifier trained on the signature")
+	}
+
+	journalHttpRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("HEAD", "/journal/test-signature", nil))
+
+	if _, ok := _remembered(journalModule.dbInstance, "evicted-signature"); ok {
+		t.Fatal("Expected signature to be evicted by the next evaluation")
+	} else if _isClassified("evicted-signature") {
+		t.Fatal("Expected the classifier of an evicted signature to be released")
+	}
+
+	write(`[
+		{"date":"2021-05-05T00:00:00Z","amount":-4000,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"evicted-signature"}
+	]`)
+
+	buf := httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("GET", "/journal/evicted-signature/download", nil))
+
+	body, _ := io.ReadAll(buf.Result().Body)
+	if lines := strings.Split(strings.Trim(string(body), "\n"), "\n"); len(lines) != 7 {
+		t.Fatalf("Expected header and 6 records after eviction but got %q", body)
+	}
+}
@@ -37,6 +37,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/lexndru/expenses"
@@ -48,6 +49,7 @@ import (
 var (
 	journalDBInstance = sqlite.Open("file::memory:")
 	journalHttpRouter *mux.Router
+	journalModule     journal
 )
 
 func init() {
@@ -62,7 +64,12 @@ func init() {
 		reg.Setup(journalHttpRouter) // must register
 
 		mod := journal{db, 10}
+		if err := mod.Install(); err != nil {
+			panic(err)
+		}
+
 		mod.Setup(journalHttpRouter)
+		journalModule = mod
 	}
 
 	var dataTransactions expenses.Transactions
@@ -90,11 +97,12 @@ func TestStreamSignedTransactionRecords(t *testing.T) {
 
 	// NOTE: last 36 chars are for the assoc. UUID
 	expected := []string{
-		"actor.#6-xxxx-xxxx-xxxx-xxxxxxxxxxxx,actor.#1-xxxx-xxxx-xxxx-xxxxxxxxxxxx,Label #3,1581724800,1240000,",
-		"Actor #1,Actor #2,Label #1.2,1580947200,-930,",
-		"Actor #1,Actor #5,Label #1.1,1580947200,-1500,",
-		"Actor #1,Actor #2,Label #1.1,1580860800,-3822,",
-		"Actor #1,Actor #2,Label #1.2,1580860800,-2410,",
+		"sender,receiver,label,date,amount,parent",
+		"actor.#6-xxxx-xxxx-xxxx-xxxxxxxxxxxx,actor.#1-xxxx-xxxx-xxxx-xxxxxxxxxxxx,Label #3,2020-02-15,12400.00,",
+		"Actor #1,Actor #2,Label #1.2,2020-02-06,-9.30,",
+		"Actor #1,Actor #5,Label #1.1,2020-02-06,-15.00,",
+		"Actor #1,Actor #2,Label #1.1,2020-02-05,-38.22,",
+		"Actor #1,Actor #2,Label #1.2,2020-02-05,-24.10,",
 	}
 
 	buf := httptest.NewRecorder()
@@ -114,7 +122,11 @@ func TestStreamSignedTransactionRecords(t *testing.T) {
 				break
 			}
 
-			if ln := line[0 : len(line)-36]; expected[i] != string(ln) {
+			if i == 0 {
+				if expected[i] != string(line) {
+					t.Fatalf("Expected header %s but got %s", expected[i], line)
+				}
+			} else if ln := line[0 : len(line)-36]; expected[i] != string(ln) {
 				t.Fatalf("Expected %s but got %s", expected[i], line)
 			}
 		}
@@ -492,8 +504,8 @@ func TestTransactionIntegrityOnDetailsConflict(t *testing.T) {
 		t.Fatal(err)
 	} else {
 		lines := strings.Split(strings.Trim(string(body), "\n"), "\n")
-		if len(lines) != 3 { // 2 details + 1 record from loaded samples
-			t.Fatalf("Expected three records to download but got %d instead", len(lines))
+		if len(lines) != 4 { // header, 2 details + 1 record from loaded samples
+			t.Fatalf("Expected three records to download but got %d instead", len(lines)-1)
 		}
 	}
 
@@ -527,15 +539,297 @@ func TestTransactionIntegrityOnDetailsConflict(t *testing.T) {
 	journalHttpRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("HEAD", "/journal/xxx", nil))
 
 	buf2 := httptest.NewRecorder()
-	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("GET", "/journal/xxx/download", nil))
+	journalHttpRouter.ServeHTTP(buf2, httptest.NewRequest("GET", "/journal/xxx/download", nil))
 	reply2 := buf2.Result()
 
 	if body, err := io.ReadAll(reply2.Body); err != nil {
 		t.Fatal(err)
 	} else {
 		lines := strings.Split(strings.Trim(string(body), "\n"), "\n")
-		if len(lines) != 1 { // the only one record from loaded samples
-			t.Fatalf("Expected corrupted transaction to be discarded and get one record but got %d instead", len(lines))
+		if len(lines) != 2 { // header and the only one record from loaded samples
+			t.Fatalf("Expected corrupted transaction to be discarded and get one record but got %d instead", len(lines)-1)
+		}
+	}
+}
+
+func TestPersistedModelAfterRestart(t *testing.T) {
+	var model journalModel
+	if err := journalModule.dbInstance.First(&model, "signature = ?", "test-signature").Error; err != nil {
+		t.Fatalf("Expected model to be persisted after evaluation: %s", err)
+	}
+
+	if model.Version != JOURNAL_MODEL_VERSION || model.ComputedAt.IsZero() {
+		t.Fatalf("Expected versioned model with compute time but got %+v", model)
+	}
+
+	_forget(journalModule.dbInstance, "test-signature") // pretend the process was restarted
+
+	payload := bytes.NewReader([]byte(`[
+		{
+			"sender": "Actor #1",
+			"receiver": "Actor #2",
+			"amount": -1200,
+			"date": "2021-04-02T00:00:00Z",
+			"parent": "xxx"
+		}
+	]`))
+
+	buf := httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/journal/test-signature", payload))
+
+	var outcome []statement
+	body, _ := io.ReadAll(buf.Result().Body)
+	if err := json.Unmarshal(body, &outcome); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(outcome) != 1 || len(outcome[0].Calculated) != 1 {
+		t.Fatalf("Expected label suggestions from the persisted model but got %s", body)
+	}
+
+	if rs, ok := _remembered(journalModule.dbInstance, "test-signature"); !ok || !rs.computed.Equal(model.ComputedAt) {
+		t.Fatal("Expected persisted model to be loaded lazily into memory")
+	}
+}
+
+func TestIncrementalModelUpdate(t *testing.T) {
+	write := func(payload string) {
+		buf := httptest.NewRecorder()
+		journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/registry/transactions", strings.NewReader(payload)))
+
+		if reply := buf.Result(); reply.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 OK after POST but got %v", reply.StatusCode)
+		}
+	}
+
+	write(`[
+		{"date":"2021-01-05T00:00:00Z","amount":-4000,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"learn-signature"},
+		{"date":"2021-01-10T00:00:00Z","amount":-4000,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"learn-signature"}
+	]`)
+
+	// nothing to update before the first evaluation
+	if _, ok := _remembered(journalModule.dbInstance, "learn-signature"); ok {
+		t.Fatal("Expected no model before the first evaluation")
+	}
+
+	journalHttpRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("HEAD", "/journal/learn-signature", nil))
+
+	before, _ := _remembered(journalModule.dbInstance, "learn-signature")
+
+	write(`[
+		{"date":"2021-02-10T00:00:00Z","amount":-4500,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"learn-signature"},
+		{"date":"2021-02-11T00:00:00Z","amount":-1000,"label":"Abonamente","sender":"Me","receiver":"Spotify","signature":"learn-signature"}
+	]`)
+
+	after, ok := _remembered(journalModule.dbInstance, "learn-signature")
+	if !ok {
+		t.Fatal("Expected model to be kept in memory")
+	}
+
+	if len(after.records) != len(before.records)+2 {
+		t.Fatalf("Expected 2 more records after write but got %d and %d", len(before.records), len(after.records))
+	}
+
+	features, ok := after.patterns["sender=Me receiver=Netflix"]
+	if !ok || len(features) != 1 {
+		t.Fatalf("Expected one Netflix feature to be updated but got %v", features)
+	}
+
+	if len(features[0].Amounts) != 2 || features[0].Months[0] != time.February {
+		t.Fatalf("Expected consecutive months to update the same feature but got %+v", features[0])
+	}
+
+	if _, ok := after.patterns["sender=Me receiver=Spotify"]; !ok {
+		t.Fatal("Expected a new party to be learned without evaluation")
+	}
+
+	if _, ok := before.patterns["sender=Me receiver=Spotify"]; ok {
+		t.Fatal("Expected previous model to stay untouched")
+	}
+
+	buf := httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/journal/learn-signature/rebuild", nil))
+
+	if reply := buf.Result(); reply.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 OK for background rebuild but got %v", reply.StatusCode)
+	}
+}
+
+func TestIncrementalUpdateAfterRestart(t *testing.T) {
+	write := func(payload string) {
+		buf := httptest.NewRecorder()
+		journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/registry/transactions", strings.NewReader(payload)))
+
+		if reply := buf.Result(); reply.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 OK after POST but got %v", reply.StatusCode)
+		}
+	}
+
+	write(`[
+		{"date":"2021-01-05T00:00:00Z","amount":-4000,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"relearn-signature"},
+		{"date":"2021-02-05T00:00:00Z","amount":-4000,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"relearn-signature"},
+		{"date":"2021-03-05T00:00:00Z","amount":-4000,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"relearn-signature"},
+		{"date":"2021-03-07T00:00:00Z","amount":-1000,"label":"Abonamente","sender":"Me","receiver":"Spotify","signature":"relearn-signature"},
+		{"date":"2021-04-05T00:00:00Z","amount":-4000,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"relearn-signature"}
+	]`)
+
+	journalHttpRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("HEAD", "/journal/relearn-signature", nil))
+	_forget(journalModule.dbInstance, "relearn-signature") // pretend the process was restarted
+
+	write(`[
+		{"date":"2021-05-05T00:00:00Z","amount":-4000,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"relearn-signature"}
+	]`)
+
+	var model journalModel
+	if err := journalModule.dbInstance.First(&model, "signature = ?", "relearn-signature").Error; err != nil {
+		t.Fatal(err)
+	} else if model.Records != 6 {
+		t.Fatalf("Expected persisted model of all 6 records but got %d", model.Records)
+	}
+
+	buf := httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("GET", "/journal/relearn-signature/download", nil))
+
+	body, _ := io.ReadAll(buf.Result().Body)
+	if lines := strings.Split(strings.Trim(string(body), "\n"), "\n"); len(lines) != 7 {
+		t.Fatalf("Expected header and 6 records after restart but got %q", body)
+	}
+
+	rs, _ := _remembered(journalModule.dbInstance, "relearn-signature")
+
+	learned := func(patterns tendency) (n int) {
+		for _, feature := range patterns["sender=Me receiver=Netflix"] {
+			n += len(feature.Amounts)
+		}
+		return
+	}
+
+	if expected := learned(_compute(rs.records)); learned(rs.patterns) != expected {
+		t.Fatalf("Expected every Netflix transaction learned once (%d) but got %d", expected, learned(rs.patterns))
+	}
+}
+
+func TestExplainedPredictions(t *testing.T) {
+	buf := httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/registry/transactions", strings.NewReader(`[
+		{"date":"2021-01-05T00:00:00Z","amount":-12000,"label":"Abonamente","sender":"Me","receiver":"Digi","signature":"explain-signature"},
+		{"date":"2021-02-05T00:00:00Z","amount":-12500,"label":"Abonamente","sender":"Me","receiver":"Digi","signature":"explain-signature"},
+		{"date":"2021-03-05T00:00:00Z","amount":-12000,"label":"Abonamente","sender":"Me","receiver":"Digi","signature":"explain-signature"}
+	]`)))
+
+	if reply := buf.Result(); reply.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 OK after POST but got %v", reply.StatusCode)
+	}
+
+	journalHttpRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("HEAD", "/journal/explain-signature", nil))
+
+	buf = httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/journal/explain-signature", strings.NewReader(`[
+		{"sender":"Me","receiver":"Digi","amount":-12200,"date":"2021-04-05T00:00:00Z"}
+	]`)))
+
+	var outcome []statement
+	body, _ := io.ReadAll(buf.Result().Body)
+	if err := json.Unmarshal(body, &outcome); err != nil || len(outcome) != 1 {
+		t.Fatalf("Expected one statement but got %s", body)
+	}
+
+	// the model learned a feature per month from the two older records
+	reasons, ok := outcome[0].Explained["Abonamente"]
+	if !ok || len(reasons) != 2 {
+		t.Fatalf("Expected two explained features of Abonamente but got %s", body)
+	}
+
+	reason := reasons[0]
+	if reason.Amount == nil || reason.Amount.Kind != AMOUNT_APPROXIMATION || reason.Amount.Min != 12000 || reason.Amount.Max != 13000 {
+		t.Fatalf("Expected amount to match the approximate range but got %+v", reason.Amount)
+	}
+
+	if reason.Day != 5 || reason.Month != "" || reason.Weekday != "" {
+		t.Fatalf("Expected only the day of month to match beside the amount, got %+v", reason)
+	}
+
+	if len(reason.History.Amounts) != 1 || reason.History.Outgoing != 1 || reason.History.Months[0] != "February" {
+		t.Fatalf("Expected history of the feature but got %+v", reason.History)
+	}
+
+	if reasons[1].Amount != nil || reasons[1].Day != 5 {
+		t.Fatalf("Expected only the day of month to match the other feature but got %+v", reasons[1])
+	}
+
+	if points := outcome[0].Calculated["Abonamente"]; points[1] != 1 || points[4] != 2 {
+		t.Fatalf("Expected explanations to agree with points but got %v", points)
+	}
+}
+
+func TestDownloadFormatsAndFilters(t *testing.T) {
+	buf := httptest.NewRecorder()
+	journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/registry/transactions", strings.NewReader(`[
+		{"date":"2021-01-05T00:00:00Z","amount":-4099,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"download-signature"},
+		{"date":"2021-02-05T00:00:00Z","amount":-4099,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"download-signature"},
+		{"date":"2021-03-05T18:00:00Z","amount":-5,"label":"Comisioane","sender":"Me","receiver":"Bank","signature":"download-signature"}
+	]`)))
+
+	if reply := buf.Result(); reply.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 OK after POST but got %v", reply.StatusCode)
+	}
+
+	download := func(query string) (string, *http.Response) {
+		buf := httptest.NewRecorder()
+		journalHttpRouter.ServeHTTP(buf, httptest.NewRequest("GET", "/journal/download-signature/download"+query, nil))
+
+		body, _ := io.ReadAll(buf.Result().Body)
+		return string(body), buf.Result()
+	}
+
+	// no evaluation before, the download runs it
+	body, _ := download("?sep=%3B&from=2021-02-01")
+	lines := strings.Split(strings.Trim(body, "\n"), "\n")
+
+	if len(lines) != 3 || lines[0] != "sender;receiver;label;date;amount;parent" {
+		t.Fatalf("Expected header and two records since February but got %q", body)
+	}
+
+	if !strings.HasPrefix(lines[1], "Me;Bank;Comisioane;2021-03-05;-0,05;") || !strings.HasPrefix(lines[2], "Me;Netflix;Abonamente;2021-02-05;-40,99;") {
+		t.Fatalf("Expected ISO dates and decimal amounts for ro_RO but got %q", body)
+	}
+
+	body, reply := download("?format=ndjson&to=2021-02-28")
+	if reply.Header.Get("Content-Type") != "application/x-ndjson; charset=utf-8" {
+		t.Fatalf("Expected NDJSON content type but got %s", reply.Header.Get("Content-Type"))
+	}
+
+	lines = strings.Split(strings.Trim(body, "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected two records until March but got %q", body)
+	}
+
+	if body, _ := download("?to=2021-03-05"); len(strings.Split(strings.Trim(body, "\n"), "\n")) != 4 {
+		t.Fatalf("Expected the evening of the last day to be included but got %q", body)
+	}
+
+	var row struct {
+		Date   string  `json:"date"`
+		Amount float64 `json:"amount"`
+	}
+
+	if err := json.Unmarshal([]byte(lines[0]), &row); err != nil || row.Date != "2021-02-05" || row.Amount != -40.99 {
+		t.Fatalf("Expected a JSON object per line but got %q", lines[0])
+	}
+
+	var rows []exportedRecord
+	body, _ = download("?format=json")
+	if err := json.Unmarshal([]byte(body), &rows); err != nil || len(rows) != 3 || rows[2].Amount != "-40.99" {
+		t.Fatalf("Expected all records as JSON but got %q", body)
+	}
+
+	if body, _ := download("?sep=semicolon"); !strings.HasPrefix(body, "sender;receiver;") {
+		t.Fatalf("Expected semicolon to be spelled out too but got %q", body)
+	}
+
+	for _, query := range []string{"?format=xml", "?sep=|", "?from=March"} {
+		if _, reply := download(query); reply.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 Bad Request for %s but got %v", query, reply.StatusCode)
 		}
 	}
 }
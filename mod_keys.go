@@ -0,0 +1,433 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"gorm.io/gorm"
+)
+
+type keys struct {
+	dbInstance  *gorm.DB
+	dbBatchSize int
+}
+
+func (k keys) Install() error {
+	return k.dbInstance.AutoMigrate(&apiKey{})
+}
+
+func (k keys) Setup(router *mux.Router) {
+	router.HandleFunc("/keys", k.list).Methods(http.MethodGet)
+	router.HandleFunc("/keys", k.create).Methods(http.MethodPost)
+	router.HandleFunc("/keys/{id:[0-9]+}", k.revoke).Methods(http.MethodDelete)
+}
+
+// apiKey is only stored as a hash, the key itself is shown once on create;
+// scopes are space separated like headers
+type apiKey struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	Name       string     `json:"name" gorm:"type: varchar(100); not null"`
+	Household  string     `json:"household" gorm:"type: varchar(20); not null"`
+	Prefix     string     `json:"prefix" gorm:"type: varchar(12); not null"`
+	Hash       string     `json:"-" gorm:"type: varchar(64); uniqueIndex; not null"`
+	Scopes     string     `json:"scopes" gorm:"type: text; not null"`
+	CreatedAt  time.Time  `json:"created" gorm:"autoCreateTime"`
+	LastUsedAt *time.Time `json:"last_used"`
+	RevokedAt  *time.Time `json:"revoked"`
+}
+
+const (
+	SCOPE_REGISTRY = "registry"
+	SCOPE_JOURNAL  = "journal"
+	SCOPE_BACKUP   = "backup"
+	SCOPE_ADMIN    = "admin"
+
+	SCOPE_READ  = "read"
+	SCOPE_WRITE = "write"
+)
+
+const (
+	KEY_PREFIX      = "gsp_"
+	KEY_SIZE        = 24 // random bytes
+	KEY_USED_UPDATE = time.Minute
+)
+
+// scopeModules map the first segment of a route to the module of its scope,
+// routes not listed here require the admin scope
+var scopeModules = map[string]string{
+	"registry":   SCOPE_REGISTRY,
+	"transfers":  SCOPE_REGISTRY,
+	"budgets":    SCOPE_REGISTRY,
+	"insights":   SCOPE_REGISTRY,
+	"templates":  SCOPE_REGISTRY,
+	"signatures": SCOPE_REGISTRY,
+	"grants":     SCOPE_REGISTRY,
+	"journal":    SCOPE_JOURNAL,
+	"jobs":       SCOPE_JOURNAL,
+	"backup":     SCOPE_BACKUP,
+}
+
+// _parseScopes validates scopes as module:read, module:write or admin
+func _parseScopes(value string) ([]string, error) {
+	scopes := strings.Fields(value)
+	if len(scopes) == 0 {
+		return nil, errors.New("a key must have at least one scope")
+	}
+
+	for _, scope := range scopes {
+		if scope == SCOPE_ADMIN {
+			continue
+		}
+
+		parts := strings.SplitN(scope, ":", 2)
+		if len(parts) != 2 || (parts[1] != SCOPE_READ && parts[1] != SCOPE_WRITE) {
+			return nil, fmt.Errorf("scope must be module:read, module:write or admin, got %q", scope)
+		}
+
+		switch parts[0] {
+		case SCOPE_REGISTRY, SCOPE_JOURNAL, SCOPE_BACKUP, SCOPE_ADMIN:
+		default:
+			return nil, fmt.Errorf("unknown module %q in scope %q", parts[0], scope)
+		}
+	}
+
+	return scopes, nil
+}
+
+// principal is the identity of an authenticated request, its household is
+// empty for the default one
+type principal struct {
+	KeyID     uint     `json:"key"`
+	Name      string   `json:"name"`
+	Household string   `json:"household"`
+	Scopes    []string `json:"scopes"`
+}
+
+// Can tells if the principal has access to a module; writing implies reading
+func (p principal) Can(module string, write bool) bool {
+	for _, scope := range p.Scopes {
+		if scope == SCOPE_ADMIN || scope == module+":"+SCOPE_WRITE || (!write && scope == module+":"+SCOPE_READ) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type principalKey struct{}
+
+func _withPrincipal(rq *http.Request, p principal) *http.Request {
+	return rq.WithContext(context.WithValue(rq.Context(), principalKey{}, p))
+}
+
+// _principalOf returns the identity of a request, if it was authenticated
+func _principalOf(rq *http.Request) (principal, bool) {
+	p, ok := rq.Context().Value(principalKey{}).(principal)
+	return p, ok
+}
+
+func _hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// _scopeOf returns the module a request needs access to and if it writes
+func _scopeOf(rq *http.Request) (string, bool) {
+	module, ok := scopeModules[_segmentOf(rq)]
+	if !ok {
+		module = SCOPE_ADMIN
+	}
+
+	return module, rq.Method != http.MethodGet && rq.Method != http.MethodHead
+}
+
+// _segmentOf returns the first segment of a route, e.g. journal
+func _segmentOf(rq *http.Request) string {
+	path := strings.TrimPrefix(strings.TrimPrefix(rq.URL.Path, API_PREFIX), "/")
+	return strings.SplitN(path, "/", 2)[0]
+}
+
+// _bearerOf reads the key of a request from the Authorization or X-Api-Key
+func _bearerOf(rq *http.Request) string {
+	if auth := rq.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+
+	return rq.Header.Get("X-Api-Key")
+}
+
+// _authenticate finds the active key of a request
+func _authenticate(db *gorm.DB, rq *http.Request) (principal, error) {
+	bearer := _bearerOf(rq)
+	if bearer == "" {
+		return principal{}, errors.New("missing api key")
+	}
+
+	var key apiKey
+	if err := db.Where("hash = ? and revoked_at is null", _hashKey(bearer)).Take(&key).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return principal{}, errors.New("invalid api key")
+	} else if err != nil {
+		return principal{}, err
+	}
+
+	if now := time.Now(); key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > KEY_USED_UPDATE {
+		db.Model(&key).Update("last_used_at", now)
+	}
+
+	return principal{KeyID: key.ID, Name: key.Name, Household: key.Household, Scopes: strings.Fields(key.Scopes)}, nil
+}
+
+// Authenticate is a middleware which requires an api key with the scope of
+// the module of the route, and puts the principal of the key on the request
+func (k keys) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, rq *http.Request) {
+		response := Response{wr}
+
+		p, err := _authenticate(k.dbInstance, rq)
+		if err != nil {
+			response.Unauthorized(err, rq)
+			return
+		}
+
+		if module, write := _scopeOf(rq); !p.Can(module, write) {
+			access := SCOPE_READ
+			if write {
+				access = SCOPE_WRITE
+			}
+
+			reason := fmt.Sprintf("key %q has no %s:%s scope", p.Name, module, access)
+			response.Forbidden(accessDenied{Reason: reason, Principal: p.Name, Required: module + ":" + access}, rq)
+			return
+		}
+
+		next.ServeHTTP(wr, _withPrincipal(rq, p))
+	})
+}
+
+// _createKey stores a new key of a household and returns it, the only time
+// it's available
+func _createKey(db *gorm.DB, name, scopes, householdID string) (apiKey, string, error) {
+	parsed, err := _parseScopes(scopes)
+	if err != nil {
+		return apiKey{}, "", err
+	}
+
+	if name = strings.TrimSpace(name); name == "" {
+		return apiKey{}, "", errors.New("a key must have a name")
+	}
+
+	if householdID != "" {
+		if err := db.Take(&household{}, "id = ?", householdID).Error; err != nil {
+			return apiKey{}, "", fmt.Errorf("household %s not found", householdID)
+		}
+	}
+
+	random := make([]byte, KEY_SIZE)
+	if _, err := rand.Read(random); err != nil {
+		return apiKey{}, "", err
+	}
+
+	secret := KEY_PREFIX + hex.EncodeToString(random)
+	key := apiKey{
+		Name:      name,
+		Household: householdID,
+		Prefix:    secret[:12],
+		Hash:      _hashKey(secret),
+		Scopes:    strings.Join(parsed, " "),
+	}
+
+	return key, secret, db.Create(&key).Error
+}
+
+func _revokeKey(db *gorm.DB, id uint) (apiKey, error) {
+	var key apiKey
+	if err := db.Take(&key, id).Error; err != nil {
+		return key, err
+	}
+
+	if key.RevokedAt == nil {
+		now := time.Now()
+		key.RevokedAt = &now
+		return key, db.Model(&key).Update("revoked_at", now).Error
+	}
+
+	return key, nil
+}
+
+func (k keys) list(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	list := make([]apiKey, 0)
+	if err := k.dbInstance.Order("id").Find(&list).Error; err != nil {
+		response.Fault(err, rq)
+	} else if output, err := json.Marshal(list); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
+
+func (k keys) create(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	var payload struct {
+		Name      string `json:"name"`
+		Scopes    string `json:"scopes"`
+		Household string `json:"household"`
+	}
+
+	if body, err := ioutil.ReadAll(rq.Body); err != nil { // TODO: avoid ioutil because of memory issues?
+		response.Fault(err, rq)
+		return
+	} else if err := json.Unmarshal(body, &payload); err != nil {
+		response.Wrong(err, rq)
+		return
+	}
+
+	key, secret, err := _createKey(k.dbInstance, payload.Name, payload.Scopes, payload.Household)
+	if err != nil {
+		response.Wrong(err, rq)
+		return
+	}
+
+	created := struct {
+		apiKey
+		Key string `json:"key"`
+	}{key, secret}
+
+	if output, err := json.Marshal(created); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
+
+func (k keys) revoke(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	params := mux.Vars(rq)
+	id, _ := strconv.ParseUint(params["id"], 10, 32)
+
+	if key, err := _revokeKey(k.dbInstance, uint(id)); errors.Is(err, gorm.ErrRecordNotFound) {
+		response.Missing(fmt.Errorf("key %d not found", id), rq)
+	} else if err != nil {
+		response.Fault(err, rq)
+	} else if output, err := json.Marshal(key); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
+
+// Command manages keys from the shell: keys create|list|revoke
+func (k keys) Command(arguments []string, out io.Writer) error {
+	usage := errors.New("usage: keys create -name NAME -scopes \"module:read module:write admin\" [-household ID] | keys list | keys revoke ID")
+	if len(arguments) == 0 {
+		return usage
+	}
+
+	switch arguments[0] {
+	case "create":
+		flags := flag.NewFlagSet("keys create", flag.ContinueOnError)
+		name := flags.String("name", "", "name of the key, e.g. who uses it")
+		scopes := flags.String("scopes", "", "space separated scopes, e.g. \"journal:read registry:write\"")
+		hh := flags.String("household", "", "household of the key, the default one if empty")
+		if err := flags.Parse(arguments[1:]); err != nil {
+			return err
+		}
+
+		key, secret, err := _createKey(k.dbInstance, *name, *scopes, *hh)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "Created key %d (%s) with scopes %q:\n%s\n", key.ID, key.Name, key.Scopes, secret)
+		fmt.Fprintln(out, "NOTICE: the key is not stored and cannot be shown again")
+	case "list":
+		var list []apiKey
+		if err := k.dbInstance.Order("id").Find(&list).Error; err != nil {
+			return err
+		}
+
+		table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "ID\tNAME\tHOUSEHOLD\tPREFIX\tSCOPES\tCREATED\tLAST USED\tREVOKED")
+		for _, key := range list {
+			fmt.Fprintf(table, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", key.ID, key.Name, key.Household, key.Prefix, key.Scopes,
+				key.CreatedAt.Format(time.RFC3339), _formatOptionalTime(key.LastUsedAt), _formatOptionalTime(key.RevokedAt))
+		}
+
+		return table.Flush()
+	case "revoke":
+		if len(arguments) != 2 {
+			return usage
+		}
+
+		id, err := strconv.ParseUint(arguments[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("key id must be a number, got %q", arguments[1])
+		}
+
+		if key, err := _revokeKey(k.dbInstance, uint(id)); err != nil {
+			return err
+		} else {
+			fmt.Fprintf(out, "Revoked key %d (%s)\n", key.ID, key.Name)
+		}
+	default:
+		return usage
+	}
+
+	return nil
+}
+
+func _formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+var (
+	keysDBInstance = sqlite.Open("file:keys?mode=memory&cache=shared")
+	keysHttpRouter *mux.Router
+	keysModule     keys
+)
+
+func init() {
+	if db, err := gorm.Open(keysDBInstance, &gorm.Config{}); err != nil {
+		panic(err)
+	} else {
+		keysHttpRouter = mux.NewRouter()
+		keysModule = keys{db, 10}
+
+		if err := keysModule.Install(); err != nil {
+			panic(err)
+		}
+
+		whoami := func(wr http.ResponseWriter, rq *http.Request) {
+			p, _ := _principalOf(rq)
+			output, _ := json.Marshal(p)
+			Response{wr}.Okay(output, false, 0, rq)
+		}
+
+		keysHttpRouter.Use(keysModule.Authenticate)
+		keysHttpRouter.HandleFunc("/journal/{signature}", whoami).Methods(http.MethodGet, http.MethodPost)
+		keysHttpRouter.HandleFunc("/registry/transactions", whoami).Methods(http.MethodGet, http.MethodPost)
+		keysModule.Setup(keysHttpRouter)
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	if scopes, err := _parseScopes(" journal:read  registry:write admin "); err != nil || len(scopes) != 3 {
+		t.Fatalf("Expected 3 valid scopes but got %v (%v)", scopes, err)
+	}
+
+	for _, invalid := range []string{"", "journal", "journal:delete", "wallet:read"} {
+		if _, err := _parseScopes(invalid); err == nil {
+			t.Fatalf("Expected %q to be an invalid scope", invalid)
+		}
+	}
+
+	p := principal{Scopes: []string{"journal:read", "registry:write"}}
+	if !p.Can(SCOPE_JOURNAL, false) || p.Can(SCOPE_JOURNAL, true) || !p.Can(SCOPE_REGISTRY, false) || p.Can(SCOPE_ADMIN, false) {
+		t.Fatalf("Expected read on journal and write on registry only for %v", p.Scopes)
+	}
+}
+
+func TestKeysAuthentication(t *testing.T) {
+	_, reader, err := _createKey(keysModule.dbInstance, "reader", "journal:read", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, admin, err := _createKey(keysModule.dbInstance, "admin", "admin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(method, target, key string, status int) *httptest.ResponseRecorder {
+		rq := httptest.NewRequest(method, target, strings.NewReader(`{"name":"ci","scopes":"registry:write"}`))
+		if key != "" {
+			rq.Header.Set("Authorization", "Bearer "+key)
+		}
+
+		buf := httptest.NewRecorder()
+		keysHttpRouter.ServeHTTP(buf, rq)
+
+		if reply := buf.Result(); reply.StatusCode != status {
+			t.Fatalf("Expected %d for %s %s but got %v", status, method, target, reply.StatusCode)
+		}
+
+		return buf
+	}
+
+	serve("GET", "/journal/test-signature", "", http.StatusUnauthorized)
+	serve("GET", "/journal/test-signature", "gsp_invalid", http.StatusUnauthorized)
+	serve("POST", "/journal/test-signature", reader, http.StatusForbidden)
+	serve("GET", "/registry/transactions", reader, http.StatusForbidden)
+	serve("GET", "/keys", reader, http.StatusForbidden)
+
+	var p principal
+	if err := json.NewDecoder(serve("GET", "/journal/test-signature", reader, http.StatusOK).Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Name != "reader" || len(p.Scopes) != 1 {
+		t.Fatalf("Expected principal of the reader key but got %+v", p)
+	}
+
+	var created struct {
+		ID  uint   `json:"id"`
+		Key string `json:"key"`
+	}
+
+	if err := json.NewDecoder(serve("POST", "/keys", admin, http.StatusOK).Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	serve("POST", "/registry/transactions", created.Key, http.StatusOK)
+	serve("DELETE", fmt.Sprintf("/keys/%d", created.ID), admin, http.StatusOK)
+	serve("POST", "/registry/transactions", created.Key, http.StatusUnauthorized)
+}
+
+func TestKeysCommand(t *testing.T) {
+	var out bytes.Buffer
+
+	if err := keysModule.Command([]string{"create", "-name", "backups", "-scopes", "backup:write"}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), KEY_PREFIX) {
+		t.Fatalf("Expected the new key to be shown but got %q", out.String())
+	}
+
+	out.Reset()
+	if err := keysModule.Command([]string{"list"}, &out); err != nil || !strings.Contains(out.String(), "backups") {
+		t.Fatalf("Expected backups key to be listed but got %q (%v)", out.String(), err)
+	}
+
+	if err := keysModule.Command([]string{"revoke", "nope"}, &out); err == nil {
+		t.Fatal("Expected revoke to fail without a numeric id")
+	}
+
+	if err := keysModule.Command([]string{"rotate"}, &out); err == nil {
+		t.Fatal("Expected unknown command to fail")
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"gorm.io/gorm"
+)
+
+// metrics exposes counters, gauges and histograms of the process in the
+// Prometheus text format, for dashboards and alerts; with authentication the
+// scrape needs an admin key which doesn't belong to a household
+type metrics struct {
+	dbInstance   *gorm.DB
+	dbBatchSize  int
+	authenticate bool
+}
+
+func (m metrics) Setup(router *mux.Router) {
+	if m.authenticate {
+		router.Handle("/metrics", keys{m.dbInstance, m.dbBatchSize}.Authenticate(http.HandlerFunc(m.restrict))).Methods(http.MethodGet)
+	} else {
+		router.HandleFunc("/metrics", m.scrape).Methods(http.MethodGet)
+	}
+}
+
+// restrict lets only keys outside of households scrape, since the metrics
+// cover every household
+func (m metrics) restrict(wr http.ResponseWriter, rq *http.Request) {
+	if p, ok := _principalOf(rq); !ok || p.Household != "" {
+		reason := fmt.Sprintf("key %q belongs to a household", p.Name)
+		Response{wr}.Forbidden(accessDenied{Reason: reason, Principal: p.Name, Required: SCOPE_ADMIN}, rq)
+		return
+	}
+
+	m.scrape(wr, rq)
+}
+
+// latency buckets in seconds, requests are mostly cached or small while
+// journal evaluations go through all transactions of a signature
+var (
+	HTTP_BUCKETS       = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	EVALUATION_BUCKETS = []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300}
+)
+
+var (
+	httpRequests         = newCounterVec("method", "route", "status")
+	httpDurations        = newHistogramVec(HTTP_BUCKETS, "method", "route", "status")
+	cacheLookups         = newCounterVec("result")
+	importedTransactions = newCounterVec("source")
+	backupOperations     = newCounterVec("operation", "result")
+	evaluationDurations  = newHistogramVec(EVALUATION_BUCKETS)
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// _labels renders label pairs as name="value",... without braces
+func _labels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(value))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// _braced wraps rendered label pairs for a sample, if any
+func _braced(pairs ...string) string {
+	var nonEmpty []string
+	for _, p := range pairs {
+		if p != "" {
+			nonEmpty = append(nonEmpty, p)
+		}
+	}
+
+	if len(nonEmpty) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(nonEmpty, ",") + "}"
+}
+
+func _float(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type counterVec struct {
+	lock   sync.Mutex
+	names  []string
+	values map[string]float64 // by rendered labels
+}
+
+func newCounterVec(names ...string) *counterVec {
+	return &counterVec{names: names, values: make(map[string]float64)}
+}
+
+func (c *counterVec) Add(delta float64, values ...string) {
+	key := _labels(c.names, values)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.values[key] += delta
+}
+
+func (c *counterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *counterVec) Value(values ...string) float64 {
+	key := _labels(c.names, values)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.values[key]
+}
+
+func (c *counterVec) Write(w io.Writer, name, help string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", name, _braced(key), _float(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64 // by bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	lock    sync.Mutex
+	names   []string
+	buckets []float64
+	series  map[string]*histogram // by rendered labels
+}
+
+func newHistogramVec(buckets []float64, names ...string) *histogramVec {
+	return &histogramVec{names: names, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) Observe(value float64, values ...string) {
+	key := _labels(h.names, values)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+
+	s.counts[sort.SearchFloat64s(h.buckets, value)]++
+	s.sum += value
+	s.count++
+}
+
+func (h *histogramVec) Write(w io.Writer, name, help string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s, cumulative := h.series[key], uint64(0)
+		for i := range s.counts {
+			upper := math.Inf(1)
+			if i < len(h.buckets) {
+				upper = h.buckets[i]
+			}
+
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, _braced(key, _labels([]string{"le"}, []string{_float(upper)})), cumulative)
+		}
+
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, _braced(key), _float(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, _braced(key), s.count)
+	}
+}
+
+func _gauge(w io.Writer, name, help string, samples map[string]float64) {
+	_samples(w, name, help, "gauge", samples)
+}
+
+// _samples writes metrics which are read when scraped rather than kept
+func _samples(w io.Writer, name, help, kind string, samples map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+
+	keys := make([]string, 0, len(samples))
+	for key := range samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", name, _braced(key), _float(samples[key]))
+	}
+}
+
+// statusRecorder keeps the status of a response for the request metrics
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Instrument is a middleware which counts requests and their latency by
+// route template, so paths with signatures or ids don't explode the series
+func (m metrics) Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, rq *http.Request) {
+		startTime := time.Now()
+		recorder := &statusRecorder{wr, http.StatusOK}
+
+		next.ServeHTTP(recorder, rq)
+
+		route := rq.URL.Path
+		if current := mux.CurrentRoute(rq); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		status := strconv.Itoa(recorder.status)
+		httpRequests.Inc(rq.Method, route, status)
+		httpDurations.Observe(time.Since(startTime).Seconds(), rq.Method, route, status)
+	})
+}
+
+func (m metrics) scrape(wr http.ResponseWriter, rq *http.Request) {
+	var out bytes.Buffer
+
+	build := _labels([]string{"version", "build", "driver", "license", "platform"}, []string{VERSION, BUILD, DRIVER, LICENSE, OSARCH})
+	_gauge(&out, "gospodapi_build_info", "Build of the running process.", map[string]float64{build: 1})
+
+	httpRequests.Write(&out, "gospodapi_http_requests_total", "HTTP requests by route and status.")
+	httpDurations.Write(&out, "gospodapi_http_request_duration_seconds", "HTTP request latency by route and status.")
+
+	registryRoutesLock.RLock()
+	cached := len(registryRoutesCache)
+	registryRoutesLock.RUnlock()
+
+	cacheLookups.Write(&out, "gospodapi_cache_lookups_total", "Response cache lookups by result (hit or miss).")
+	_gauge(&out, "gospodapi_cache_entries", "Responses held by the cache.", map[string]float64{"": float64(cached)})
+
+	if db, err := m.dbInstance.DB(); err == nil {
+		stats := db.Stats()
+		_gauge(&out, "gospodapi_db_connections", "Database connections by state.", map[string]float64{
+			`state="idle"`:   float64(stats.Idle),
+			`state="in_use"`: float64(stats.InUse),
+		})
+		_gauge(&out, "gospodapi_db_connections_max", "Maximum number of open database connections (0 is unlimited).", map[string]float64{"": float64(stats.MaxOpenConnections)})
+		_samples(&out, "gospodapi_db_wait_total", "Connections waited for.", "counter", map[string]float64{"": float64(stats.WaitCount)})
+		_samples(&out, "gospodapi_db_wait_seconds_total", "Time spent waiting for connections.", "counter", map[string]float64{"": stats.WaitDuration.Seconds()})
+		_samples(&out, "gospodapi_db_closed_total", "Connections closed by reason.", "counter", map[string]float64{
+			`reason="max_idle"`:      float64(stats.MaxIdleClosed),
+			`reason="max_idle_time"`: float64(stats.MaxIdleTimeClosed),
+			`reason="max_lifetime"`:  float64(stats.MaxLifetimeClosed),
+		})
+	}
+
+	// signatures are named by users, so they're summed up by household
+	signatures, records, features := make(map[string]float64), make(map[string]float64), make(map[string]float64)
+	usage := memory.Usage("")
+	memory.Each(func(key scoped, rs, fs int) {
+		pairs := _labels([]string{"household"}, []string{strings.TrimSuffix(strings.TrimPrefix(key.tenant, "h_"), "_")})
+		signatures[pairs]++
+		records[pairs] += float64(rs)
+		features[pairs] += float64(fs)
+	})
+
+	_gauge(&out, "gospodapi_journal_signatures", "Journal models held in memory.", signatures)
+	_gauge(&out, "gospodapi_journal_records", "Records of journal models held in memory.", records)
+	_gauge(&out, "gospodapi_journal_features", "Features of journal models held in memory.", features)
+	_gauge(&out, "gospodapi_journal_memory_held", "Records and features held by the journal.", map[string]float64{"": float64(usage.Held)})
+	_gauge(&out, "gospodapi_journal_memory_limit", "Records and features the journal can hold (0 is unlimited).", map[string]float64{"": float64(usage.Limit)})
+	evaluationDurations.Write(&out, "gospodapi_journal_evaluation_seconds", "Duration of journal evaluations.")
+
+	importedTransactions.Write(&out, "gospodapi_imported_transactions_total", "Transactions written by source.")
+	backupOperations.Write(&out, "gospodapi_backups_total", "Backups saved and restored by result.")
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	_gauge(&out, "go_goroutines", "Number of goroutines.", map[string]float64{"": float64(runtime.NumGoroutine())})
+	_gauge(&out, "go_memstats_heap_alloc_bytes", "Bytes of allocated heap objects.", map[string]float64{"": float64(mem.HeapAlloc)})
+	_gauge(&out, "go_memstats_sys_bytes", "Bytes obtained from the system.", map[string]float64{"": float64(mem.Sys)})
+
+	wr.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	wr.Write(out.Bytes())
+}
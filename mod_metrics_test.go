@@ -0,0 +1,168 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := newCounterVec("source")
+	c.Inc("registry")
+	c.Add(2, "registry")
+	c.Inc(`say "hi"`)
+
+	var out bytes.Buffer
+	c.Write(&out, "test_total", "Test counter.")
+
+	expected := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{source="registry"} 3
+test_total{source="say \"hi\""} 1
+`
+	if out.String() != expected {
+		t.Fatalf("Expected counter output\n%s\nbut got\n%s", expected, out.String())
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := newHistogramVec([]float64{0.1, 1})
+	for _, value := range []float64{0.05, 0.1, 0.5, 3} {
+		h.Observe(value)
+	}
+
+	var out bytes.Buffer
+	h.Write(&out, "test_seconds", "Test histogram.")
+
+	expected := `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 2
+test_seconds_bucket{le="1"} 3
+test_seconds_bucket{le="+Inf"} 4
+test_seconds_sum 3.65
+test_seconds_count 4
+`
+	if out.String() != expected {
+		t.Fatalf("Expected histogram output\n%s\nbut got\n%s", expected, out.String())
+	}
+}
+
+func TestMetricsScrape(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:metrics?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	module := metrics{db, 10, false}
+	router := mux.NewRouter()
+	router.Use(module.Instrument)
+	router.HandleFunc("/things/{id}", func(wr http.ResponseWriter, rq *http.Request) {
+		if mux.Vars(rq)["id"] == "missing" {
+			wr.WriteHeader(http.StatusNotFound)
+		}
+	})
+	module.Setup(router)
+
+	for _, id := range []string{"1", "2", "missing"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/things/"+id, nil))
+	}
+
+	buf := httptest.NewRecorder()
+	router.ServeHTTP(buf, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := buf.Result().Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Expected Prometheus text format but got %s", ct)
+	}
+
+	output := buf.Body.String()
+	for _, expected := range []string{
+		`gospodapi_http_requests_total{method="GET",route="/things/{id}",status="200"} 2`,
+		`gospodapi_http_requests_total{method="GET",route="/things/{id}",status="404"} 1`,
+		`gospodapi_http_request_duration_seconds_count{method="GET",route="/things/{id}",status="200"} 2`,
+		`gospodapi_build_info{version="` + VERSION + `"`,
+		`# TYPE gospodapi_cache_lookups_total counter`,
+		`gospodapi_db_connections{state="idle"}`,
+		`# TYPE gospodapi_journal_evaluation_seconds histogram`,
+		`gospodapi_journal_memory_limit `,
+		`# TYPE gospodapi_backups_total counter`,
+		`go_goroutines `,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Fatalf("Expected metrics to contain %q but got\n%s", expected, output)
+		}
+	}
+}
+
+func TestMetricsAuthenticated(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:metricsauth?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := db.AutoMigrate(&apiKey{}, &household{}); err != nil {
+		t.Fatal(err)
+	} else if err := db.Create(&household{ID: "smith", Name: "Smith", Resources: "ro_RO"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	metrics{db, 10, true}.Setup(router)
+
+	scrape := func(key string, status int) {
+		rq := httptest.NewRequest("GET", "/metrics", nil)
+		if key != "" {
+			rq.Header.Set("Authorization", "Bearer "+key)
+		}
+
+		buf := httptest.NewRecorder()
+		if router.ServeHTTP(buf, rq); buf.Code != status {
+			t.Fatalf("Expected %d from scrape but got %d", status, buf.Code)
+		}
+	}
+
+	keyOf := func(name, scopes, householdID string) string {
+		_, key, err := _createKey(db, name, scopes, householdID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return key
+	}
+
+	scrape("", http.StatusUnauthorized)
+	scrape(keyOf("clerk", "registry:read journal:read", ""), http.StatusForbidden)
+	scrape(keyOf("smith", "admin", "smith"), http.StatusForbidden)
+	scrape(keyOf("root", "admin", ""), http.StatusOK)
+}
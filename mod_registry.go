@@ -31,6 +31,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -48,6 +49,7 @@ func (r registry) Setup(router *mux.Router) {
 	router.HandleFunc("/registry/transactions", r.writeJsonTransactions).Methods(http.MethodPost)
 	router.HandleFunc("/registry/transactions", r.readJsonTransactions).Methods(http.MethodGet)
 	router.HandleFunc("/registry/transactions/{year:[0-9]{4}}/{month:[0-9]{2}}", r.readJsonMonthlyTransactions).Methods(http.MethodGet)
+	router.HandleFunc("/registry/transactions/dedupe", r.dedupe).Methods(http.MethodPost)
 
 	router.HandleFunc("/registry/labels", r.writeJsonLabels).Methods(http.MethodPost)
 	router.HandleFunc("/registry/labels", r.readJsonLabels).Methods(http.MethodGet)
@@ -56,7 +58,48 @@ func (r registry) Setup(router *mux.Router) {
 	router.HandleFunc("/registry/actors", r.readJsonActors).Methods(http.MethodGet)
 }
 
-var registryRoutesCache = make(map[string][]byte)
+var (
+	registryRoutesCache = make(map[scoped][]byte)
+	registryRoutesLock  sync.RWMutex
+)
+
+// the response cache is shared by http handlers and background routines, so
+// every access must go through these helpers
+
+func _cacheLoad(key scoped) ([]byte, bool) {
+	registryRoutesLock.RLock()
+	defer registryRoutesLock.RUnlock()
+
+	out, ok := registryRoutesCache[key]
+	if ok {
+		cacheLookups.Inc("hit")
+	} else {
+		cacheLookups.Inc("miss")
+	}
+
+	return out, ok
+}
+
+func _cacheStore(key scoped, out []byte) {
+	registryRoutesLock.Lock()
+	defer registryRoutesLock.Unlock()
+
+	registryRoutesCache[key] = out
+}
+
+func _cacheDrop(key scoped) {
+	registryRoutesLock.Lock()
+	defer registryRoutesLock.Unlock()
+
+	delete(registryRoutesCache, key)
+}
+
+func _cacheReset() {
+	registryRoutesLock.Lock()
+	defer registryRoutesLock.Unlock()
+
+	registryRoutesCache = make(map[scoped][]byte)
+}
 
 func (r registry) readJsonActors(wr http.ResponseWriter, rq *http.Request) {
 	ctx := expenses.PullContext{Storage: r.dbInstance, Limit: r.dbBatchSize}
@@ -67,7 +110,9 @@ func (r registry) readJsonActors(wr http.ResponseWriter, rq *http.Request) {
 func (r registry) writeJsonActors(wr http.ResponseWriter, rq *http.Request) {
 	ctx := expenses.PushContext{Storage: r.dbInstance, BatchSize: r.dbBatchSize}
 
-	_resolvePushRequest(&expenses.Actors{}, ctx, wr, rq)
+	if err := _resolvePushRequest(&expenses.Actors{}, ctx, wr, rq); err == nil {
+		_cacheReset() // reports like insights group transactions by actors
+	}
 }
 
 func (r registry) readJsonLabels(wr http.ResponseWriter, rq *http.Request) {
@@ -79,11 +124,13 @@ func (r registry) readJsonLabels(wr http.ResponseWriter, rq *http.Request) {
 func (r registry) writeJsonLabels(wr http.ResponseWriter, rq *http.Request) {
 	ctx := expenses.PushContext{Storage: r.dbInstance, BatchSize: r.dbBatchSize}
 
-	_resolvePushRequest(&expenses.Labels{}, ctx, wr, rq)
+	if err := _resolvePushRequest(&expenses.Labels{}, ctx, wr, rq); err == nil {
+		_cacheReset() // reports like insights group transactions by labels
+	}
 }
 
 func (r registry) readJsonTransactions(wr http.ResponseWriter, rq *http.Request) {
-	ctx := expenses.PullContext{Storage: r.dbInstance, Limit: r.dbBatchSize}
+	ctx := expenses.PullContext{Storage: _restrictedTo(rq, r.dbInstance), Limit: r.dbBatchSize}
 
 	_resolvePullRequest(&expenses.Transactions{}, ctx, wr, rq)
 }
@@ -98,28 +145,39 @@ func (r registry) readJsonMonthlyTransactions(wr http.ResponseWriter, rq *http.R
 	t0, t1 := period, period.AddDate(0, 1, -1)
 
 	ctx := expenses.PullContext{
-		Storage: r.dbInstance.Where("date between ? and ?", t0, t1),
+		Storage: _restrictedTo(rq, r.dbInstance).Where("date between ? and ?", t0, t1),
 		Limit:   r.dbBatchSize,
 	}
 
 	_resolvePullRequest(&expenses.Transactions{}, ctx, wr, rq)
 }
 
+// registryHooks are called after transactions are written to the registry,
+// e.g. the journal uses them to keep models current
+var registryHooks []func(*gorm.DB, expenses.Transactions)
+
 func (r registry) writeJsonTransactions(wr http.ResponseWriter, rq *http.Request) {
 	ctx := expenses.PushContext{Storage: r.dbInstance, BatchSize: r.dbBatchSize}
 
-	_resolvePushRequest(&expenses.Transactions{}, ctx, wr, rq)
+	reg := &expenses.Transactions{}
+	if err := _resolvePushRequest(reg, ctx, wr, rq); err == nil {
+		importedTransactions.Add(float64(len(*reg)), "registry")
+		for _, hook := range registryHooks {
+			hook(r.dbInstance, *reg)
+		}
+	}
 	// transactions push request(s) can create not only transactions (with details)
 	// but also new labels and new actors if necessary; for this reason it's safer
 	// to just recreate the entire cache table
-	registryRoutesCache = make(map[string][]byte)
+	_cacheReset()
 }
 
 func _resolvePullRequest(reg expenses.Registry, ctx expenses.PullContext, wr http.ResponseWriter, rq *http.Request) {
 	startTime := time.Now()
 	response := Response{wr}
 
-	if cached, ok := registryRoutesCache[rq.URL.Path]; ok {
+	key := _restrictedKey(rq, _scoped(ctx.Storage, rq.URL.Path))
+	if cached, ok := _cacheLoad(key); ok {
 		response.Okay(cached, true, time.Since(startTime), rq)
 		return // no need to continue
 	}
@@ -130,11 +188,11 @@ func _resolvePullRequest(reg expenses.Registry, ctx expenses.PullContext, wr htt
 		response.Fault(err, rq)
 	} else {
 		response.Okay(out, false, time.Since(startTime), rq)
-		registryRoutesCache[rq.URL.Path] = out
+		_cacheStore(key, out)
 	}
 }
 
-func _resolvePushRequest(reg expenses.Registry, ctx expenses.PushContext, wr http.ResponseWriter, rq *http.Request) {
+func _resolvePushRequest(reg expenses.Registry, ctx expenses.PushContext, wr http.ResponseWriter, rq *http.Request) error {
 	startTime := time.Now()
 	response := Response{wr}
 
@@ -142,11 +200,11 @@ func _resolvePushRequest(reg expenses.Registry, ctx expenses.PushContext, wr htt
 	payload, err := ioutil.ReadAll(rq.Body)
 	if err != nil { // TODO: avoid ioutil because of memory issues?
 		response.Wrong(err, rq)
-		return // wrong payload, don't continue
+		return err // wrong payload, don't continue
 	} else {
 		if err = expenses.FromJson(payload, reg); err != nil {
 			response.Wrong(err, rq)
-			return // wrong payload, can't continue
+			return err // wrong payload, can't continue
 		}
 	}
 
@@ -156,6 +214,83 @@ func _resolvePushRequest(reg expenses.Registry, ctx expenses.PushContext, wr htt
 		response.Fault(err, rq)
 	} else {
 		response.Okay(out, false, time.Since(startTime), rq)
-		delete(registryRoutesCache, rq.URL.Path)
+		_cacheDrop(_scoped(ctx.Storage, rq.URL.Path))
+	}
+
+	return err
+}
+
+// _signaturesByUUID maps the given transaction keys to the signatures they
+// are stored with, keys which are not stored yet are left out
+func _signaturesByUUID(db *gorm.DB, keys []string, batch int) (map[string]string, error) {
+	stored, err := _transactionsByUUID(db.Select("uuid", "signature"), keys, batch)
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make(map[string]string, len(stored))
+	for key, trx := range stored {
+		owners[key] = trx.Signature
+	}
+
+	return owners, nil
+}
+
+// _transactionsByUUID loads the stored transactions of the given keys in
+// batches, as narrowed down by db (e.g. selected columns or preloads)
+func _transactionsByUUID(db *gorm.DB, keys []string, batch int) (map[string]expenses.Transaction, error) {
+	stored := make(map[string]expenses.Transaction, len(keys))
+	if batch < 1 {
+		batch = len(keys)
+	}
+
+	for start := 0; start < len(keys); start += batch {
+		end := start + batch
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		var reg expenses.Transactions
+		if err := db.Where("uuid in ?", keys[start:end]).Find(&reg).Error; err != nil {
+			return nil, err
+		}
+
+		for _, trx := range reg {
+			stored[*trx.UUID] = trx
+		}
 	}
+
+	return stored, nil
+}
+
+// _labelParents maps every label name to its parent name, if any, so reports
+// can roll up amounts through the label hierarchy
+func _labelParents(db *gorm.DB) (map[string]string, error) {
+	var labels []expenses.Label
+	if err := db.Select("name", "parent_name").Find(&labels).Error; err != nil {
+		return nil, err
+	}
+
+	parents := make(map[string]string, len(labels))
+	for _, label := range labels {
+		if label.ParentName.Valid {
+			parents[label.Name] = label.ParentName.String
+		}
+	}
+
+	return parents, nil
+}
+
+// _labelLineage returns the label followed by all its ancestors; it stops on
+// circular references instead of looping forever
+func _labelLineage(parents map[string]string, label string) []string {
+	lineage := []string{label}
+	seen := map[string]bool{label: true}
+
+	for parent, ok := parents[label]; ok && !seen[parent]; parent, ok = parents[parent] {
+		lineage = append(lineage, parent)
+		seen[parent] = true
+	}
+
+	return lineage
 }
@@ -0,0 +1,272 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lexndru/expenses"
+
+	"gorm.io/gorm"
+)
+
+// default tolerance to look for duplicate transactions, see tolerance
+const (
+	DEDUPE_DAYS_TOLERANCE    = 2
+	DEDUPE_PERCENT_TOLERANCE = 0.05
+)
+
+type duplicate struct {
+	Transaction expenses.Transaction `json:"transaction"`
+	Grade       int                  `json:"grade"`
+	Days        int                  `json:"days"`
+	Amount      int64                `json:"amount"`
+}
+
+// duplicates are transactions between the same actors within tolerance of
+// each other; the one to keep is the most complete
+type duplicates struct {
+	Keep       expenses.Transaction `json:"keep"`
+	Duplicates []duplicate          `json:"duplicates"`
+}
+
+// dedupe previews duplicate transactions of a signature (or all) and merges
+// them into the one to keep when asked to with ?merge=true
+func (r registry) dedupe(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	tol, err := _dedupeTolerance(rq)
+	if err != nil {
+		response.Wrong(err, rq)
+		return
+	}
+
+	query := rq.URL.Query()
+	merge := query.Get("merge") == "true"
+
+	storage := r.dbInstance.Preload("Details")
+	if signature := query.Get("signature"); signature != "" {
+		storage = storage.Where("signature = ?", signature)
+	}
+
+	if r.dbInstance.Migrator().HasTable(&transfer{}) {
+		storage = _withoutTransfers(storage) // linked transfers are not duplicates
+	}
+
+	var reg expenses.Transactions
+	if err := storage.Order("date, created_at").Find(&reg).Error; err != nil {
+		response.Fault(err, rq)
+		return
+	}
+
+	groups := _findDuplicates(reg, tol)
+
+	var merged int
+	if merge && len(groups) > 0 {
+		signatures := make(map[string]bool)
+		err := r.dbInstance.Transaction(func(tx *gorm.DB) error {
+			for _, group := range groups {
+				n, err := _mergeDuplicates(tx, group)
+				if err != nil {
+					return err
+				}
+
+				merged += n
+				signatures[group.Keep.Signature] = true
+			}
+
+			if !tx.Migrator().HasTable(&journalModel{}) {
+				return nil
+			}
+
+			// persisted models learned the duplicates, so they're evaluated again
+			for signature := range signatures {
+				if err := tx.Where("signature = ?", signature).Delete(&journalModel{}).Error; err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			response.Fault(err, rq)
+			return
+		}
+
+		for signature := range signatures {
+			_forgetSignature(r.dbInstance, signature)
+		}
+
+		_cacheReset()
+	}
+
+	out := struct {
+		Groups []duplicates `json:"groups"`
+		Merged int          `json:"merged"`
+	}{groups, merged}
+
+	if output, err := json.Marshal(out); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
+
+func _dedupeTolerance(rq *http.Request) (tol tolerance, err error) {
+	tol = tolerance{Days: DEDUPE_DAYS_TOLERANCE, Percent: DEDUPE_PERCENT_TOLERANCE}
+	query := rq.URL.Query()
+
+	if value := query.Get("days"); value != "" {
+		if tol.Days, err = strconv.Atoi(value); err != nil || tol.Days < 0 {
+			return tol, fmt.Errorf("days must be a positive number, got %q", value)
+		}
+	}
+
+	if value := query.Get("amount"); value != "" {
+		if tol.Amount, err = strconv.ParseInt(value, 10, 64); err != nil || tol.Amount < 0 {
+			return tol, fmt.Errorf("amount must be a positive number, got %q", value)
+		}
+	}
+
+	if value := query.Get("percent"); value != "" {
+		if tol.Percent, err = strconv.ParseFloat(value, 64); err != nil || tol.Percent < 0 || tol.Percent > 1 {
+			return tol, fmt.Errorf("percent must be between 0 and 1, got %q", value)
+		}
+	}
+
+	return tol, nil
+}
+
+// _findDuplicates groups transactions sorted by date which are within the
+// tolerance of the first one of their group and between the same actors
+// (grade 3 or more); comparing with the first keeps chains of transactions,
+// each close to the next, from drifting beyond the tolerance
+func _findDuplicates(reg expenses.Transactions, tol tolerance) []duplicates {
+	grouped := make([]bool, len(reg))
+
+	var members [][]int
+	for i := range reg {
+		if grouped[i] {
+			continue
+		}
+
+		indexes := []int{i}
+		r := _fromTransaction(reg[i])
+		for j := i + 1; j < len(reg) && _daysBetween(reg[i].Date, reg[j].Date) <= tol.Days; j++ {
+			if grouped[j] || reg[i].Signature != reg[j].Signature {
+				continue
+			}
+
+			// label is ignored, duplicates are often labeled differently
+			if grade := r.CompareWithTolerance(reg[j], tol); grade&3 == 3 {
+				grouped[j] = true
+				indexes = append(indexes, j)
+			}
+		}
+
+		members = append(members, indexes)
+	}
+
+	groups := make([]duplicates, 0)
+	for _, indexes := range members {
+		if len(indexes) < 2 {
+			continue
+		}
+
+		sort.SliceStable(indexes, func(a, b int) bool {
+			return _moreComplete(reg[indexes[a]], reg[indexes[b]])
+		})
+
+		keep := reg[indexes[0]]
+		group := duplicates{Keep: keep}
+		for _, index := range indexes[1:] {
+			trx := reg[index]
+			group.Duplicates = append(group.Duplicates, duplicate{
+				Transaction: trx,
+				Grade:       _fromTransaction(keep).CompareWithTolerance(trx, tol),
+				Days:        _daysBetween(keep.Date, trx.Date),
+				Amount:      trx.Amount - keep.Amount,
+			})
+		}
+
+		groups = append(groups, group)
+	}
+
+	return groups
+}
+
+// _moreComplete prefers transactions with details, then labeled ones, then
+// the ones registered first
+func _moreComplete(a, b expenses.Transaction) bool {
+	if (len(a.Details) > 0) != (len(b.Details) > 0) {
+		return len(a.Details) > 0
+	}
+
+	labeledA := a.LabelName != "" && a.LabelName != UNNAMED_ENTRY
+	labeledB := b.LabelName != "" && b.LabelName != UNNAMED_ENTRY
+	if labeledA != labeledB {
+		return labeledA
+	}
+
+	return a.CreatedAt.Before(b.CreatedAt)
+}
+
+// _mergeDuplicates removes the duplicates of a group; the transaction kept
+// adopts the first label of a duplicate if it has none
+func _mergeDuplicates(tx *gorm.DB, group duplicates) (int, error) {
+	keys := make([]string, len(group.Duplicates))
+	label := group.Keep.LabelName
+
+	for i, dup := range group.Duplicates {
+		keys[i] = *dup.Transaction.UUID
+
+		if (label == "" || label == UNNAMED_ENTRY) && dup.Transaction.LabelName != UNNAMED_ENTRY {
+			label = dup.Transaction.LabelName
+		}
+	}
+
+	if label != group.Keep.LabelName {
+		if err := tx.Model(&expenses.Transaction{}).Where("uuid = ?", *group.Keep.UUID).Update("label_name", label).Error; err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Where("transaction_uuid in ?", keys).Delete(&expenses.Details{}).Error; err != nil {
+		return 0, err
+	}
+
+	res := tx.Where("uuid in ?", keys).Delete(&expenses.Transaction{})
+	return int(res.RowsAffected), res.Error
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lexndru/expenses"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+var (
+	dedupeDBInstance = sqlite.Open("file:dedupe?mode=memory&cache=shared")
+	dedupeHttpRouter *mux.Router
+	dedupeDB         *gorm.DB
+)
+
+func init() {
+	if db, err := gorm.Open(dedupeDBInstance, &gorm.Config{}); err != nil {
+		panic(err)
+	} else {
+		dedupeHttpRouter = mux.NewRouter()
+		dedupeDB = db
+
+		expenses.Install(db)
+
+		mod := registry{db, 10}
+		mod.Setup(dedupeHttpRouter)
+	}
+}
+
+func TestNormalizedActorNames(t *testing.T) {
+	names := map[string]string{
+		"  Ştefan  CEL Mare ": "stefan cel mare",
+		"ȘTEFAN cel mare":     "stefan cel mare",
+		"Băcănia Țării":       "bacania tarii",
+		"Înghețată\tâ":        "inghetata a",
+	}
+
+	for name, expected := range names {
+		if normalized := _normalizeName(name); normalized != expected {
+			t.Fatalf("Expected %q to be %q but got %q", name, expected, normalized)
+		}
+	}
+}
+
+func TestCompareWithTolerance(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2021, 5, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	r := record{Sender: "Me", Receiver: "Ştefan Pizza", Label: "Restaurant", Date: day(1), Amount: -4300}
+	trx := expenses.Transaction{SenderName: "me", ReceiverName: "ștefan  pizza", LabelName: "?", Date: day(3), Amount: -4500}
+
+	if grade := r.CompareWithTransaction(trx); grade != 0 {
+		t.Fatalf("Expected no exact similarity but got %d", grade)
+	}
+
+	if grade := r.CompareWithTolerance(trx, tolerance{Days: 2, Percent: 0.05}); grade != 3 {
+		t.Fatalf("Expected same actors within tolerance but got %d", grade)
+	}
+
+	if grade := r.CompareWithTolerance(trx, tolerance{Days: 1, Percent: 0.05}); grade != 0 {
+		t.Fatalf("Expected nothing out of days tolerance but got %d", grade)
+	}
+
+	if grade := r.CompareWithTolerance(trx, tolerance{Days: 2, Amount: 100}); grade != 0 {
+		t.Fatalf("Expected nothing out of amount tolerance but got %d", grade)
+	}
+
+	trx.Amount = 4500
+	if grade := r.CompareWithTolerance(trx, tolerance{Days: 2, Amount: 10000}); grade != 0 {
+		t.Fatalf("Expected nothing for amounts of opposite sign but got %d", grade)
+	}
+}
+
+func TestDedupeTransactions(t *testing.T) {
+	buf := httptest.NewRecorder()
+	dedupeHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/registry/transactions", strings.NewReader(`[
+		{"uuid":"5d1c7d10-0000-4000-8000-000000000001","date":"2021-05-01T00:00:00Z","amount":-4300,"label":"Restaurant","sender":"Me","receiver":"Ştefan Pizza","signature":"dedupe-signature"},
+		{"uuid":"5d1c7d10-0000-4000-8000-000000000002","date":"2021-05-03T00:00:00Z","amount":-4500,"label":"?","sender":"me","receiver":"ștefan  pizza","signature":"dedupe-signature"},
+		{"uuid":"5d1c7d10-0000-4000-8000-000000000003","date":"2021-05-03T00:00:00Z","amount":-4500,"label":"?","sender":"Me","receiver":"Kaufland","signature":"dedupe-signature"},
+		{"uuid":"5d1c7d10-0000-4000-8000-000000000004","date":"2021-05-20T00:00:00Z","amount":-4500,"label":"?","sender":"Me","receiver":"Ştefan Pizza","signature":"dedupe-signature"},
+		{"uuid":"5d1c7d10-0000-4000-8000-000000000005","date":"2021-05-05T00:00:00Z","amount":-4000,"label":"?","sender":"Me","receiver":"Netflix","signature":"dedupe-signature"},
+		{"uuid":"5d1c7d10-0000-4000-8000-000000000006","date":"2021-05-05T00:00:00Z","amount":-4000,"label":"?","sender":"Me","receiver":"Netflix","signature":"dedupe-signature"},
+		{"uuid":"5d1c7d10-0000-4000-8000-000000000007","date":"2021-05-05T00:00:00Z","amount":-4000,"label":"?","sender":"Me","receiver":"Netflix","signature":"other-signature"}
+	]`)))
+
+	if reply := buf.Result(); reply.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 OK after POST but got %v", reply.StatusCode)
+	}
+
+	type outcome struct {
+		Groups []duplicates `json:"groups"`
+		Merged int          `json:"merged"`
+	}
+
+	dedupe := func(query string) (out outcome) {
+		buf := httptest.NewRecorder()
+		dedupeHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/registry/transactions/dedupe"+query, nil))
+
+		if reply := buf.Result(); reply.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 OK after dedupe but got %v", reply.StatusCode)
+		}
+
+		body, _ := io.ReadAll(buf.Result().Body)
+		if err := json.Unmarshal(body, &out); err != nil {
+			t.Fatal(err)
+		}
+
+		return
+	}
+
+	count := func() (n int64) {
+		dedupeDB.Model(&expenses.Transaction{}).Count(&n)
+		return
+	}
+
+	preview := dedupe("?signature=dedupe-signature")
+	if len(preview.Groups) != 2 || preview.Merged != 0 || count() != 7 {
+		t.Fatalf("Expected 2 groups of duplicates and nothing merged but got %+v", preview)
+	}
+
+	pizza := preview.Groups[0]
+	if *pizza.Keep.UUID != "5d1c7d10-0000-4000-8000-000000000001" || len(pizza.Duplicates) != 1 {
+		t.Fatalf("Expected labeled transaction to be kept but got %+v", pizza)
+	}
+
+	if dup := pizza.Duplicates[0]; dup.Days != 2 || dup.Amount != -200 || dup.Grade != 3 {
+		t.Fatalf("Expected tip and posting delay of the duplicate but got %+v", dup)
+	}
+
+	if strict := dedupe("?signature=dedupe-signature&days=0&percent=0"); len(strict.Groups) != 1 {
+		t.Fatalf("Expected only exact duplicates without tolerance but got %+v", strict.Groups)
+	}
+
+	// the journal learned the duplicates before they're merged
+	if err := dedupeDB.AutoMigrate(&journalModel{}); err != nil {
+		t.Fatal(err)
+	} else if err := _persist(dedupeDB, "dedupe-signature", results{}); err != nil {
+		t.Fatal(err)
+	}
+
+	_memorize(dedupeDB, "dedupe-signature", results{})
+
+	if merged := dedupe("?signature=dedupe-signature&merge=true"); merged.Merged != 2 || count() != 5 {
+		t.Fatalf("Expected 2 duplicates to be merged but got %d and %d left", merged.Merged, count())
+	}
+
+	if _, ok := _recall(dedupeDB, "dedupe-signature"); ok {
+		t.Fatal("Expected the journal to forget a model learned with duplicates")
+	}
+
+	if again := dedupe("?signature=dedupe-signature"); len(again.Groups) != 0 {
+		t.Fatalf("Expected no more duplicates after merge but got %+v", again.Groups)
+	}
+
+	buf = httptest.NewRecorder()
+	dedupeHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/registry/transactions/dedupe?percent=2", nil))
+	if reply := buf.Result(); reply.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 Bad Request for wrong tolerance but got %v", reply.StatusCode)
+	}
+}
+
+func TestDedupeChainWithinTolerance(t *testing.T) {
+	buf := httptest.NewRecorder()
+	dedupeHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/registry/transactions", strings.NewReader(`[
+		{"date":"2021-06-01T00:00:00Z","amount":-2000,"label":"?","sender":"Me","receiver":"Bakery","signature":"chain-signature"},
+		{"date":"2021-06-03T00:00:00Z","amount":-2000,"label":"?","sender":"Me","receiver":"Bakery","signature":"chain-signature"},
+		{"date":"2021-06-05T00:00:00Z","amount":-2000,"label":"?","sender":"Me","receiver":"Bakery","signature":"chain-signature"}
+	]`)))
+
+	if reply := buf.Result(); reply.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 OK after POST but got %v", reply.StatusCode)
+	}
+
+	buf = httptest.NewRecorder()
+	dedupeHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/registry/transactions/dedupe?signature=chain-signature&days=2", nil))
+
+	var out struct {
+		Groups []duplicates `json:"groups"`
+	}
+
+	if err := json.NewDecoder(buf.Result().Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	// the last one is 4 days after the first, so it's not a duplicate of it
+	if len(out.Groups) != 1 || len(out.Groups[0].Duplicates) != 1 || out.Groups[0].Duplicates[0].Days != 2 {
+		t.Fatalf("Expected only the first two transactions grouped but got %+v", out.Groups)
+	}
+}
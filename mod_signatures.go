@@ -0,0 +1,458 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lexndru/expenses"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type signatures struct {
+	dbInstance  *gorm.DB
+	dbBatchSize int
+}
+
+func (s signatures) Install() error {
+	return s.dbInstance.AutoMigrate(&signatureMetadata{})
+}
+
+func (s signatures) Setup(router *mux.Router) {
+	router.HandleFunc("/signatures", s.list).Methods(http.MethodGet)
+	router.HandleFunc("/signatures/{signature:[a-z0-9-]+}", s.read).Methods(http.MethodGet)
+	router.HandleFunc("/signatures/{signature:[a-z0-9-]+}", s.write).Methods(http.MethodPut)
+	router.HandleFunc("/signatures/{signature:[a-z0-9-]+}", s.delete).Methods(http.MethodDelete)
+	router.HandleFunc("/signatures/{signature:[a-z0-9-]+}/rename", s.rename).Methods(http.MethodPost)
+	router.HandleFunc("/signatures/{signature:[a-z0-9-]+}/merge", s.merge).Methods(http.MethodPost)
+}
+
+// signatureMetadata describes a signature, which otherwise is just a column
+// on transactions and every other signature bound table
+type signatureMetadata struct {
+	Signature   string    `json:"signature" gorm:"type: varchar(36); primaryKey"`
+	DisplayName string    `json:"display_name" gorm:"type: varchar(100); not null"`
+	Currency    string    `json:"currency" gorm:"type: varchar(3); not null"`
+	Timezone    string    `json:"timezone" gorm:"type: varchar(64); not null"`
+	Owner       string    `json:"owner" gorm:"type: varchar(100); not null"`
+	CreatedAt   time.Time `json:"-" gorm:"autoCreateTime"`
+	UpdatedAt   time.Time `json:"-" gorm:"autoUpdateTime"`
+}
+
+var (
+	signaturePattern = regexp.MustCompile(`^[a-z0-9-]{1,36}$`)
+	currencyPattern  = regexp.MustCompile(`^[A-Z]{3}$`)
+)
+
+func (m *signatureMetadata) BeforeSave(tx *gorm.DB) error {
+	if m.Currency != "" && !currencyPattern.MatchString(m.Currency) {
+		return fmt.Errorf("currency must be an ISO 4217 code, got %q", m.Currency)
+	}
+
+	if _, err := time.LoadLocation(m.Timezone); err != nil {
+		return fmt.Errorf("unknown timezone %q", m.Timezone)
+	}
+
+	return nil
+}
+
+// signatureSummary is the metadata of a signature with the totals of its
+// transactions and the dates of the first and last one
+type signatureSummary struct {
+	signatureMetadata
+
+	Count   int64      `json:"count"`
+	Income  int64      `json:"income"`
+	Expense int64      `json:"expense"`
+	Net     int64      `json:"net"`
+	First   *time.Time `json:"first"`
+	Last    *time.Time `json:"last"`
+}
+
+// _signatureTables are the models bound to a signature, other than the
+// registry transactions, which are installed
+func _signatureTables(db *gorm.DB) []interface{} {
+	tables := make([]interface{}, 0)
+
+	for _, model := range []interface{}{&journalModel{}, &journalSetting{}, &journalFeedback{}, &recurrence{}, &signatureMetadata{}, &grant{}} {
+		if db.Migrator().HasTable(model) {
+			tables = append(tables, model)
+		}
+	}
+
+	return tables
+}
+
+// _summarize returns the summaries of the given signatures, or of all known
+// signatures if none are given, sorted by name
+func _summarize(db *gorm.DB, names ...string) ([]signatureSummary, error) {
+	var totals []insight
+
+	query := db.Model(&expenses.Transaction{}).Select("signature as name, " + insightColumns).Group("signature")
+	if len(names) > 0 {
+		query = query.Where("signature in ?", names)
+	}
+
+	if err := query.Scan(&totals).Error; err != nil {
+		return nil, err
+	}
+
+	var metadata []signatureMetadata
+	query = db.Model(&signatureMetadata{})
+	if len(names) > 0 {
+		query = query.Where("signature in ?", names)
+	}
+
+	if err := query.Find(&metadata).Error; err != nil {
+		return nil, err
+	}
+
+	summaries := make(map[string]*signatureSummary)
+	for _, m := range metadata {
+		summaries[m.Signature] = &signatureSummary{signatureMetadata: m}
+	}
+
+	for _, t := range totals {
+		summary, ok := summaries[t.Name]
+		if !ok {
+			summary = &signatureSummary{signatureMetadata: signatureMetadata{Signature: t.Name}}
+			summaries[t.Name] = summary
+		}
+
+		summary.Count, summary.Income, summary.Expense, summary.Net = t.Count, t.Income, t.Expense, t.Net
+
+		// dates are read one by one because min and max lose the column type
+		// on some drivers and come back as text
+		var first, last expenses.Transaction
+		if err := db.Where("signature = ?", t.Name).Order("date").Take(&first).Error; err != nil {
+			return nil, err
+		}
+
+		if err := db.Where("signature = ?", t.Name).Order("date DESC").Take(&last).Error; err != nil {
+			return nil, err
+		}
+
+		summary.First, summary.Last = &first.Date, &last.Date
+	}
+
+	list := make([]signatureSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		list = append(list, *summary)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Signature < list[j].Signature
+	})
+
+	return list, nil
+}
+
+// _signatureExists is true if there are transactions or metadata of it
+func _signatureExists(db *gorm.DB, signature string) (bool, error) {
+	var count int64
+
+	if err := db.Model(&expenses.Transaction{}).Where("signature = ?", signature).Count(&count).Error; err != nil || count > 0 {
+		return count > 0, err
+	}
+
+	err := db.Model(&signatureMetadata{}).Where("signature = ?", signature).Count(&count).Error
+	return count > 0, err
+}
+
+// _forgetSignature drops everything kept in memory about a signature once
+// its rows changed
+func _forgetSignature(db *gorm.DB, signature string) {
+	_forget(db, signature)
+	_forgetFeedback(db, signature)
+	_forgetClassifier(db, signature)
+}
+
+// _renameSignature moves all rows of a signature to another one, which must
+// not exist yet
+func _renameSignature(tx *gorm.DB, from, to string) error {
+	if err := tx.Model(&expenses.Transaction{}).Where("signature = ?", from).Update("signature", to).Error; err != nil {
+		return err
+	}
+
+	for _, model := range _signatureTables(tx) {
+		if err := tx.Model(model).Where("signature = ?", from).Update("signature", to).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// _mergeSignature moves all transactions, feedback and templates of a
+// signature into another one; models of both are dropped to be recomputed
+// and the target keeps its own settings and metadata if it has any
+func _mergeSignature(tx *gorm.DB, from, into string) error {
+	if err := tx.Model(&expenses.Transaction{}).Where("signature = ?", from).Update("signature", into).Error; err != nil {
+		return err
+	}
+
+	for _, model := range _signatureTables(tx) {
+		var err error
+
+		switch model.(type) {
+		case *journalModel:
+			err = tx.Where("signature in ?", []string{from, into}).Delete(model).Error
+		case *journalSetting, *signatureMetadata:
+			var count int64
+			if err = tx.Model(model).Where("signature = ?", into).Count(&count).Error; err != nil {
+				break
+			} else if count > 0 {
+				err = tx.Where("signature = ?", from).Delete(model).Error
+			} else {
+				err = tx.Model(model).Where("signature = ?", from).Update("signature", into).Error
+			}
+		case *grant:
+			// keys granted on both keep their role on the target
+			keys := tx.Model(model).Select("key_id").Where("signature = ?", into)
+			if err = tx.Where("signature = ? and key_id in (?)", from, keys).Delete(model).Error; err == nil {
+				err = tx.Model(model).Where("signature = ?", from).Update("signature", into).Error
+			}
+		default:
+			err = tx.Model(model).Where("signature = ?", from).Update("signature", into).Error
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// _deleteSignature deletes all transactions of a signature with their
+// details and transfer links, and all rows bound to it
+func _deleteSignature(tx *gorm.DB, signature string) (int64, error) {
+	keys := tx.Model(&expenses.Transaction{}).Select("uuid").Where("signature = ?", signature)
+
+	if err := tx.Where("transaction_uuid in (?)", keys).Delete(&expenses.Details{}).Error; err != nil {
+		return 0, err
+	}
+
+	if tx.Migrator().HasTable(&transfer{}) {
+		if err := tx.Where("outgoing_uuid in (?) or incoming_uuid in (?)", keys, keys).Delete(&transfer{}).Error; err != nil {
+			return 0, err
+		}
+	}
+
+	res := tx.Where("signature = ?", signature).Delete(&expenses.Transaction{})
+	if res.Error != nil {
+		return 0, res.Error
+	}
+
+	for _, model := range _signatureTables(tx) {
+		if err := tx.Where("signature = ?", signature).Delete(model).Error; err != nil {
+			return 0, err
+		}
+	}
+
+	return res.RowsAffected, nil
+}
+
+func (s signatures) list(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	names, _ := _grantedSignatures(rq) // all unless restricted by grants
+	if list, err := _summarize(s.dbInstance, names...); err != nil {
+		response.Fault(err, rq)
+	} else if output, err := json.Marshal(list); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
+
+func (s signatures) read(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	params := mux.Vars(rq)
+	signature := params["signature"]
+
+	if list, err := _summarize(s.dbInstance, signature); err != nil {
+		response.Fault(err, rq)
+	} else if len(list) == 0 {
+		response.Missing(fmt.Errorf("signature %s not found", signature), rq)
+	} else if output, err := json.Marshal(list[0]); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
+
+func (s signatures) write(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	params := mux.Vars(rq)
+	signature := params["signature"]
+
+	var metadata signatureMetadata
+	if payload, err := ioutil.ReadAll(rq.Body); err != nil { // TODO: avoid ioutil because of memory issues?
+		response.Fault(err, rq)
+		return
+	} else if err := json.Unmarshal(payload, &metadata); err != nil {
+		response.Wrong(err, rq)
+		return
+	}
+
+	if !signaturePattern.MatchString(signature) {
+		response.Wrong(fmt.Errorf("signature must have at most 36 characters, got %q", signature), rq)
+		return
+	}
+
+	metadata.Signature = signature
+	if err := s.dbInstance.Clauses(clause.OnConflict{UpdateAll: true}).Create(&metadata).Error; err != nil {
+		response.Wrong(err, rq)
+	} else if output, err := json.Marshal(metadata); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(output, false, time.Since(startTime), rq)
+	}
+}
+
+// rename changes a signature to ?to across all tables in one transaction
+func (s signatures) rename(wr http.ResponseWriter, rq *http.Request) {
+	params := mux.Vars(rq)
+	signature, to := params["signature"], rq.URL.Query().Get("to")
+
+	if !signaturePattern.MatchString(to) || to == signature {
+		Response{wr}.Wrong(fmt.Errorf("to must be a new signature of at most 36 characters, got %q", to), rq)
+		return
+	}
+
+	s.change(wr, rq, "rename", to, func(tx *gorm.DB) error {
+		if exists, err := _signatureExists(tx, to); err != nil {
+			return err
+		} else if exists {
+			return errSignatureExists
+		}
+
+		return _renameSignature(tx, signature, to)
+	})
+}
+
+// merge moves everything of a signature into ?into in one transaction
+func (s signatures) merge(wr http.ResponseWriter, rq *http.Request) {
+	params := mux.Vars(rq)
+	signature, into := params["signature"], rq.URL.Query().Get("into")
+
+	if !signaturePattern.MatchString(into) || into == signature {
+		Response{wr}.Wrong(fmt.Errorf("into must be another signature, got %q", into), rq)
+		return
+	}
+
+	s.change(wr, rq, "merge", into, func(tx *gorm.DB) error {
+		return _mergeSignature(tx, signature, into)
+	})
+}
+
+func (s signatures) delete(wr http.ResponseWriter, rq *http.Request) {
+	s.change(wr, rq, "delete", "", func(tx *gorm.DB) error {
+		_, err := _deleteSignature(tx, mux.Vars(rq)["signature"])
+		return err
+	})
+}
+
+var (
+	errSignatureNotFound = errors.New("signature not found")
+	errSignatureExists   = errors.New("signature already exists, merge it instead")
+)
+
+// change runs fn in a transaction if the signature of the request exists,
+// audits it as action, then drops what's kept in memory about it and outputs
+// the summary of the resulting signature, if any
+func (s signatures) change(wr http.ResponseWriter, rq *http.Request, action, result string, fn func(tx *gorm.DB) error) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	params := mux.Vars(rq)
+	signature := params["signature"]
+
+	err := s.dbInstance.Transaction(func(tx *gorm.DB) error {
+		if exists, err := _signatureExists(tx, signature); err != nil {
+			return err
+		} else if !exists {
+			return errSignatureNotFound
+		}
+
+		if err := fn(tx); err != nil {
+			return err
+		}
+
+		if tx.Migrator().HasTable(&auditEntry{}) {
+			return _audit(tx, rq, action, signature, result)
+		}
+
+		return nil
+	})
+
+	switch {
+	case errors.Is(err, errSignatureNotFound):
+		response.Missing(fmt.Errorf("signature %s not found", signature), rq)
+		return
+	case errors.Is(err, errSignatureExists):
+		response.Wrong(err, rq)
+		return
+	case err != nil:
+		response.Fault(err, rq)
+		return
+	}
+
+	_forgetSignature(s.dbInstance, signature)
+	_forgetSignature(s.dbInstance, result)
+	_cacheReset()
+
+	output := []byte(fmt.Sprintf(`{"signature":%q,"deleted":true}`, signature))
+	if result != "" {
+		if list, err := _summarize(s.dbInstance, result); err != nil {
+			response.Fault(err, rq)
+			return
+		} else if output, err = json.Marshal(list[0]); err != nil {
+			response.Fault(err, rq)
+			return
+		}
+	}
+
+	response.Okay(output, false, time.Since(startTime), rq)
+}
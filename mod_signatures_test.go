@@ -0,0 +1,155 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/lexndru/expenses"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+var (
+	signaturesDBInstance = sqlite.Open("file:signatures?mode=memory&cache=shared")
+	signaturesHttpRouter *mux.Router
+	signaturesDB         *gorm.DB
+)
+
+func init() {
+	if db, err := gorm.Open(signaturesDBInstance, &gorm.Config{}); err != nil {
+		panic(err)
+	} else {
+		signaturesHttpRouter = mux.NewRouter()
+		signaturesDB = db
+
+		expenses.Install(db)
+
+		reg := registry{db, 10}
+		reg.Setup(signaturesHttpRouter)
+
+		for _, mod := range []interface{ Install() error }{journal{db, 10}, transfers{db, 10}, signatures{db, 10}} {
+			if err := mod.Install(); err != nil {
+				panic(err)
+			}
+		}
+
+		signatures{db, 10}.Setup(signaturesHttpRouter)
+	}
+}
+
+func TestSignatureManagement(t *testing.T) {
+	serve := func(method, target, body string, status int) []byte {
+		buf := httptest.NewRecorder()
+		signaturesHttpRouter.ServeHTTP(buf, httptest.NewRequest(method, target, strings.NewReader(body)))
+
+		reply := buf.Result()
+		if reply.StatusCode != status {
+			t.Fatalf("Expected %d after %s %s but got %v", status, method, target, reply.StatusCode)
+		}
+
+		output, _ := io.ReadAll(reply.Body)
+		return output
+	}
+
+	serve("POST", "/registry/transactions", `[
+		{"uuid":"5a9e0000-0000-4000-8000-000000000001","date":"2021-05-01T00:00:00Z","amount":250000,"label":"Salariu","sender":"Employer","receiver":"Me","signature":"sig-alpha"},
+		{"uuid":"5a9e0000-0000-4000-8000-000000000002","date":"2021-05-20T00:00:00Z","amount":-4000,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"sig-alpha"},
+		{"uuid":"5a9e0000-0000-4000-8000-000000000003","date":"2021-04-03T00:00:00Z","amount":-9000,"label":"Mâncare","sender":"Me","receiver":"Kaufland","signature":"sig-beta"},
+		{"uuid":"5a9e0000-0000-4000-8000-000000000004","date":"2021-06-03T00:00:00Z","amount":-1000,"label":"Mâncare","sender":"Me","receiver":"Kaufland","signature":"sig-gamma"}
+	]`, http.StatusOK)
+
+	signaturesDB.Create(&transfer{OutgoingUUID: "5a9e0000-0000-4000-8000-000000000004", IncomingUUID: "5a9e0000-0000-4000-8000-000000000001", Amount: 1000})
+	signaturesDB.Create(&journalFeedback{Signature: "sig-beta", Party: "Me Kaufland", Label: "Mâncare", Accepted: true})
+
+	serve("PUT", "/signatures/sig-alpha", `{"display_name":"Alpha","currency":"eur","timezone":"Europe/Bucharest"}`, http.StatusBadRequest)
+	serve("PUT", "/signatures/sig-alpha", `{"display_name":"Alpha","currency":"RON","timezone":"Mars/Olympus"}`, http.StatusBadRequest)
+	serve("PUT", "/signatures/sig-alpha", `{"display_name":"Alpha","currency":"RON","timezone":"Europe/Bucharest","owner":"alex"}`, http.StatusOK)
+	serve("PUT", "/signatures/sig-empty", `{"display_name":"Empty"}`, http.StatusOK)
+
+	var list []signatureSummary
+	if err := json.Unmarshal(serve("GET", "/signatures", "", http.StatusOK), &list); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 4 || list[0].Signature != "sig-alpha" || list[3].Signature != "sig-gamma" {
+		t.Fatalf("Expected 4 signatures sorted by name but got %+v", list)
+	}
+
+	alpha := list[0]
+	if alpha.DisplayName != "Alpha" || alpha.Count != 2 || alpha.Income != 250000 || alpha.Net != 246000 ||
+		alpha.First == nil || alpha.First.Day() != 1 || alpha.Last == nil || alpha.Last.Day() != 20 {
+		t.Fatalf("Expected metadata and totals of sig-alpha but got %+v", alpha)
+	}
+
+	if empty := list[2]; empty.Signature != "sig-empty" || empty.Count != 0 || empty.First != nil {
+		t.Fatalf("Expected metadata only signature without transactions but got %+v", empty)
+	}
+
+	serve("POST", "/signatures/sig-beta/rename?to=sig-alpha", "", http.StatusBadRequest)
+	serve("POST", "/signatures/sig-missing/rename?to=sig-delta", "", http.StatusNotFound)
+
+	var renamed signatureSummary
+	if err := json.Unmarshal(serve("POST", "/signatures/sig-beta/rename?to=sig-delta", "", http.StatusOK), &renamed); err != nil {
+		t.Fatal(err)
+	}
+
+	var feedback int64
+	signaturesDB.Model(&journalFeedback{}).Where("signature = ?", "sig-delta").Count(&feedback)
+
+	if renamed.Signature != "sig-delta" || renamed.Count != 1 || feedback != 1 {
+		t.Fatalf("Expected transactions and feedback renamed but got %+v and %d feedback", renamed, feedback)
+	}
+
+	var merged signatureSummary
+	if err := json.Unmarshal(serve("POST", "/signatures/sig-delta/merge?into=sig-alpha", "", http.StatusOK), &merged); err != nil {
+		t.Fatal(err)
+	}
+
+	if merged.Count != 3 || merged.DisplayName != "Alpha" || merged.First.Month() != 4 {
+		t.Fatalf("Expected sig-delta merged into sig-alpha but got %+v", merged)
+	}
+
+	serve("GET", "/signatures/sig-delta", "", http.StatusNotFound)
+	serve("DELETE", "/signatures/sig-gamma", "", http.StatusOK)
+	serve("GET", "/signatures/sig-gamma", "", http.StatusNotFound)
+
+	var transfers int64
+	signaturesDB.Model(&transfer{}).Count(&transfers)
+
+	if transfers != 0 {
+		t.Fatalf("Expected transfer links of deleted transactions to be deleted but got %d", transfers)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SD_LISTEN_FDS_START is the first file descriptor passed by systemd on
+// socket activation (see sd_listen_fds)
+const SD_LISTEN_FDS_START = 3
+
+// UNIX_SOCKET_PREFIX marks a -bind address as a unix domain socket path
+const UNIX_SOCKET_PREFIX = "unix:"
+
+// _listeners returns the sockets passed by systemd if activated, otherwise
+// it binds the address, either tcp or unix:/path/to/socket
+func _listeners(address string) ([]net.Listener, error) {
+	if activated, err := _activatedListeners(); err != nil || len(activated) > 0 {
+		return activated, err
+	}
+
+	if !strings.HasPrefix(address, UNIX_SOCKET_PREFIX) {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+
+		return []net.Listener{listener}, nil
+	}
+
+	path := strings.TrimPrefix(address, UNIX_SOCKET_PREFIX)
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path) // left behind by a process which didn't stop cleanly
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// the reverse proxy usually runs as another user of the same group
+	if err := os.Chmod(path, 0660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return []net.Listener{listener}, nil
+}
+
+// _activatedListeners returns the sockets systemd passed to this process,
+// if any; the environment is cleared so children don't inherit them
+func _activatedListeners() ([]net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	return _inheritedListeners(SD_LISTEN_FDS_START, count)
+}
+
+// _inheritedListeners turns count file descriptors from first on into
+// listeners, closing the descriptors which are duplicated by the listeners
+func _inheritedListeners(first, count int) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, count)
+
+	for fd := first; fd < first+count; fd++ {
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("listen-fd-%d", fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+
+			return nil, fmt.Errorf("cannot use socket %d passed by systemd: %s", fd, err)
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+// _notify sends a state to systemd (see sd_notify), e.g. READY=1; it's a
+// no-op unless the service is started with Type=notify
+func _notify(state string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:] // abstract namespace
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// _watchdogInterval is how often systemd expects keep-alive pings, or zero
+// if the watchdog is disabled (see sd_watchdog_enabled)
+func _watchdogInterval() (time.Duration, error) {
+	value := os.Getenv("WATCHDOG_USEC")
+	if value == "" {
+		return 0, nil
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil // meant for another process
+	}
+
+	usec, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, errors.New("WATCHDOG_USEC must be a positive number of microseconds")
+	}
+
+	return time.Duration(usec) * time.Microsecond, nil
+}
+
+// _watchdog pings systemd twice per interval until stopped
+func _watchdog(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := _notify("WATCHDOG=1"); err != nil {
+				log.Printf("warning: cannot ping systemd watchdog: %s\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestUnixSocketListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.sock")
+
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	listeners, err := _listeners(UNIX_SOCKET_PREFIX + path)
+	if err != nil {
+		t.Fatalf("Expected a stale socket to be replaced but got %v", err)
+	} else if len(listeners) != 1 {
+		t.Fatalf("Expected one listener but got %d", len(listeners))
+	}
+
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if mode := info.Mode().Perm(); mode != 0660 {
+		t.Fatalf("Expected socket mode 0660 but got %v", mode)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(wr http.ResponseWriter, rq *http.Request) {
+		wr.Write([]byte("pong"))
+	})}
+	go server.Serve(listeners[0])
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+
+	reply, err := client.Get("http://gospodapi/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reply.Body.Close()
+
+	if body, _ := ioutil.ReadAll(reply.Body); string(body) != "pong" {
+		t.Fatalf("Expected pong over the unix socket but got %q", body)
+	}
+}
+
+func TestActivatedListeners(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	if listeners, err := _activatedListeners(); err != nil || len(listeners) != 0 {
+		t.Fatalf("Expected sockets of another process to be ignored but got %v (%v)", listeners, err)
+	}
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	file, err := tcp.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the descriptor is closed once inherited, so it must not be owned by file
+	// too or it's closed again when file is collected, maybe reused by then
+	fd, err := syscall.Dup(int(file.Fd()))
+	if file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	listeners, err := _inheritedListeners(fd, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listeners[0].Close()
+
+	if listeners[0].Addr().String() != tcp.Addr().String() {
+		t.Fatalf("Expected inherited socket on %v but got %v", tcp.Addr(), listeners[0].Addr())
+	}
+
+	go func() {
+		if conn, err := listeners[0].Accept(); err == nil {
+			conn.Write([]byte("activated"))
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if body, _ := ioutil.ReadAll(conn); string(body) != "activated" {
+		t.Fatalf("Expected the inherited socket to accept connections but got %q", body)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	if sent, err := _notify("READY=1"); sent || err != nil {
+		t.Fatalf("Expected no notification without NOTIFY_SOCKET but got %v (%v)", sent, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	systemd, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer systemd.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	received := func() string {
+		buf := make([]byte, 256)
+		systemd.SetReadDeadline(time.Now().Add(time.Second))
+
+		n, err := systemd.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(buf[:n])
+	}
+
+	if sent, err := _notify("READY=1"); !sent || err != nil {
+		t.Fatalf("Expected notification to be sent but got %v (%v)", sent, err)
+	} else if state := received(); state != "READY=1" {
+		t.Fatalf("Expected READY=1 but got %q", state)
+	}
+
+	os.Setenv("WATCHDOG_USEC", "20000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	interval, err := _watchdogInterval()
+	if err != nil || interval != 20*time.Millisecond {
+		t.Fatalf("Expected a watchdog of 20ms but got %v (%v)", interval, err)
+	}
+
+	stop := make(chan struct{})
+	go _watchdog(interval, stop)
+	defer close(stop)
+
+	if state := received(); state != "WATCHDOG=1" {
+		t.Fatalf("Expected WATCHDOG=1 but got %q", state)
+	}
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	if interval, err := _watchdogInterval(); interval != 0 || err != nil {
+		t.Fatalf("Expected the watchdog of another process to be ignored but got %v (%v)", interval, err)
+	}
+}
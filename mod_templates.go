@@ -0,0 +1,560 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lexndru/expenses"
+
+	"gorm.io/gorm"
+)
+
+type templates struct {
+	dbInstance  *gorm.DB
+	dbBatchSize int
+	clock       func() time.Time
+}
+
+func (t templates) Install() error {
+	return t.dbInstance.AutoMigrate(&recurrence{})
+}
+
+func (t templates) Setup(router *mux.Router) {
+	router.HandleFunc("/templates", t.readJsonTemplates).Methods(http.MethodGet)
+	router.HandleFunc("/templates", t.writeJsonTemplates).Methods(http.MethodPost)
+	router.HandleFunc("/templates/run", t.run).Methods(http.MethodPost)
+	router.HandleFunc("/templates/{id:[0-9]+}", t.readJsonTemplate).Methods(http.MethodGet)
+	router.HandleFunc("/templates/{id:[0-9]+}", t.updateJsonTemplate).Methods(http.MethodPut)
+	router.HandleFunc("/templates/{id:[0-9]+}", t.deleteJsonTemplate).Methods(http.MethodDelete)
+	router.HandleFunc("/templates/{id:[0-9]+}/preview", t.preview).Methods(http.MethodGet)
+}
+
+// recurrence is a template for transactions which repeat on a schedule, e.g.
+// rent, utilities or subscriptions; the scheduler materializes every due
+// occurrence into the registry and remembers the last day it went through
+type recurrence struct {
+	ID           uint       `json:"id" gorm:"primaryKey"`
+	Name         string     `json:"name" gorm:"type: varchar(100); not null"`
+	Rule         string     `json:"rule" gorm:"type: varchar(200); not null"`
+	Start        time.Time  `json:"start" gorm:"type: date; not null"`
+	Until        *time.Time `json:"until" gorm:"type: date"`
+	Amount       int64      `json:"amount" gorm:"not null"`
+	LabelName    string     `json:"label" gorm:"not null"`
+	SenderName   string     `json:"sender" gorm:"not null"`
+	ReceiverName string     `json:"receiver" gorm:"not null"`
+	Signature    string     `json:"signature" gorm:"type: varchar(36); index; not null"`
+	Headers      string     `json:"headers" gorm:"type: text; not null"`
+	Paused       bool       `json:"paused" gorm:"not null"`
+	LastRun      *time.Time `json:"last_run" gorm:"type: date"`
+	CreatedAt    time.Time  `json:"-" gorm:"autoCreateTime"`
+	UpdatedAt    time.Time  `json:"-" gorm:"autoUpdateTime"`
+}
+
+func (r *recurrence) BeforeSave(tx *gorm.DB) (err error) {
+	if _, err = _parseRule(r.Rule); err != nil {
+		return
+	}
+
+	if r.Start.IsZero() {
+		return errors.New("template must have a start date")
+	}
+
+	if r.Amount == 0 {
+		return errors.New("template amount cannot be zero")
+	}
+
+	if r.Signature == "" {
+		return errors.New("template must have a signature")
+	}
+
+	return
+}
+
+// Transaction builds the transaction of an occurrence; the UUID is derived
+// from the template and the date so writing it twice is harmless
+func (r recurrence) Transaction(date time.Time) expenses.Transaction {
+	key := uuid.NewSHA1(uuid.NameSpaceOID, []byte(fmt.Sprintf("template=%d date=%s", r.ID, date.Format("2006-01-02")))).String()
+
+	return expenses.Transaction{
+		UUID:         &key,
+		Date:         date,
+		Amount:       r.Amount,
+		LabelName:    r.LabelName,
+		SenderName:   r.SenderName,
+		ReceiverName: r.ReceiverName,
+		Signature:    r.Signature,
+		Headers:      r.Headers,
+	}
+}
+
+const (
+	FREQ_DAILY   = "DAILY"
+	FREQ_WEEKLY  = "WEEKLY"
+	FREQ_MONTHLY = "MONTHLY"
+	FREQ_YEARLY  = "YEARLY"
+)
+
+// rrule is a subset of RFC 5545 recurrence rules, enough for common cases:
+//
+//	FREQ=MONTHLY;BYMONTHDAY=5                          monthly on day 5
+//	FREQ=WEEKLY;INTERVAL=2                             every two weeks
+//	FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1      last business day
+type rrule struct {
+	Freq     string
+	Interval int
+	MonthDay int
+	Weekdays []time.Weekday
+	SetPos   int
+}
+
+var rruleWeekdays = map[string]time.Weekday{
+	"MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday, "TH": time.Thursday,
+	"FR": time.Friday, "SA": time.Saturday, "SU": time.Sunday,
+}
+
+func _parseRule(value string) (rule rrule, err error) {
+	rule.Interval = 1
+
+	for _, part := range strings.Split(strings.ToUpper(strings.TrimSpace(value)), ";") {
+		if part == "" {
+			continue
+		}
+
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return rule, fmt.Errorf("malformed rule part %q", part)
+		}
+
+		switch kv[0] {
+		case "FREQ":
+			switch kv[1] {
+			case FREQ_DAILY, FREQ_WEEKLY, FREQ_MONTHLY, FREQ_YEARLY:
+				rule.Freq = kv[1]
+			default:
+				return rule, fmt.Errorf("unsupported rule frequency %q", kv[1])
+			}
+		case "INTERVAL":
+			if rule.Interval, err = strconv.Atoi(kv[1]); err != nil || rule.Interval < 1 {
+				return rule, fmt.Errorf("rule interval must be a positive number, got %q", kv[1])
+			}
+		case "BYMONTHDAY":
+			if rule.MonthDay, err = strconv.Atoi(kv[1]); err != nil || rule.MonthDay == 0 || rule.MonthDay < -31 || rule.MonthDay > 31 {
+				return rule, fmt.Errorf("rule month day must be between -31 and 31 except 0, got %q", kv[1])
+			}
+		case "BYDAY":
+			for _, name := range strings.Split(kv[1], ",") {
+				if weekday, ok := rruleWeekdays[name]; ok {
+					rule.Weekdays = append(rule.Weekdays, weekday)
+				} else {
+					return rule, fmt.Errorf("unsupported rule weekday %q", name)
+				}
+			}
+		case "BYSETPOS":
+			if rule.SetPos, err = strconv.Atoi(kv[1]); err != nil || rule.SetPos == 0 {
+				return rule, fmt.Errorf("rule set position must be a non-zero number, got %q", kv[1])
+			}
+		default:
+			return rule, fmt.Errorf("unsupported rule part %q", kv[0])
+		}
+	}
+
+	if rule.Freq == "" {
+		return rule, errors.New("rule must have a FREQ")
+	}
+
+	if rule.SetPos != 0 && (rule.Freq != FREQ_MONTHLY || len(rule.Weekdays) == 0) {
+		return rule, errors.New("rule BYSETPOS is supported only for monthly rules with BYDAY")
+	}
+
+	return rule, nil
+}
+
+func _day(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+func _clampDay(year int, month time.Month, day int) time.Time {
+	last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.Local).Day()
+
+	if day < 0 {
+		day = last + 1 + day
+	}
+
+	if day < 1 {
+		day = 1
+	} else if day > last {
+		day = last
+	}
+
+	return time.Date(year, month, day, 0, 0, 0, 0, time.Local)
+}
+
+// candidates returns the dates of the n-th period of a rule started at start
+func (r rrule) candidates(start time.Time, n int) []time.Time {
+	step := n * r.Interval
+	dates := make([]time.Time, 0, 1)
+
+	weekdays := r.Weekdays
+	if len(weekdays) == 0 {
+		weekdays = []time.Weekday{start.Weekday()}
+	}
+
+	switch r.Freq {
+	case FREQ_DAILY:
+		dates = append(dates, start.AddDate(0, 0, step))
+	case FREQ_WEEKLY:
+		monday := start.AddDate(0, 0, -((int(start.Weekday())+6)%7)+7*step)
+		for _, weekday := range weekdays {
+			dates = append(dates, monday.AddDate(0, 0, (int(weekday)+6)%7))
+		}
+	case FREQ_MONTHLY:
+		month := time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.Local).AddDate(0, step, 0)
+		if r.SetPos != 0 {
+			matches := make([]time.Time, 0)
+			for day := month; day.Month() == month.Month(); day = day.AddDate(0, 0, 1) {
+				for _, weekday := range weekdays {
+					if day.Weekday() == weekday {
+						matches = append(matches, day)
+					}
+				}
+			}
+
+			if pos := r.SetPos; pos > 0 && pos <= len(matches) {
+				dates = append(dates, matches[pos-1])
+			} else if pos < 0 && -pos <= len(matches) {
+				dates = append(dates, matches[len(matches)+pos])
+			}
+		} else if r.MonthDay != 0 {
+			dates = append(dates, _clampDay(month.Year(), month.Month(), r.MonthDay))
+		} else {
+			dates = append(dates, _clampDay(month.Year(), month.Month(), start.Day()))
+		}
+	case FREQ_YEARLY:
+		dates = append(dates, _clampDay(start.Year()+step, start.Month(), start.Day()))
+	}
+
+	sort.Slice(dates, func(i, j int) bool {
+		return dates[i].Before(dates[j])
+	})
+
+	return dates
+}
+
+// Occurrences lists the dates of a rule started at start which fall after the
+// given day and not later than until; a positive limit stops the list early
+func (r rrule) Occurrences(start, after, until time.Time, limit int) []time.Time {
+	start, after, until = _day(start), _day(after), _day(until)
+	dates := make([]time.Time, 0)
+
+	for n := 0; ; n++ {
+		candidates := r.candidates(start, n)
+		if len(candidates) == 0 && start.AddDate(0, n*r.Interval, 0).After(until) {
+			return dates // set positions out of range never match, e.g. 6th monday
+		}
+
+		for _, date := range candidates {
+			if date.After(until) {
+				return dates
+			}
+
+			if date.Before(start) || !date.After(after) {
+				continue
+			}
+
+			if dates = append(dates, date); limit > 0 && len(dates) >= limit {
+				return dates
+			}
+		}
+	}
+}
+
+// Materialize writes every due occurrence of every active template into the
+// registry; without catch-up the occurrences missed while the process was
+// down are skipped and only the ones due today are written
+func (t templates) Materialize(catchup bool) (int, error) {
+	var list []recurrence
+	if err := t.dbInstance.Where("paused = ?", false).Find(&list).Error; err != nil {
+		return 0, err
+	}
+
+	today := _day(t.clock())
+	created := 0
+
+	for _, item := range list {
+		rule, err := _parseRule(item.Rule)
+		if err != nil {
+			log.Printf("warning: template %d has a broken rule: %s\n", item.ID, err)
+			continue
+		}
+
+		after := item.Start.AddDate(0, 0, -1)
+		if item.LastRun != nil {
+			after = *item.LastRun
+		}
+
+		if yesterday := today.AddDate(0, 0, -1); !catchup && after.Before(yesterday) {
+			after = yesterday
+		}
+
+		until := today
+		if item.Until != nil && item.Until.Before(until) {
+			until = *item.Until
+		}
+
+		var reg expenses.Transactions
+		for _, date := range rule.Occurrences(item.Start, after, until, 0) {
+			reg = append(reg, item.Transaction(date))
+		}
+
+		if len(reg) > 0 {
+			ctx := expenses.PushContext{Storage: t.dbInstance, BatchSize: t.dbBatchSize, JustAppend: true}
+			if err := reg.Push(ctx); err != nil {
+				return created, err
+			}
+
+			for _, hook := range registryHooks {
+				hook(t.dbInstance, reg)
+			}
+
+			created += len(reg)
+		}
+
+		if err := t.dbInstance.Model(&item).UpdateColumn("last_run", today).Error; err != nil {
+			return created, err
+		}
+	}
+
+	if created > 0 {
+		_cacheReset()
+	}
+
+	return created, nil
+}
+
+// Schedule starts the background routine to materialize templates; the first
+// run happens right away to recover after downtime
+func (t templates) Schedule(every time.Duration, catchup bool) {
+	go func() {
+		for {
+			if created, err := t.Materialize(catchup); err != nil {
+				log.Printf("warning: scheduler failed to materialize templates: %s\n", err)
+			} else if created > 0 {
+				log.Printf("Scheduler materialized %d transaction(s) from templates\n", created)
+			}
+
+			catchup = true // no downtime between runs
+			time.Sleep(every)
+		}
+	}()
+}
+
+func (t templates) readJsonTemplates(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	var list []recurrence
+	if err := t.dbInstance.Order("id").Find(&list).Error; err != nil {
+		response.Fault(err, rq)
+	} else if out, err := expenses.ToJson(list); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(out, false, time.Since(startTime), rq)
+	}
+}
+
+func (t templates) writeJsonTemplates(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	var list []recurrence
+	if payload, err := ioutil.ReadAll(rq.Body); err != nil { // TODO: avoid ioutil because of memory issues?
+		response.Wrong(err, rq)
+		return // wrong payload, don't continue
+	} else if err := expenses.FromJson(payload, &list); err != nil {
+		response.Wrong(err, rq)
+		return // wrong payload, can't continue
+	}
+
+	for i := range list {
+		if err := list[i].BeforeSave(nil); err != nil {
+			response.Wrong(err, rq)
+			return // invalid template, can't continue
+		}
+	}
+
+	if len(list) > 0 {
+		if err := t.dbInstance.CreateInBatches(&list, t.dbBatchSize).Error; err != nil {
+			response.Fault(err, rq)
+			return
+		}
+	}
+
+	if out, err := expenses.ToJson(list); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(out, false, time.Since(startTime), rq)
+	}
+}
+
+func (t templates) readJsonTemplate(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	var item recurrence
+	if err := t.dbInstance.First(&item, mux.Vars(rq)["id"]).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		response.Missing(err, rq)
+	} else if err != nil {
+		response.Fault(err, rq)
+	} else if out, err := expenses.ToJson(item); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(out, false, time.Since(startTime), rq)
+	}
+}
+
+func (t templates) updateJsonTemplate(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	var item recurrence
+	if err := t.dbInstance.First(&item, mux.Vars(rq)["id"]).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		response.Missing(err, rq)
+		return
+	} else if err != nil {
+		response.Fault(err, rq)
+		return
+	}
+
+	id, lastRun := item.ID, item.LastRun
+	if payload, err := ioutil.ReadAll(rq.Body); err != nil { // TODO: avoid ioutil because of memory issues?
+		response.Wrong(err, rq)
+		return // wrong payload, don't continue
+	} else if err := expenses.FromJson(payload, &item); err != nil {
+		response.Wrong(err, rq)
+		return // wrong payload, can't continue
+	}
+
+	item.ID, item.LastRun = id, lastRun // owned by the scheduler
+	if err := item.BeforeSave(nil); err != nil {
+		response.Wrong(err, rq)
+	} else if err := t.dbInstance.Save(&item).Error; err != nil {
+		response.Fault(err, rq)
+	} else if out, err := expenses.ToJson(item); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(out, false, time.Since(startTime), rq)
+	}
+}
+
+func (t templates) deleteJsonTemplate(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	if res := t.dbInstance.Delete(&recurrence{}, mux.Vars(rq)["id"]); res.Error != nil {
+		response.Fault(res.Error, rq)
+	} else if res.RowsAffected == 0 {
+		response.Missing(gorm.ErrRecordNotFound, rq)
+	} else {
+		response.Okay([]byte(fmt.Sprintf(`{"deleted":%d}`, res.RowsAffected)), false, time.Since(startTime), rq)
+	}
+}
+
+const TEMPLATES_PREVIEW_COUNT = 12
+
+func (t templates) preview(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	count := TEMPLATES_PREVIEW_COUNT
+	if value := rq.URL.Query().Get("count"); value != "" {
+		if n, err := strconv.Atoi(value); err != nil || n < 1 {
+			response.Wrong(fmt.Errorf("count must be a positive number, got %q", value), rq)
+			return
+		} else {
+			count = n
+		}
+	}
+
+	var item recurrence
+	if err := t.dbInstance.First(&item, mux.Vars(rq)["id"]).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		response.Missing(err, rq)
+		return
+	} else if err != nil {
+		response.Fault(err, rq)
+		return
+	}
+
+	rule, err := _parseRule(item.Rule)
+	if err != nil {
+		response.Fault(err, rq)
+		return
+	}
+
+	after := _day(t.clock())
+	if item.LastRun != nil && item.LastRun.After(after) {
+		after = *item.LastRun
+	}
+
+	until := after.AddDate(100, 0, 0) // far enough, the count limits it anyway
+	if item.Until != nil {
+		until = *item.Until
+	}
+
+	upcoming := make(expenses.Transactions, 0, count)
+	for _, date := range rule.Occurrences(item.Start, after, until, count) {
+		upcoming = append(upcoming, item.Transaction(date))
+	}
+
+	if out, err := expenses.ToJson(upcoming); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(out, false, time.Since(startTime), rq)
+	}
+}
+
+func (t templates) run(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	if created, err := t.Materialize(true); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay([]byte(fmt.Sprintf(`{"created":%d}`, created)), false, time.Since(startTime), rq)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lexndru/expenses"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+var (
+	templatesDBInstance = sqlite.Open("file::memory:")
+	templatesHttpRouter *mux.Router
+	templatesModule     templates
+	templatesFakeNow    = time.Date(2021, 3, 15, 10, 0, 0, 0, time.Local)
+)
+
+func init() {
+	if db, err := gorm.Open(templatesDBInstance, &gorm.Config{}); err != nil {
+		panic(err)
+	} else {
+		templatesHttpRouter = mux.NewRouter()
+
+		expenses.Install(db)
+
+		templatesModule = templates{db, 10, func() time.Time { return templatesFakeNow }}
+		if err := templatesModule.Install(); err != nil {
+			panic(err)
+		}
+
+		templatesModule.Setup(templatesHttpRouter)
+	}
+}
+
+func _dates(dates []time.Time) []string {
+	out := make([]string, len(dates))
+	for i, date := range dates {
+		out[i] = date.Format("2006-01-02")
+	}
+
+	return out
+}
+
+func TestRecurrenceRules(t *testing.T) {
+	start := time.Date(2021, 1, 31, 0, 0, 0, 0, time.Local)
+	after := start.AddDate(0, 0, -1)
+	until := time.Date(2021, 4, 30, 0, 0, 0, 0, time.Local)
+
+	cases := map[string][]string{
+		"FREQ=MONTHLY":                                  {"2021-01-31", "2021-02-28", "2021-03-31", "2021-04-30"},
+		"FREQ=MONTHLY;BYMONTHDAY=5":                     {"2021-02-05", "2021-03-05", "2021-04-05"},
+		"FREQ=WEEKLY;INTERVAL=4":                        {"2021-01-31", "2021-02-28", "2021-03-28", "2021-04-25"},
+		"FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1": {"2021-02-26", "2021-03-31", "2021-04-30"},
+		"freq=yearly":                                   {"2021-01-31"},
+	}
+
+	for value, expected := range cases {
+		rule, err := _parseRule(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := _dates(rule.Occurrences(start, after, until, 0))
+		if len(got) != len(expected) {
+			t.Fatalf("Expected %v for %s but got %v", expected, value, got)
+		}
+
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Fatalf("Expected %v for %s but got %v", expected, value, got)
+			}
+		}
+	}
+
+	for _, wrong := range []string{"", "FREQ=HOURLY", "FREQ=WEEKLY;BYSETPOS=1", "FREQ=MONTHLY;BYMONTHDAY=0", "FREQ=DAILY;COUNT=3"} {
+		if _, err := _parseRule(wrong); err == nil {
+			t.Fatalf("Expected error for rule %q", wrong)
+		}
+	}
+
+	rule, _ := _parseRule("FREQ=MONTHLY;BYDAY=MO;BYSETPOS=6")
+	if got := rule.Occurrences(start, after, until, 0); len(got) != 0 {
+		t.Fatalf("Expected no occurrences for a 6th monday but got %v", got)
+	}
+}
+
+func TestMaterializeTemplatesWithCatchUp(t *testing.T) {
+	payload := []byte(`[
+		{"name":"Chirie","rule":"FREQ=MONTHLY;BYMONTHDAY=5","start":"2021-01-01T00:00:00Z","amount":-150000,"label":"Chirie","sender":"Me","receiver":"Landlord","signature":"rent"},
+		{"name":"Netflix","rule":"FREQ=MONTHLY;BYMONTHDAY=15","start":"2021-01-01T00:00:00Z","amount":-4000,"label":"Abonamente","sender":"Me","receiver":"Netflix","signature":"subscriptions"}
+	]`)
+
+	buf := httptest.NewRecorder()
+	templatesHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/templates", bytes.NewReader(payload)))
+
+	if reply := buf.Result(); reply.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(reply.Body)
+		t.Fatalf("Expected 200 OK after POST but got %v: %s", reply.StatusCode, body)
+	}
+
+	// without catch-up only today's occurrence is written
+	if created, err := templatesModule.Materialize(false); err != nil {
+		t.Fatal(err)
+	} else if created != 1 {
+		t.Fatalf("Expected only today's occurrence without catch-up but got %d", created)
+	}
+
+	templatesFakeNow = templatesFakeNow.AddDate(0, 2, 0) // two months of downtime
+
+	if created, err := templatesModule.Materialize(true); err != nil {
+		t.Fatal(err)
+	} else if created != 4 {
+		t.Fatalf("Expected 4 missed occurrences with catch-up but got %d", created)
+	}
+
+	if created, _ := templatesModule.Materialize(true); created != 0 {
+		t.Fatalf("Expected nothing due on a second run but got %d", created)
+	}
+
+	var count int64
+	templatesModule.dbInstance.Model(&expenses.Transaction{}).Where("signature = ?", "rent").Count(&count)
+
+	if count != 2 {
+		t.Fatalf("Expected 2 rent transactions for april and may but got %d", count)
+	}
+}
+
+func TestPreviewTemplateOccurrences(t *testing.T) {
+	buf := httptest.NewRecorder()
+	templatesHttpRouter.ServeHTTP(buf, httptest.NewRequest("GET", "/templates/1/preview?count=3", nil))
+	reply := buf.Result()
+
+	if reply.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 OK for preview but got %v", reply.StatusCode)
+	}
+
+	var upcoming expenses.Transactions
+	body, _ := io.ReadAll(reply.Body)
+	if err := json.Unmarshal(body, &upcoming); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(upcoming) != 3 || upcoming[0].Date.Format("2006-01-02") != "2021-06-05" {
+		t.Fatalf("Expected 3 upcoming occurrences starting with june but got %v", upcoming)
+	}
+
+	buf2 := httptest.NewRecorder()
+	templatesHttpRouter.ServeHTTP(buf2, httptest.NewRequest("PUT", "/templates/1", bytes.NewReader([]byte(`{"rule":"FREQ=FORTNIGHTLY"}`))))
+
+	if reply := buf2.Result(); reply.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 Bad Request for unsupported rule but got %v", reply.StatusCode)
+	}
+
+	buf3 := httptest.NewRecorder()
+	templatesHttpRouter.ServeHTTP(buf3, httptest.NewRequest("DELETE", "/templates/42", nil))
+
+	if reply := buf3.Result(); reply.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 Not Found for missing template but got %v", reply.StatusCode)
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// TLS_RELOAD_INTERVAL is how often certificate files are checked for changes
+const TLS_RELOAD_INTERVAL = 30 * time.Second
+
+// self-signed certificates are kept next to the state file for first-run
+// setups and regenerated when they expire
+const (
+	TLS_SELFSIGNED_CERT     = "gospodapi.crt"
+	TLS_SELFSIGNED_KEY      = "gospodapi.key"
+	TLS_SELFSIGNED_VALIDITY = 365 * 24 * time.Hour
+)
+
+// certificates serves the certificate of the server and reloads it when its
+// files change, so renewals don't require a restart
+type certificates struct {
+	certFile string
+	keyFile  string
+
+	lock     sync.RWMutex
+	current  *tls.Certificate
+	modified time.Time
+}
+
+func newCertificates(certFile, keyFile string) (*certificates, error) {
+	c := &certificates{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// _modifiedAt is the latest change of the certificate or the key file
+func (c *certificates) _modifiedAt() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// Reload loads the certificate from its files; the current one is kept if
+// they can't be loaded, e.g. halfway through a renewal
+func (c *certificates) Reload() error {
+	modified, err := c._modifiedAt()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.current, c.modified = &cert, modified
+
+	return nil
+}
+
+// Changed is true if the files were modified since they were last loaded
+func (c *certificates) Changed() bool {
+	modified, err := c._modifiedAt()
+	if err != nil {
+		return false
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return modified.After(c.modified)
+}
+
+// Watch reloads the certificate on SIGHUP or when its files change
+func (c *certificates) Watch(interval time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hangup:
+		case <-ticker.C:
+			if !c.Changed() {
+				continue
+			}
+		}
+
+		if err := c.Reload(); err != nil {
+			log.Printf("warning: cannot reload certificate %s: %s\n", c.certFile, err)
+		} else {
+			log.Printf("Reloaded certificate %s\n", c.certFile)
+		}
+	}
+}
+
+func (c *certificates) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.current, nil
+}
+
+// _clientAuthorities loads a bundle of PEM certificates to verify clients
+func _clientAuthorities(bundle string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", bundle)
+	}
+
+	return pool, nil
+}
+
+// _selfSigned generates a PEM certificate and key for the given hosts, valid
+// for both servers and clients, which can also sign other certificates
+func _selfSigned(hosts []string, validity time.Duration) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"gospodapi"}, CommonName: hosts[0]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return certPEM, keyPEM, nil
+}
+
+// _ensureSelfSigned writes a self-signed certificate for this host unless a
+// valid one already exists; files of the user are never overwritten, so they
+// are only generated if both are missing or owned by the process
+func _ensureSelfSigned(certFile, keyFile string, owned bool) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil && time.Now().Before(leaf.NotAfter) {
+			return nil
+		} else if !owned {
+			log.Printf("warning: certificate %s is expired or invalid\n", certFile)
+			return nil
+		}
+	} else if !owned && (_exists(certFile) || _exists(keyFile)) {
+		return err
+	}
+
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		hosts = append(hosts, hostname)
+	}
+
+	certPEM, keyPEM, err := _selfSigned(hosts, TLS_SELFSIGNED_VALIDITY)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+
+	log.Printf("Generated self-signed certificate %s for %v\n", certFile, hosts)
+
+	return ioutil.WriteFile(certFile, certPEM, 0644)
+}
+
+// _exists is true unless the file is certainly missing
+func _exists(file string) bool {
+	_, err := os.Stat(file)
+	return !os.IsNotExist(err)
+}
+
+// _tlsConfig returns the tls configuration of the server, or nil to serve
+// plain http; clients must present a certificate signed by clientCA if given
+func _tlsConfig(certFile, keyFile, clientCA string, selfSigned bool) (*tls.Config, *certificates, error) {
+	if selfSigned {
+		owned := certFile == "" && keyFile == ""
+		if owned {
+			dir := filepath.Dir(args.configName)
+			certFile, keyFile = filepath.Join(dir, TLS_SELFSIGNED_CERT), filepath.Join(dir, TLS_SELFSIGNED_KEY)
+		}
+
+		if certFile != "" && keyFile != "" { // otherwise reported below
+			if err := _ensureSelfSigned(certFile, keyFile, owned); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if certFile == "" && keyFile == "" {
+		if clientCA != "" {
+			return nil, nil, errors.New("client certificates require -tls-cert and -tls-key")
+		}
+
+		return nil, nil, nil
+	} else if certFile == "" || keyFile == "" {
+		return nil, nil, errors.New("tls requires both -tls-cert and -tls-key")
+	}
+
+	certs, err := newCertificates(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+
+	if clientCA != "" {
+		if cfg.ClientCAs, err = _clientAuthorities(clientCA); err != nil {
+			return nil, nil, err
+		}
+
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, certs, nil
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func _writeSelfSigned(t *testing.T, certFile, keyFile string, hosts ...string) []byte {
+	certPEM, keyPEM, err := _selfSigned(hosts, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certPEM
+}
+
+func _serialOf(t *testing.T, c *certificates) string {
+	cert, _ := c.GetCertificate(nil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return leaf.SerialNumber.String()
+}
+
+func TestCertificatesReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+
+	_writeSelfSigned(t, certFile, keyFile, "localhost")
+	certs, err := newCertificates(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial := _serialOf(t, certs)
+	if certs.Changed() {
+		t.Fatal("Expected certificate to be current right after loading")
+	}
+
+	_writeSelfSigned(t, certFile, keyFile, "localhost")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+
+	if !certs.Changed() {
+		t.Fatal("Expected certificate to be changed after renewal")
+	} else if err := certs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	renewed := _serialOf(t, certs)
+	if renewed == serial {
+		t.Fatalf("Expected a new certificate after reload but still got %s", serial)
+	}
+
+	ioutil.WriteFile(certFile, []byte("halfway through a renewal"), 0644)
+	if err := certs.Reload(); err == nil {
+		t.Fatal("Expected reload to fail for an invalid certificate")
+	} else if _serialOf(t, certs) != renewed {
+		t.Fatal("Expected the previous certificate to be kept after a failed reload")
+	}
+}
+
+func TestTlsConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "self.crt"), filepath.Join(dir, "self.key")
+
+	if cfg, _, err := _tlsConfig("", "", "", false); cfg != nil || err != nil {
+		t.Fatalf("Expected plain http without certificates but got %v (%v)", cfg, err)
+	}
+
+	if _, _, err := _tlsConfig(certFile, "", "", false); err == nil {
+		t.Fatal("Expected an error for a certificate without key")
+	}
+
+	if _, _, err := _tlsConfig("", "", certFile, false); err == nil {
+		t.Fatal("Expected an error for client certificates without tls")
+	}
+
+	if cfg, _, err := _tlsConfig(certFile, keyFile, "", true); err != nil || cfg == nil {
+		t.Fatalf("Expected a self-signed certificate to be generated but got %v", err)
+	}
+
+	generated, _ := ioutil.ReadFile(certFile)
+	if _, _, err := _tlsConfig(certFile, keyFile, "", true); err != nil {
+		t.Fatal(err)
+	} else if again, _ := ioutil.ReadFile(certFile); string(again) != string(generated) {
+		t.Fatal("Expected a valid self-signed certificate to be reused")
+	}
+
+	// files of the user are reported rather than overwritten
+	ioutil.WriteFile(keyFile, []byte("not a key"), 0600)
+	if _, _, err := _tlsConfig(certFile, keyFile, "", true); err == nil {
+		t.Fatal("Expected an error for a key which cannot be loaded")
+	} else if again, _ := ioutil.ReadFile(certFile); string(again) != string(generated) {
+		t.Fatal("Expected the certificate of the user to be kept")
+	}
+
+	defer func(configName string) { args.configName = configName }(args.configName)
+	args.configName = filepath.Join(dir, "state", ".gospodapi")
+	os.Mkdir(filepath.Dir(args.configName), 0755)
+
+	if cfg, _, err := _tlsConfig("", "", "", true); err != nil || cfg == nil {
+		t.Fatalf("Expected a self-signed certificate next to the state file but got %v", err)
+	} else if _, err := os.Stat(filepath.Join(dir, "state", TLS_SELFSIGNED_CERT)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTlsClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverKey := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	deviceCert, deviceKey := filepath.Join(dir, "device.crt"), filepath.Join(dir, "device.key")
+	strangerCert, strangerKey := filepath.Join(dir, "stranger.crt"), filepath.Join(dir, "stranger.key")
+
+	serverPEM := _writeSelfSigned(t, serverCert, serverKey, "127.0.0.1")
+	_writeSelfSigned(t, deviceCert, deviceKey, "device")
+	_writeSelfSigned(t, strangerCert, strangerKey, "stranger")
+
+	cfg, _, err := _tlsConfig(serverCert, serverKey, deviceCert, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(wr http.ResponseWriter, rq *http.Request) {
+		wr.Write([]byte(rq.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.Listener = tls.NewListener(server.Listener, cfg) // StartTLS would set its own certificate
+	server.Start()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(serverPEM)
+
+	connect := func(certFile, keyFile string) (string, error) {
+		clientCfg := &tls.Config{RootCAs: roots}
+		if certFile != "" {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientCfg.Certificates = []tls.Certificate{cert}
+		}
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientCfg}}
+		reply, err := client.Get("https://" + server.Listener.Addr().String())
+		if err != nil {
+			return "", err
+		}
+		defer reply.Body.Close()
+
+		body, err := ioutil.ReadAll(reply.Body)
+		return string(body), err
+	}
+
+	if _, err := connect("", ""); err == nil {
+		t.Fatal("Expected clients without certificate to be rejected")
+	}
+
+	if _, err := connect(strangerCert, strangerKey); err == nil {
+		t.Fatal("Expected clients with an unknown certificate to be rejected")
+	}
+
+	if name, err := connect(deviceCert, deviceKey); err != nil || name != "device" {
+		t.Fatalf("Expected household device to connect but got %q (%v)", name, err)
+	}
+}
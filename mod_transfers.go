@@ -0,0 +1,274 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lexndru/expenses"
+
+	"gorm.io/gorm"
+)
+
+type transfers struct {
+	dbInstance  *gorm.DB
+	dbBatchSize int
+}
+
+func (t transfers) Install() error {
+	return t.dbInstance.AutoMigrate(&transfer{})
+}
+
+func (t transfers) Setup(router *mux.Router) {
+	router.HandleFunc("/transfers", t.readJsonTransfers).Methods(http.MethodGet)
+	router.HandleFunc("/transfers", t.writeJsonTransfers).Methods(http.MethodPost)
+	router.HandleFunc("/transfers/candidates", t.detect).Methods(http.MethodGet)
+	router.HandleFunc("/transfers/{uuid}", t.unlink).Methods(http.MethodDelete)
+}
+
+// transfer links two transactions from different signatures which are the
+// same money moving between accounts (e.g. from checking to savings)
+type transfer struct {
+	OutgoingUUID string    `json:"outgoing" gorm:"type: varchar(36); primaryKey"`
+	IncomingUUID string    `json:"incoming" gorm:"type: varchar(36); uniqueIndex; not null"`
+	Amount       int64     `json:"amount" gorm:"not null"`
+	CreatedAt    time.Time `json:"-" gorm:"autoCreateTime"`
+}
+
+type transferCandidate struct {
+	Grade    int                  `json:"grade"`
+	Outgoing expenses.Transaction `json:"outgoing"`
+	Incoming expenses.Transaction `json:"incoming"`
+}
+
+const TRANSFER_DAYS_TOLERANCE = 3
+
+func (t transfers) readJsonTransfers(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	var links []transfer
+	if err := t.dbInstance.Order("created_at DESC").Find(&links).Error; err != nil {
+		response.Fault(err, rq)
+	} else if out, err := expenses.ToJson(links); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(out, false, time.Since(startTime), rq)
+	}
+}
+
+func (t transfers) writeJsonTransfers(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	var links []transfer
+	if payload, err := ioutil.ReadAll(rq.Body); err != nil { // TODO: avoid ioutil because of memory issues?
+		response.Wrong(err, rq)
+		return // wrong payload, don't continue
+	} else if err := expenses.FromJson(payload, &links); err != nil {
+		response.Wrong(err, rq)
+		return // wrong payload, can't continue
+	}
+
+	for i, link := range links {
+		if amount, err := _validateTransfer(t.dbInstance, link); err != nil {
+			response.Wrong(err, rq)
+			return // cannot link unrelated transactions
+		} else {
+			links[i].Amount = amount
+		}
+	}
+
+	if len(links) > 0 {
+		if err := t.dbInstance.CreateInBatches(&links, t.dbBatchSize).Error; err != nil {
+			response.Fault(err, rq)
+			return
+		}
+	}
+
+	if out, err := expenses.ToJson(links); err != nil {
+		response.Fault(err, rq)
+	} else {
+		response.Okay(out, false, time.Since(startTime), rq)
+		// linked transfers are left out from reports, therefore every cached
+		// response may be outdated
+		_cacheReset()
+	}
+}
+
+func (t transfers) unlink(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	params := mux.Vars(rq)
+	key := params["uuid"]
+
+	query := t.dbInstance.Where("outgoing_uuid = ? or incoming_uuid = ?", key, key)
+	if res := query.Delete(&transfer{}); res.Error != nil {
+		response.Fault(res.Error, rq)
+	} else {
+		response.Okay([]byte(fmt.Sprintf(`{"unlinked":%d}`, res.RowsAffected)), false, time.Since(startTime), rq)
+		_cacheReset()
+	}
+}
+
+func (t transfers) detect(wr http.ResponseWriter, rq *http.Request) {
+	response := Response{wr}
+	startTime := time.Now()
+
+	days := TRANSFER_DAYS_TOLERANCE
+	if value := rq.URL.Query().Get("days"); value != "" {
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			response.Wrong(fmt.Errorf("days must be a positive number, got %q", value), rq)
+			return
+		} else {
+			days = n
+		}
+	}
+
+	var outgoing, incoming expenses.Transactions
+
+	ctxOut := expenses.PullContext{
+		Storage: t.dbInstance.Scopes(_withoutTransfers).Where("amount < 0"),
+		Limit:   t.dbBatchSize,
+	}
+
+	ctxIn := expenses.PullContext{
+		Storage: t.dbInstance.Scopes(_withoutTransfers).Where("amount > 0"),
+		Limit:   t.dbBatchSize,
+	}
+
+	if err := outgoing.Pull(ctxOut); err != nil {
+		response.Fault(err, rq)
+	} else if err := incoming.Pull(ctxIn); err != nil {
+		response.Fault(err, rq)
+	} else {
+		tolerance := time.Duration(days) * 24 * time.Hour
+		candidates := _detectTransfers(outgoing, incoming, tolerance)
+
+		if out, err := expenses.ToJson(candidates); err != nil {
+			response.Fault(err, rq)
+		} else {
+			response.Okay(out, false, time.Since(startTime), rq)
+		}
+	}
+}
+
+// _withoutTransfers is a query scope on transactions to leave out linked
+// transfers from income/expense reports
+func _withoutTransfers(db *gorm.DB) *gorm.DB {
+	outgoing := db.Session(&gorm.Session{NewDB: true}).Model(&transfer{}).Select("outgoing_uuid")
+	incoming := db.Session(&gorm.Session{NewDB: true}).Model(&transfer{}).Select("incoming_uuid")
+
+	return db.Where("uuid not in (?)", outgoing).Where("uuid not in (?)", incoming)
+}
+
+func _validateTransfer(db *gorm.DB, link transfer) (int64, error) {
+	var out, in expenses.Transaction
+
+	if err := db.Where("uuid = ?", link.OutgoingUUID).First(&out).Error; err != nil {
+		return 0, fmt.Errorf("outgoing transaction %q: %w", link.OutgoingUUID, err)
+	}
+
+	if err := db.Where("uuid = ?", link.IncomingUUID).First(&in).Error; err != nil {
+		return 0, fmt.Errorf("incoming transaction %q: %w", link.IncomingUUID, err)
+	}
+
+	if out.Amount >= 0 || in.Amount != -out.Amount {
+		return 0, errors.New("transfer must link a negative amount with its positive counterpart")
+	}
+
+	if out.Signature == in.Signature {
+		return 0, errors.New("transfer must link transactions from different signatures")
+	}
+
+	return in.Amount, nil
+}
+
+func _detectTransfers(outgoing, incoming expenses.Transactions, tolerance time.Duration) []transferCandidate {
+	type pair struct {
+		grade   int
+		gap     time.Duration
+		out, in int
+	}
+
+	pairs := make([]pair, 0)
+	for i, out := range outgoing {
+		source := _fromTransaction(out)
+
+		for j, in := range incoming {
+			if in.Signature == out.Signature {
+				continue // transfers happen between different signatures
+			}
+
+			if grade := source.CompareWithTransfer(in, tolerance); grade > 0 {
+				gap := in.Date.Sub(out.Date)
+				if gap < 0 {
+					gap *= -1
+				}
+
+				pairs = append(pairs, pair{grade, gap, i, j})
+			}
+		}
+	}
+
+	// best graded pairs are picked first and closest dates break the ties
+	sort.SliceStable(pairs, func(i, j int) bool {
+		if pairs[i].grade == pairs[j].grade {
+			return pairs[i].gap < pairs[j].gap
+		}
+
+		return pairs[i].grade > pairs[j].grade
+	})
+
+	candidates := make([]transferCandidate, 0)
+	pairedOut := make(map[int]bool)
+	pairedIn := make(map[int]bool)
+
+	for _, p := range pairs {
+		if pairedOut[p.out] || pairedIn[p.in] {
+			continue // each transaction can only be one side of a transfer
+		}
+
+		pairedOut[p.out], pairedIn[p.in] = true, true
+		candidates = append(candidates, transferCandidate{
+			Grade:    p.grade,
+			Outgoing: outgoing[p.out],
+			Incoming: incoming[p.in],
+		})
+	}
+
+	return candidates
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2021 Alexandru Catrina <alex@codeissues.net>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+//    list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+//    this list of conditions and the following disclaimer in the documentation
+//    and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+//    contributors may be used to endorse or promote products derived from
+//    this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lexndru/expenses"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+var (
+	transfersDBInstance = sqlite.Open("file::memory:")
+	transfersHttpRouter *mux.Router
+)
+
+func init() {
+	if db, err := gorm.Open(transfersDBInstance, &gorm.Config{}); err != nil {
+		panic(err)
+	} else {
+		transfersHttpRouter = mux.NewRouter()
+
+		expenses.Install(db)
+
+		mod := transfers{db, 10}
+		if err := mod.Install(); err != nil {
+			panic(err)
+		}
+
+		mod.Setup(transfersHttpRouter)
+
+		day := func(d int) time.Time {
+			return time.Date(2021, 3, d, 0, 0, 0, 0, time.UTC)
+		}
+
+		keys := []string{
+			"9a5e4a3e-1b65-4c2b-9d6e-000000000001",
+			"9a5e4a3e-1b65-4c2b-9d6e-000000000002",
+			"9a5e4a3e-1b65-4c2b-9d6e-000000000003",
+			"9a5e4a3e-1b65-4c2b-9d6e-000000000004",
+		}
+
+		seed := expenses.Transactions{
+			{UUID: &keys[0], Date: day(1), Amount: -50000, LabelName: "Economii", SenderName: "Me", ReceiverName: "Savings", Signature: "checking"},
+			{UUID: &keys[1], Date: day(2), Amount: 50000, LabelName: "Economii", SenderName: "Me", ReceiverName: "Savings", Signature: "savings"},
+			{UUID: &keys[2], Date: day(2), Amount: -50000, LabelName: "Alimente", SenderName: "Me", ReceiverName: "Market", Signature: "checking"},
+			{UUID: &keys[3], Date: day(20), Amount: 50000, LabelName: "Salariu", SenderName: "Work", ReceiverName: "Me", Signature: "savings"},
+		}
+
+		if err := seed.Push(expenses.PushContext{Storage: db, BatchSize: 10}); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestDetectTransferCandidates(t *testing.T) {
+	buf := httptest.NewRecorder()
+	transfersHttpRouter.ServeHTTP(buf, httptest.NewRequest("GET", "/transfers/candidates", nil))
+	reply := buf.Result()
+
+	if reply.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 OK but got %v", reply.StatusCode)
+	}
+
+	body, _ := io.ReadAll(reply.Body)
+
+	var candidates []transferCandidate
+	if err := json.Unmarshal(body, &candidates); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(candidates) != 1 {
+		t.Fatalf("Expected one transfer candidate within tolerance but got %d", len(candidates))
+	}
+
+	if out := *candidates[0].Outgoing.UUID; out != "9a5e4a3e-1b65-4c2b-9d6e-000000000001" {
+		t.Fatalf("Expected savings transfer to be paired by actors but got %s", out)
+	}
+
+	if candidates[0].Grade != 8+1+2+4 {
+		t.Fatalf("Expected full transfer grade but got %d", candidates[0].Grade)
+	}
+
+	buf2 := httptest.NewRecorder()
+	transfersHttpRouter.ServeHTTP(buf2, httptest.NewRequest("GET", "/transfers/candidates?days=x", nil))
+
+	if reply2 := buf2.Result(); reply2.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 Bad Request for wrong tolerance but got %v", reply2.StatusCode)
+	}
+}
+
+func TestConfirmAndUnlinkTransfers(t *testing.T) {
+	wrong := []byte(`[{"outgoing":"9a5e4a3e-1b65-4c2b-9d6e-000000000001","incoming":"9a5e4a3e-1b65-4c2b-9d6e-000000000003"}]`)
+
+	buf := httptest.NewRecorder()
+	transfersHttpRouter.ServeHTTP(buf, httptest.NewRequest("POST", "/transfers", bytes.NewReader(wrong)))
+
+	if reply := buf.Result(); reply.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 Bad Request when linking same signature but got %v", reply.StatusCode)
+	}
+
+	payload := []byte(`[{"outgoing":"9a5e4a3e-1b65-4c2b-9d6e-000000000001","incoming":"9a5e4a3e-1b65-4c2b-9d6e-000000000002"}]`)
+
+	buf2 := httptest.NewRecorder()
+	transfersHttpRouter.ServeHTTP(buf2, httptest.NewRequest("POST", "/transfers", bytes.NewReader(payload)))
+
+	if reply := buf2.Result(); reply.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 OK after linking but got %v", reply.StatusCode)
+	}
+
+	buf3 := httptest.NewRecorder()
+	transfersHttpRouter.ServeHTTP(buf3, httptest.NewRequest("GET", "/transfers/candidates?days=30", nil))
+
+	var candidates []transferCandidate
+	body, _ := io.ReadAll(buf3.Result().Body)
+	if err := json.Unmarshal(body, &candidates); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, candidate := range candidates {
+		if *candidate.Outgoing.UUID == "9a5e4a3e-1b65-4c2b-9d6e-000000000001" {
+			t.Fatal("Expected linked transfer to be excluded from candidates")
+		}
+	}
+
+	buf4 := httptest.NewRecorder()
+	transfersHttpRouter.ServeHTTP(buf4, httptest.NewRequest("DELETE", "/transfers/9a5e4a3e-1b65-4c2b-9d6e-000000000002", nil))
+
+	if body, _ := io.ReadAll(buf4.Result().Body); string(body) != fmt.Sprintf(`{"unlinked":%d}`, 1) {
+		t.Fatalf("Expected one transfer to be unlinked but got %s", body)
+	}
+}